@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+// getVM returns the VM named `vmName` or nil if it doesn't exist.
+func getVM(ctx context.Context, vmName string) (*serverapi.ListVMResponse, error) {
+	resp, httpResp, err := apiClient.DefaultAPI.VmNameGet(ctx, vmName).Execute()
+	if httpResp != nil && httpResp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apiError("get VM", httpResp, err)
+	}
+	return resp, nil
+}
+
+func createVMFromManifest(ctx context.Context, manifest vmManifest) error {
+	_, httpResp, err := apiClient.DefaultAPI.
+		VmStartPost(ctx).
+		StartVMRequest(manifest.toStartVMRequest()).Execute()
+	if err != nil {
+		return apiError("start VM", httpResp, err)
+	}
+	return nil
+}
+
+// checkManifest has the server check that the VM of `manifest` could replace
+// the existing VM of the same name, e.g. that it fits the tenant's quota.
+func checkManifest(ctx context.Context, manifest vmManifest) error {
+	req := manifest.toStartVMRequest()
+	req.DryRun = serverapi.PtrBool(true)
+	_, httpResp, err := apiClient.DefaultAPI.VmStartPost(ctx).StartVMRequest(req).Execute()
+	if err != nil {
+		return apiError("check VM", httpResp, err)
+	}
+	return nil
+}
+
+func destroyVMByName(ctx context.Context, vmName string) error {
+	vmRequest := serverapi.VMRequest{
+		VmName: serverapi.PtrString(vmName),
+	}
+	_, httpResp, err := apiClient.DefaultAPI.VmDestroyPost(ctx).VMRequest(vmRequest).Execute()
+	if err != nil {
+		return apiError("destroy VM", httpResp, err)
+	}
+	return nil
+}
+
+func uploadManifestFiles(ctx context.Context, manifest vmManifest) error {
+	if len(manifest.Files) == 0 {
+		return nil
+	}
+
+	req, err := manifest.toUploadFilesRequest()
+	if err != nil {
+		return err
+	}
+
+	_, httpResp, err := apiClient.DefaultAPI.
+		VmNameFilesPut(ctx, manifest.Name).
+		UploadFilesRequest(req).Execute()
+	if err != nil {
+		return apiError("upload files", httpResp, err)
+	}
+	return nil
+}
+
+// applyManifest converges the VM of `manifest`. VMs are created if they don't
+// exist and recreated if their spec changed. If `dryRun` is set the changes are
+// only printed.
+func applyManifest(ctx context.Context, manifest vmManifest, dryRun bool) error {
+	current, err := getVM(ctx, manifest.Name)
+	if err != nil {
+		return err
+	}
+
+	action := "created"
+	var changes []specChange
+	if current != nil {
+		changes = diffSpec(current.Spec, manifest)
+		action = "unchanged"
+		if len(changes) > 0 {
+			action = "recreated"
+		}
+
+		switch current.GetStatus() {
+		case "CRASHED", "EXITED":
+			action = "recreated"
+		case "STOPPED", "PAUSED":
+			if action == "unchanged" {
+				action = "started"
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("vm/%s %s (dry run)\n", manifest.Name, action)
+		for _, change := range changes {
+			fmt.Printf("  ~ %v\n", change)
+		}
+		return nil
+	}
+
+	switch action {
+	case "created", "started":
+		// Starting a stopped or paused VM boots or resumes it.
+		err = createVMFromManifest(ctx, manifest)
+	case "recreated":
+		// The VM can't be recreated in place so the new spec is checked first
+		// to not destroy the VM for a spec that fails to start.
+		err = checkManifest(ctx, manifest)
+		if err == nil {
+			err = destroyVMByName(ctx, manifest.Name)
+		}
+		if err == nil {
+			err = createVMFromManifest(ctx, manifest)
+			if err != nil {
+				return fmt.Errorf("vm/%s: destroyed the old VM but failed to create the new one: %w", manifest.Name, err)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("vm/%s: %w", manifest.Name, err)
+	}
+
+	err = uploadManifestFiles(ctx, manifest)
+	if err != nil {
+		return fmt.Errorf("vm/%s: %w", manifest.Name, err)
+	}
+
+	fmt.Printf("vm/%s %s\n", manifest.Name, action)
+	for _, change := range changes {
+		fmt.Printf("  ~ %v\n", change)
+	}
+	return nil
+}
+
+// applyFile applies every manifest in `path`, stopping at the first failure.
+func applyFile(path string, dryRun bool) error {
+	manifests, err := readManifests(path)
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range manifests {
+		err = applyManifest(context.Background(), manifest, dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFile destroys the VMs of the manifests in `path`. VMs that don't exist
+// are skipped.
+func deleteFile(path string) error {
+	manifests, err := readManifests(path)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, manifest := range manifests {
+		current, err := getVM(ctx, manifest.Name)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			fmt.Printf("vm/%s not found\n", manifest.Name)
+			continue
+		}
+
+		err = destroyVMByName(ctx, manifest.Name)
+		if err != nil {
+			return fmt.Errorf("vm/%s: %w", manifest.Name, err)
+		}
+		fmt.Printf("vm/%s deleted\n", manifest.Name)
+	}
+	return nil
+}
+
+// getVMManifest prints the manifest of the running VM `vmName` as YAML.
+func getVMManifest(vmName string, output string) error {
+	if output != "yaml" {
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	current, err := getVM(context.Background(), vmName)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFoundError(vmName)
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	err = encoder.Encode(manifestFromSpec(current.Spec))
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
+)
+
+// Exit codes of the CLI so that scripts can tell failures apart.
+const (
+	exitOK = 0
+	// Usage errors and anything not covered below.
+	exitError = 1
+	// The server rejected the request as invalid.
+	exitInvalid = 2
+	// The caller isn't authenticated or allowed to make the request.
+	exitUnauthorized = 3
+	// The VM or resource doesn't exist.
+	exitNotFound = 4
+	// The request conflicts with the current state e.g. the VM already exists.
+	exitConflict = 5
+	// A tenant quota or rate limit was hit.
+	exitQuota = 6
+	// The server couldn't be reached or failed.
+	exitUnavailable = 7
+	// A process run in a VM timed out, like timeout(1).
+	exitTimeout = 124
+)
+
+// requestError is the error of a failed API call.
+type requestError struct {
+	action string
+	// HTTP status code of the response, 0 if no response was received.
+	statusCode int
+	// Body of the response, if any.
+	message string
+	err     error
+}
+
+func (e *requestError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("failed to %s: %s (%d)", e.action, e.message, e.statusCode)
+	}
+	return fmt.Sprintf("failed to %s: %v", e.action, e.err)
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// processError is the result of a process run in a VM that didn't succeed.
+type processError struct {
+	status   string
+	exitCode int
+	message  string
+}
+
+func (e *processError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("process %s: %s", e.status, e.message)
+	}
+	return fmt.Sprintf("process %s with exit code: %d", e.status, e.exitCode)
+}
+
+// apiError returns the error of a failed API call, including the body of the
+// response if there's one.
+func apiError(action string, httpResp *http.Response, err error) error {
+	if httpResp == nil {
+		return &requestError{action: action, err: err}
+	}
+	body, _ := io.ReadAll(httpResp.Body)
+	return &requestError{
+		action:     action,
+		statusCode: httpResp.StatusCode,
+		message:    strings.TrimSpace(string(body)),
+		err:        err,
+	}
+}
+
+// notFoundError returns the error used when VM `vmName` doesn't exist.
+func notFoundError(vmName string) error {
+	return &requestError{
+		action:     "get VM",
+		statusCode: http.StatusNotFound,
+		message:    fmt.Sprintf("vm %s not found", vmName),
+	}
+}
+
+// exitCode returns the exit code of the CLI for `err`.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	// Processes run in VMs exit the CLI with their own exit code.
+	var procErr *processError
+	if errors.As(err, &procErr) {
+		if procErr.status == execstream.StatusTimeout {
+			return exitTimeout
+		}
+		if procErr.exitCode > 0 {
+			return procErr.exitCode
+		}
+		return exitError
+	}
+
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return exitError
+	}
+
+	switch code := reqErr.statusCode; {
+	case code == 0:
+		// No response means the server couldn't be reached.
+		return exitUnavailable
+	case code == http.StatusBadRequest:
+		return exitInvalid
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return exitUnauthorized
+	case code == http.StatusNotFound:
+		return exitNotFound
+	case code == http.StatusConflict:
+		return exitConflict
+	case code == http.StatusTooManyRequests:
+		return exitQuota
+	case code >= http.StatusInternalServerError:
+		return exitUnavailable
+	default:
+		return exitError
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Wait before reconnecting to a dropped event stream.
+const eventsReconnectInterval = 1 * time.Second
+
+type event struct {
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	VmName  string    `json:"vmName"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+func printEvent(e event) {
+	fmt.Printf("%d\t%s\t%s\t%s\t%s\n", e.ID, e.Time.Format(time.RFC3339), e.Type, e.VmName, e.Message)
+}
+
+// readEvents reads server-sent events from `body`, calling `handle` for each
+// of them.
+func readEvents(body io.Reader, handle func(event)) error {
+	scanner := bufio.NewScanner(body)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if data.Len() == 0 {
+				continue
+			}
+			var e event
+			err := json.Unmarshal([]byte(data.String()), &e)
+			if err != nil {
+				return fmt.Errorf("failed to parse event: %w", err)
+			}
+			handle(e)
+			data.Reset()
+
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	return scanner.Err()
+}
+
+// streamEventsOnce reads the event stream after event `since` till it ends.
+// Returns the ID of the last event it read.
+func streamEventsOnce(ctx context.Context, since uint64, follow bool) (uint64, error) {
+	url := fmt.Sprintf("%s/events?since=%d&follow=%v", serverURL, since, follow)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return since, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return since, apiError("get events", nil, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return since, apiError("get events", resp, errors.New(resp.Status))
+	}
+
+	lastID := since
+	err = readEvents(resp.Body, func(e event) {
+		printEvent(e)
+		lastID = e.ID
+	})
+	return lastID, err
+}
+
+// showEvents prints the retained events after `since`. If `follow` is set it
+// keeps printing new events, reconnecting if the stream drops.
+func showEvents(ctx context.Context, since uint64, follow bool) error {
+	for {
+		lastID, err := streamEventsOnce(ctx, since, follow)
+		if !follow || ctx.Err() != nil {
+			return err
+		}
+
+		if err != nil {
+			log.Warnf("event stream dropped: %v", err)
+		}
+		since = lastID
+		log.Debugf("reconnecting to event stream after event: %d", since)
+		time.Sleep(eventsReconnectInterval)
+	}
+}
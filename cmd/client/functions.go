@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+// tarCode returns a gzipped tar archive of `files` by their relative path.
+func tarCode(files map[string]string) ([]byte, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, path := range paths {
+		content := files[path]
+		err := tw.WriteHeader(&tar.Header{
+			Name:     path,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(tw, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// registerFunction registers a new version of `functionName` with the code in
+// `dir` or just `handler`, or with the archive `bundleFile` as is.
+func registerFunction(ctx context.Context, functionName string, lang string, dir string, handler string, bundleFile string, dependencies []string, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	var bundle []byte
+	var err error
+	if bundleFile != "" {
+		if dir != "" {
+			return fmt.Errorf("--bundle and --dir can't be combined")
+		}
+		bundle, err = os.ReadFile(bundleFile)
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+	} else {
+		var files map[string]string
+		files, handler, err = readCodeFiles(dir, handler)
+		if err != nil {
+			return err
+		}
+		bundle, err = tarCode(files)
+		if err != nil {
+			return fmt.Errorf("failed to archive code: %w", err)
+		}
+	}
+
+	req := serverapi.RegisterFunctionRequest{
+		Name:         serverapi.PtrString(functionName),
+		Lang:         serverapi.PtrString(lang),
+		Handler:      serverapi.PtrString(handler),
+		Dependencies: dependencies,
+		Bundle:       serverapi.PtrString(base64.StdEncoding.EncodeToString(bundle)),
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.FunctionsPost(ctx).RegisterFunctionRequest(req).Execute()
+	if err != nil {
+		return apiError("register function", httpResp, err)
+	}
+	return printFunctions(os.Stdout, []serverapi.FunctionInfo{*resp}, output, true)
+}
+
+// listFunctions prints the latest version of every function.
+func listFunctions(ctx context.Context, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.FunctionsGet(ctx).Execute()
+	if err != nil {
+		return apiError("list functions", httpResp, err)
+	}
+	return printFunctions(os.Stdout, resp.GetFunctions(), output, false)
+}
+
+// showFunction prints `version` of `functionName`, 0 meaning the latest.
+func showFunction(ctx context.Context, functionName string, version int32, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	req := apiClient.DefaultAPI.FunctionsNameGet(ctx, functionName)
+	if version != 0 {
+		req = req.Version(version)
+	}
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return apiError("get function", httpResp, err)
+	}
+	return printFunctions(os.Stdout, []serverapi.FunctionInfo{*resp}, output, true)
+}
+
+// deleteFunction deletes `version` of `functionName`, 0 meaning every version.
+func deleteFunction(ctx context.Context, functionName string, version int32) error {
+	req := apiClient.DefaultAPI.FunctionsNameDelete(ctx, functionName)
+	if version != 0 {
+		req = req.Version(version)
+	}
+	_, httpResp, err := req.Execute()
+	if err != nil {
+		return apiError("delete function", httpResp, err)
+	}
+
+	if version != 0 {
+		fmt.Printf("function/%s version %d deleted\n", functionName, version)
+	} else {
+		fmt.Printf("function/%s deleted\n", functionName)
+	}
+	return nil
+}
+
+// printFunctions writes `functions` to `w` in `output` format. A single
+// function is printed as an object rather than a list in the JSON format.
+func printFunctions(w io.Writer, functions []serverapi.FunctionInfo, output string, single bool) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if single && len(functions) == 1 {
+			return encoder.Encode(functions[0])
+		}
+		return encoder.Encode(functions)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tVERSIONS\tLANG\tHANDLER\tLAYER\tAGE")
+	for _, fn := range functions {
+		versions := make([]string, 0, len(fn.GetVersions()))
+		for _, version := range fn.GetVersions() {
+			versions = append(versions, strconv.Itoa(int(version)))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			fn.GetName(),
+			fn.GetVersion(),
+			orNone(strings.Join(versions, ",")),
+			fn.GetLang(),
+			fn.GetHandler(),
+			fn.GetLayerStatus(),
+			formatAge(fn.GetCreatedAt(), now),
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range functions {
+		if fn.GetLayerError() != "" {
+			fmt.Fprintf(os.Stderr, "layer of %s version %d failed: %s\n", fn.GetName(), fn.GetVersion(), fn.GetLayerError())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
+)
+
+// readInput returns the JSON input of an invocation given inline as `input` or
+// read from `inputFile`, "-" being stdin. Returns nil if neither is set.
+func readInput(input string, inputFile string) (any, error) {
+	if input != "" && inputFile != "" {
+		return nil, errors.New("--input and --input-file can't be combined")
+	}
+
+	data := []byte(input)
+	if inputFile != "" {
+		var err error
+		if inputFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(inputFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var value any
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, fmt.Errorf("input isn't valid JSON: %w", err)
+	}
+	return value, nil
+}
+
+// invokeFunction invokes `functionName` with the code in `dir` or just
+// `entryPoint`, or with `version` of its registered code if `entryPoint` isn't
+// set. By default the output of the code is printed as is and an invocation
+// that doesn't succeed is returned as a `processError`.
+func invokeFunction(ctx context.Context, functionName string, lang string, dir string, entryPoint string, dependencies []string, version int32, input any, timeoutSeconds int32, fresh bool, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+
+	req := serverapi.InvokeFunctionRequest{
+		Dependencies:   dependencies,
+		TimeoutSeconds: serverapi.PtrInt32(timeoutSeconds),
+		Fresh:          serverapi.PtrBool(fresh),
+	}
+	if entryPoint != "" {
+		if version != 0 {
+			return errors.New("--version only applies to the registered function, without --file")
+		}
+		files, entryPoint, err := readCodeFiles(dir, entryPoint)
+		if err != nil {
+			return err
+		}
+		req.SetLang(lang)
+		req.SetFiles(files)
+		req.SetEntryPoint(entryPoint)
+	} else if dir != "" {
+		return errors.New("--dir requires --file")
+	} else if version != 0 {
+		req.SetVersion(version)
+	}
+	if input != nil {
+		req.SetInput(input)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.FunctionsNameInvokePost(ctx, functionName).InvokeFunctionRequest(req).Execute()
+	if err != nil {
+		return apiError("invoke function", httpResp, err)
+	}
+
+	if output == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(resp)
+	}
+
+	fmt.Fprint(os.Stdout, resp.GetStdout())
+	fmt.Fprint(os.Stderr, resp.GetStderr())
+	if resp.GetStdoutTruncated() || resp.GetStderrTruncated() {
+		fmt.Fprintln(os.Stderr, "output truncated to its end")
+	}
+	if resp.GetStatus() == execstream.StatusSuccess {
+		return nil
+	}
+	return &processError{status: resp.GetStatus(), exitCode: int(resp.GetExitCode()), message: resp.GetError()}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -16,6 +21,11 @@ import (
 
 var (
 	apiClient *serverapi.APIClient
+	// Used for requests the generated client can't make e.g. streaming
+	// events.
+	httpClient *http.Client
+	serverURL  string
+	authToken  string
 )
 
 func stopVM(vmName string) error {
@@ -23,15 +33,50 @@ func stopVM(vmName string) error {
 		VmName: serverapi.PtrString(vmName),
 	}
 
-	_, http_resp, err := apiClient.
+	_, httpResp, err := apiClient.
 		DefaultAPI.
 		VmStopPost(context.Background()).VMRequest(*vmRequest).Execute()
 	if err != nil {
-		body, _ := io.ReadAll(http_resp.Body)
-		return fmt.Errorf("failed to stop VM: error: %s code: %v", string(body), err)
+		return apiError("stop VM", httpResp, err)
 	}
 
-	log.Infof("successfully stopped VM: %s", vmName)
+	fmt.Printf("vm/%s stopped\n", vmName)
+	return nil
+}
+
+func pauseVM(vmName string) error {
+	_, httpResp, err := apiClient.DefaultAPI.VmNamePausePost(context.Background(), vmName).Execute()
+	if err != nil {
+		return apiError("pause VM", httpResp, err)
+	}
+
+	fmt.Printf("vm/%s paused\n", vmName)
+	return nil
+}
+
+func resumeVM(vmName string) error {
+	_, httpResp, err := apiClient.DefaultAPI.VmNameResumePost(context.Background(), vmName).Execute()
+	if err != nil {
+		return apiError("resume VM", httpResp, err)
+	}
+
+	fmt.Printf("vm/%s resumed\n", vmName)
+	return nil
+}
+
+func migrateVM(vmName string, destination string) error {
+	migrateVMRequest := &serverapi.MigrateVMRequest{
+		Destination: serverapi.PtrString(destination),
+	}
+
+	_, httpResp, err := apiClient.DefaultAPI.
+		VmNameMigratePost(context.Background(), vmName).
+		MigrateVMRequest(*migrateVMRequest).Execute()
+	if err != nil {
+		return apiError("migrate VM", httpResp, err)
+	}
+
+	fmt.Printf("vm/%s migrated to %s\n", vmName, destination)
 	return nil
 }
 
@@ -40,110 +85,284 @@ func destroyVM(vmName string) error {
 		VmName: serverapi.PtrString(vmName),
 	}
 
-	_, http_resp, err := apiClient.
+	_, httpResp, err := apiClient.
 		DefaultAPI.
 		VmDestroyPost(context.Background()).VMRequest(*vmRequest).Execute()
 	if err != nil {
-		body, _ := io.ReadAll(http_resp.Body)
-		return fmt.Errorf("failed to destroy VM: error: %s code: %v", string(body), err)
+		return apiError("destroy VM", httpResp, err)
 	}
 
-	log.Infof("successfully destroyed VM: %s", vmName)
+	fmt.Printf("vm/%s destroyed\n", vmName)
 	return nil
 }
 
 func destroyAllVMs() error {
-	_, http_resp, err := apiClient.DefaultAPI.VmDestroyAllPost(context.Background()).Execute()
+	_, httpResp, err := apiClient.DefaultAPI.VmDestroyAllPost(context.Background()).Execute()
 	if err != nil {
-		body, _ := io.ReadAll(http_resp.Body)
-		return fmt.Errorf("failed to destroy all VMs: error: %s code: %v", string(body), err)
+		return apiError("destroy all VMs", httpResp, err)
 	}
 
-	log.Infof("destroyed all VMs")
+	fmt.Println("destroyed all VMs")
 	return nil
 }
 
-func startVM(vmName string, kernel string, rootfs string, entryPoint string) error {
-	startVMRequest := &serverapi.StartVMRequest{
-		VmName:     serverapi.PtrString(vmName),
-		Kernel:     serverapi.PtrString(kernel),
-		Rootfs:     serverapi.PtrString(rootfs),
-		EntryPoint: serverapi.PtrString(entryPoint),
-	}
-
-	resp, http_resp, err := apiClient.DefaultAPI.
+func startVM(startVMRequest serverapi.StartVMRequest) error {
+	_, httpResp, err := apiClient.DefaultAPI.
 		VmStartPost(context.Background()).
-		StartVMRequest(*startVMRequest).Execute()
+		StartVMRequest(startVMRequest).Execute()
 	if err != nil {
-		body, _ := io.ReadAll(http_resp.Body)
-		return fmt.Errorf("failed to start VM: error: %s code: %v", string(body), err)
+		return apiError("start VM", httpResp, err)
+	}
+
+	fmt.Printf("vm/%s started\n", startVMRequest.GetVmName())
+	return nil
+}
+
+// showVMResult prints the result of the entry point of `vmName` in `output`
+// format. By default its output is printed as is and its exit code is
+// returned as the CLI's.
+func showVMResult(ctx context.Context, vmName string, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format: %s", output)
 	}
 
-	resp_bytes, err := resp.MarshalJSON()
+	result, httpResp, err := apiClient.DefaultAPI.VmNameResultGet(ctx, vmName).Execute()
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return apiError("get VM result", httpResp, err)
+	}
+
+	if output == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	fmt.Fprint(os.Stdout, result.GetStdout())
+	fmt.Fprint(os.Stderr, result.GetStderr())
+	if result.GetStdoutTruncated() || result.GetStderrTruncated() {
+		fmt.Fprintln(os.Stderr, "output truncated to its end")
+	}
+	fmt.Fprintf(os.Stderr, "exited with code %d after %dms\n", result.GetExitCode(), result.GetDurationMs())
+	if result.GetExitCode() != 0 {
+		return &processError{status: "exited", exitCode: int(result.GetExitCode())}
 	}
-	log.Infof("started VM: %v", string(resp_bytes))
 	return nil
 }
 
-func listAllVMs() error {
-	resp, http_resp, err := apiClient.DefaultAPI.VmListGet(context.Background()).Execute()
-	if err != nil {
-		body, _ := io.ReadAll(http_resp.Body)
-		return fmt.Errorf("failed to list all VMs: error: %s code: %v", string(body), err)
+// parseEnvFlags parses NAME=VALUE flags.
+func parseEnvFlags(values []string) (map[string]string, error) {
+	env := make(map[string]string, len(values))
+	for _, value := range values {
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid env var, expected NAME=VALUE: %q", value)
+		}
+		env[name] = val
+	}
+	return env, nil
+}
+
+// getSecrets returns the values of the environment variables `names` of the
+// client.
+func getSecrets(names []string) (map[string]string, error) {
+	secrets := make(map[string]string, len(names))
+	for _, name := range names {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("secret %s isn't set in the environment", name)
+		}
+		secrets[name] = value
 	}
+	return secrets, nil
+}
 
-	resp_bytes, err := resp.MarshalJSON()
+// readSSHKeys returns the public keys in the authorized_keys style files
+// `paths`, skipping blank lines and comments.
+func readSSHKeys(paths []string) ([]string, error) {
+	var keys []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ssh keys: %w", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func listAllVMs() ([]vmRow, error) {
+	resp, httpResp, err := apiClient.DefaultAPI.VmListGet(context.Background()).Execute()
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return nil, apiError("list all VMs", httpResp, err)
 	}
-	log.Infof("VMs: %v", string(resp_bytes))
-	return nil
+
+	var vms []vmRow
+	for _, vm := range resp.GetVms() {
+		vms = append(vms, vmRow{
+			Name:           vm.GetVmName(),
+			Status:         vm.GetStatus(),
+			IP:             vm.GetIp(),
+			TapDeviceName:  vm.GetTapDeviceName(),
+			RestartPolicy:  vm.GetRestartPolicy(),
+			Restarts:       vm.GetRestarts(),
+			CreatedAt:      vm.GetCreatedAt(),
+			LastActivityAt: vm.GetLastActivityAt(),
+		})
+	}
+	return vms, nil
 }
 
-func createApiClient(serverAddr string) (*serverapi.APIClient, error) {
-	host, port, err := net.SplitHostPort(serverAddr)
+// createHTTPClient returns the HTTP client used to talk to the server. It dials
+// the server's unix socket if one is configured and sets up TLS otherwise.
+func createHTTPClient(clientConfig *config.ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if clientConfig.SocketPath != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", clientConfig.SocketPath)
+		}
+		return &http.Client{Transport: transport}, nil
+	}
+
+	if !clientConfig.UseTLS {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientConfig.CAFile != "" {
+		caPEM, err := os.ReadFile(clientConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in ca file: %s", clientConfig.CAFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if clientConfig.CertFile != "" || clientConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientConfig.CertFile, clientConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert and key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// getServerURL returns the base URL of the server in `clientConfig`.
+func getServerURL(clientConfig *config.ClientConfig) string {
+	if clientConfig.SocketPath != "" {
+		// The host is ignored when dialing the unix socket.
+		return "http://localhost:80"
+	}
+
+	scheme := "http"
+	if clientConfig.UseTLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(clientConfig.ServerHost, clientConfig.ServerPort)
+}
+
+// createApiClient returns a client for the server in `clientConfig`. Its token
+// is sent as a bearer token if set.
+func createApiClient(clientConfig *config.ClientConfig) (*serverapi.APIClient, error) {
+	var err error
+	httpClient, err = createHTTPClient(clientConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse server address: %v", err)
+		return nil, err
 	}
+	serverURL = getServerURL(clientConfig)
+	authToken = clientConfig.Token
 
 	serverConfiguration := &serverapi.ServerConfiguration{
-		URL:         "http://{host}:{port}",
+		URL:         serverURL,
 		Description: "Development server",
-		Variables: map[string]serverapi.ServerVariable{
-			"host": {
-				Description:  "host",
-				DefaultValue: host,
-			},
-			"port": {
-				Description:  "port",
-				DefaultValue: port,
-			},
-		},
 	}
 
 	configuration := serverapi.NewConfiguration()
 	configuration.Servers = serverapi.ServerConfigurations{
 		*serverConfiguration,
 	}
+	configuration.HTTPClient = httpClient
+	if clientConfig.Token != "" {
+		configuration.AddDefaultHeader("Authorization", "Bearer "+clientConfig.Token)
+	}
 	apiClient = serverapi.NewAPIClient(configuration)
 
 	return apiClient, nil
 }
 
-func listVM(vmName string) error {
-	resp, _, err := apiClient.DefaultAPI.VmNameGet(context.Background(), vmName).Execute()
+func listVM(vmName string) ([]vmRow, error) {
+	vm, err := getVM(context.Background(), vmName)
 	if err != nil {
-		return fmt.Errorf("failed to list VM: %w", err)
+		return nil, err
+	}
+	if vm == nil {
+		return nil, notFoundError(vmName)
 	}
 
-	resp_bytes, err := resp.MarshalJSON()
+	return []vmRow{{
+		Name:           vm.GetVmName(),
+		Status:         vm.GetStatus(),
+		IP:             vm.GetIp(),
+		TapDeviceName:  vm.GetTapDeviceName(),
+		RestartPolicy:  vm.GetRestartPolicy(),
+		Restarts:       vm.GetRestarts(),
+		CreatedAt:      vm.GetCreatedAt(),
+		LastActivityAt: vm.GetLastActivityAt(),
+	}}, nil
+}
+
+// showVMs prints the VMs returned by `list` in `output` format, refreshing them
+// every `interval` if `watchVMs` is set.
+func showVMs(ctx context.Context, list func() ([]vmRow, error), output string, single bool, watchVMs bool, interval time.Duration) error {
+	err := validateOutput(output)
 	if err != nil {
-		return fmt.Errorf("failed to marshal response: %w", err)
+		return err
+	}
+
+	render := func() error {
+		vms, err := list()
+		if err != nil {
+			return err
+		}
+		return printVMs(os.Stdout, vms, output, single)
+	}
+	if !watchVMs {
+		return render()
+	}
+	return watch(ctx, interval, output, render)
+}
+
+// listFlags returns the flags of the listing commands.
+func listFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: json, yaml, wide or name. Defaults to a table",
+		},
+		&cli.BoolFlag{
+			Name:    "watch",
+			Aliases: []string{"w"},
+			Usage:   "Keep refreshing the listing",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "How often to refresh the listing with --watch",
+			Value: 2 * time.Second,
+		},
 	}
-	log.Infof("VM: %v", string(resp_bytes))
-	return nil
 }
 
 func main() {
@@ -161,11 +380,9 @@ func main() {
 					if err != nil {
 						return fmt.Errorf("failed to get client config: %v", err)
 					}
-					log.Infof("client config: %v", clientConfig)
+					log.Debugf("client config: %v", clientConfig)
 
-					apiClient, err = createApiClient(
-						fmt.Sprintf("%s:%s", clientConfig.ServerHost, clientConfig.ServerPort),
-					)
+					apiClient, err = createApiClient(clientConfig)
 					if err != nil {
 						return fmt.Errorf("failed to initialize api client: %v", err)
 					}
@@ -200,14 +417,124 @@ func main() {
 						Usage:    "Entry point of the VM",
 						Required: false,
 					},
+					&cli.BoolFlag{
+						Name:    "wait",
+						Aliases: []string{"w"},
+						Usage:   "Wait for the guest's services to be up before returning",
+					},
+					&cli.IntFlag{
+						Name:  "boot-timeout",
+						Usage: "Seconds to wait for the guest to be ready with --wait",
+					},
+					&cli.StringFlag{
+						Name:  "restart",
+						Usage: "Restart policy of the VM: never, on-failure or always",
+						Value: "never",
+					},
+					&cli.IntFlag{
+						Name:  "max-restarts",
+						Usage: "Maximum number of restarts, 0 means unlimited",
+					},
+					&cli.BoolFlag{
+						Name:  "rm",
+						Usage: "Destroy the VM once its entry point exits, its result can still be fetched with `result` for a while",
+					},
+					&cli.IntFlag{
+						Name:  "ttl",
+						Usage: "Seconds after which the VM is reclaimed, 0 uses the server default and -1 disables it",
+					},
+					&cli.IntFlag{
+						Name:  "idle-timeout",
+						Usage: "Seconds of inactivity after which the VM is reclaimed, 0 uses the server default and -1 disables it",
+					},
+					&cli.StringFlag{
+						Name:  "expiry-action",
+						Usage: "What to do with the VM when it expires: destroy, snapshot or pause. Defaults to the server default",
+					},
+					&cli.StringSliceFlag{
+						Name:  "env",
+						Usage: "NAME=VALUE environment variable of the entry point, can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "secret",
+						Usage: "Name of an environment variable of the client to pass to the entry point as a secret, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "workdir",
+						Usage: "Directory the entry point runs in",
+					},
+					&cli.StringFlag{
+						Name:  "user",
+						Usage: "User the entry point runs as, a name or uid[:gid]",
+					},
+					&cli.StringFlag{
+						Name:  "hostname",
+						Usage: "Hostname of the guest, defaults to the VM name",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ssh-key-file",
+						Usage: "File of public keys to authorize for root in the guest, can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "disable-service",
+						Usage: "Guest service not to start e.g. node-server, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "user-data-file",
+						Usage: "User data put on the config drive, a script or a #cloud-config",
+					},
 				},
+				ArgsUsage: "[-- command [args...]]",
 				Action: func(ctx *cli.Context) error {
-					return startVM(
-						ctx.String("name"),
-						ctx.String("kernel"),
-						ctx.String("rootfs"),
-						ctx.String("entry-point"),
-					)
+					env, err := parseEnvFlags(ctx.StringSlice("env"))
+					if err != nil {
+						return err
+					}
+					secrets, err := getSecrets(ctx.StringSlice("secret"))
+					if err != nil {
+						return err
+					}
+					sshKeys, err := readSSHKeys(ctx.StringSlice("ssh-key-file"))
+					if err != nil {
+						return err
+					}
+					var userData string
+					if path := ctx.String("user-data-file"); path != "" {
+						content, err := os.ReadFile(path)
+						if err != nil {
+							return fmt.Errorf("failed to read user data: %w", err)
+						}
+						userData = string(content)
+					}
+
+					startVMRequest := serverapi.StartVMRequest{
+						VmName:             serverapi.PtrString(ctx.String("name")),
+						Kernel:             serverapi.PtrString(ctx.String("kernel")),
+						Rootfs:             serverapi.PtrString(ctx.String("rootfs")),
+						EntryPoint:         serverapi.PtrString(ctx.String("entry-point")),
+						Args:               ctx.Args().Slice(),
+						WorkingDir:         serverapi.PtrString(ctx.String("workdir")),
+						User:               serverapi.PtrString(ctx.String("user")),
+						Hostname:           serverapi.PtrString(ctx.String("hostname")),
+						SshKeys:            sshKeys,
+						UserData:           serverapi.PtrString(userData),
+						DisabledServices:   ctx.StringSlice("disable-service"),
+						WaitForReady:       serverapi.PtrBool(ctx.Bool("wait")),
+						BootTimeoutSeconds: serverapi.PtrInt32(int32(ctx.Int("boot-timeout"))),
+						RestartPolicy:      serverapi.PtrString(ctx.String("restart")),
+						MaxRestarts:        serverapi.PtrInt32(int32(ctx.Int("max-restarts"))),
+						DestroyOnExit:      serverapi.PtrBool(ctx.Bool("rm")),
+						TtlSeconds:         serverapi.PtrInt32(int32(ctx.Int("ttl"))),
+						IdleTimeoutSeconds: serverapi.PtrInt32(int32(ctx.Int("idle-timeout"))),
+						ExpiryAction:       serverapi.PtrString(ctx.String("expiry-action")),
+					}
+					if len(env) > 0 {
+						startVMRequest.Env = &env
+					}
+					if len(secrets) > 0 {
+						startVMRequest.Secrets = &secrets
+					}
+					return startVM(startVMRequest)
 				},
 			},
 			{
@@ -225,6 +552,75 @@ func main() {
 					return stopVM(ctx.String("name"))
 				},
 			},
+			{
+				Name:  "pause",
+				Usage: "Pause a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to pause",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return pauseVM(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "resume",
+				Usage: "Resume a paused VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to resume",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return resumeVM(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Live migrate a VM to another server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to migrate",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "destination",
+						Aliases:  []string{"d"},
+						Usage:    "host:port or http(s) URL of the server to migrate the VM to",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return migrateVM(ctx.String("name"), ctx.String("destination"))
+				},
+			},
+			{
+				Name:  "events",
+				Usage: "Show the lifecycle events of VMs",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "Keep streaming new events",
+					},
+					&cli.Uint64Flag{
+						Name:  "since",
+						Usage: "Only show events after the one with this ID",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return showEvents(ctx.Context, ctx.Uint64("since"), ctx.Bool("follow"))
+				},
+			},
 			{
 				Name:  "destroy",
 				Usage: "Destroy a VM",
@@ -250,23 +646,354 @@ func main() {
 			{
 				Name:  "list-all",
 				Usage: "List all VMs",
+				Flags: listFlags(),
 				Action: func(ctx *cli.Context) error {
-					return listAllVMs()
+					return showVMs(ctx.Context, listAllVMs, ctx.String("output"), false, ctx.Bool("watch"), ctx.Duration("interval"))
 				},
 			},
 			{
 				Name:  "list",
 				Usage: "List VM info",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to list",
+						Required: true,
+					},
+				}, listFlags()...),
+				Action: func(ctx *cli.Context) error {
+					list := func() ([]vmRow, error) {
+						return listVM(ctx.String("name"))
+					}
+					return showVMs(ctx.Context, list, ctx.String("output"), true, ctx.Bool("watch"), ctx.Duration("interval"))
+				},
+			},
+			{
+				Name:  "result",
+				Usage: "Show the result of a VM's entry point once it has exited",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to destroy",
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: json, defaults to the entry point's output",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return showVMResult(ctx.Context, ctx.String("name"), ctx.String("output"))
+				},
+			},
+			{
+				Name:  "invoke",
+				Usage: "Invoke a function with code and print its output once it exits",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the function",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "lang",
+						Usage: "Language of the code",
+						Value: "python",
+					},
+					&cli.StringFlag{
+						Name:    "file",
+						Aliases: []string{"f"},
+						Usage:   "File to run. Relative to --dir if it's set. Runs the registered function if unset",
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory to upload along with the file",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dep",
+						Usage: "Package to install before running the code, can be repeated",
+					},
+					&cli.IntFlag{
+						Name:  "version",
+						Usage: "Version of the registered function to run, defaults to the latest",
+					},
+					&cli.StringFlag{
+						Name:  "input",
+						Usage: "JSON passed to the code on its stdin",
+					},
+					&cli.StringFlag{
+						Name:  "input-file",
+						Usage: "File with the JSON passed to the code on its stdin, - for stdin",
+					},
+					&cli.IntFlag{
+						Name:  "timeout",
+						Usage: "Seconds after which the code is killed, 0 means no limit",
+					},
+					&cli.BoolFlag{
+						Name:  "fresh",
+						Usage: "Run in a newly booted VM instead of a pooled one",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: json, defaults to the code's output",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					input, err := readInput(ctx.String("input"), ctx.String("input-file"))
+					if err != nil {
+						return err
+					}
+					return invokeFunction(
+						ctx.Context,
+						ctx.String("name"),
+						ctx.String("lang"),
+						ctx.String("dir"),
+						ctx.String("file"),
+						ctx.StringSlice("dep"),
+						int32(ctx.Int("version")),
+						input,
+						int32(ctx.Int("timeout")),
+						ctx.Bool("fresh"),
+						ctx.String("output"),
+					)
+				},
+			},
+			{
+				Name:  "register",
+				Usage: "Register a new version of a function with its code and dependencies",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the function",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "lang",
+						Usage: "Language of the code",
+						Value: "python",
+					},
+					&cli.StringFlag{
+						Name:     "handler",
+						Aliases:  []string{"f"},
+						Usage:    "File to run. Relative to --dir or --bundle if either is set",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory to upload along with the handler",
+					},
+					&cli.StringFlag{
+						Name:  "bundle",
+						Usage: "Tar, gzipped tar or zip archive of the code to upload as is",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dep",
+						Usage: "Package to install into the function's layer, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: json, defaults to a table",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return registerFunction(
+						ctx.Context,
+						ctx.String("name"),
+						ctx.String("lang"),
+						ctx.String("dir"),
+						ctx.String("handler"),
+						ctx.String("bundle"),
+						ctx.StringSlice("dep"),
+						ctx.String("output"),
+					)
+				},
+			},
+			{
+				Name:  "functions",
+				Usage: "List the latest version of every registered function",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: json, defaults to a table",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return listFunctions(ctx.Context, ctx.String("output"))
+				},
+			},
+			{
+				Name:  "function",
+				Usage: "Show a version of a registered function",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the function",
 						Required: true,
 					},
+					&cli.IntFlag{
+						Name:  "version",
+						Usage: "Version to show, defaults to the latest",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: json, defaults to a table",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return showFunction(ctx.Context, ctx.String("name"), int32(ctx.Int("version")), ctx.String("output"))
+				},
+			},
+			{
+				Name:  "unregister",
+				Usage: "Delete a version of a registered function, or all of them",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the function",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "version",
+						Usage: "Version to delete, defaults to every version",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return deleteFunction(ctx.Context, ctx.String("name"), int32(ctx.Int("version")))
+				},
+			},
+			{
+				Name:  "run",
+				Usage: "Run code in a VM and stream its output",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to run the code in",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "lang",
+						Usage: "Language of the code",
+						Value: "python",
+					},
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "File to run. Relative to --dir if it's set",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory to upload along with the file",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dep",
+						Usage: "Package to install before running the code, can be repeated",
+					},
+					&cli.IntFlag{
+						Name:  "timeout",
+						Usage: "Seconds after which the code is killed, 0 means no limit",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return runCode(
+						ctx.Context,
+						ctx.String("name"),
+						ctx.String("lang"),
+						ctx.String("dir"),
+						ctx.String("file"),
+						ctx.StringSlice("dep"),
+						int32(ctx.Int("timeout")),
+					)
+				},
+			},
+			{
+				Name:      "exec",
+				Usage:     "Run a command in a VM and stream its output",
+				ArgsUsage: "-- command [args...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to run the command in",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "timeout",
+						Usage: "Seconds after which the command is killed, 0 means no limit",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return execCommand(ctx.Context, ctx.String("name"), ctx.Args().Slice(), int32(ctx.Int("timeout")))
+				},
+			},
+			{
+				Name:  "apply",
+				Usage: "Create or update the VMs in a manifest file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Path of the YAML manifest file or - for stdin",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would change",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return applyFile(ctx.String("file"), ctx.Bool("dry-run"))
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "Destroy the VMs in a manifest file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Path of the YAML manifest file or - for stdin",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return deleteFile(ctx.String("file"))
+				},
+			},
+			{
+				Name:  "get",
+				Usage: "Show the manifest of a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format: yaml",
+						Value:   "yaml",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return listVM(ctx.String("name"))
+					return getVMManifest(ctx.String("name"), ctx.String("output"))
 				},
 			},
 		},
@@ -274,6 +1001,7 @@ func main() {
 
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitCode(err))
 	}
 }
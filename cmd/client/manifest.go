@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+// The only network VMs can be attached to, which is the server's bridge.
+const defaultNetwork = "default"
+
+// vmManifest is the declarative spec of a VM. `apply` converges VMs to the
+// manifests in a YAML file and `get` exports the manifest of a VM.
+//
+// Fields that are left unset get the server's defaults and aren't compared
+// with the VM when applying, except for the entry point, env, disks and ports
+// for which unset means none. Secrets are never compared as the server doesn't
+// return them.
+type vmManifest struct {
+	Name       string `yaml:"name"`
+	Kernel     string `yaml:"kernel,omitempty"`
+	Rootfs     string `yaml:"rootfs,omitempty"`
+	EntryPoint string `yaml:"entryPoint,omitempty"`
+	// The entry point as a command and its arguments, instead of `EntryPoint`.
+	Args       []string          `yaml:"args,omitempty"`
+	WorkingDir string            `yaml:"workingDir,omitempty"`
+	User       string            `yaml:"user,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty"`
+	// Names of environment variables of the client that are passed to the
+	// entry point as secrets, so that they don't have to be in the manifest.
+	SecretsFromEnv []string          `yaml:"secretsFromEnv,omitempty"`
+	Resources      manifestResources `yaml:"resources,omitempty"`
+	// Defaults to the name of the VM.
+	Hostname string `yaml:"hostname,omitempty"`
+	// Public keys authorized for root in the guest.
+	SSHKeys []string `yaml:"sshKeys,omitempty"`
+	// A script run once per instance or a "#cloud-config".
+	UserData string `yaml:"userData,omitempty"`
+	// Guest services not to start e.g. "node-server".
+	DisabledServices []string       `yaml:"disabledServices,omitempty"`
+	Disks            []manifestDisk `yaml:"disks,omitempty"`
+	// Only `defaultNetwork` is supported.
+	Networks []string       `yaml:"networks,omitempty"`
+	Ports    []manifestPort `yaml:"ports,omitempty"`
+	// Uploaded once the VM is ready, on every apply as they can't be compared
+	// with the files in the VM.
+	Files              []manifestFile `yaml:"files,omitempty"`
+	RestartPolicy      string         `yaml:"restartPolicy,omitempty"`
+	MaxRestarts        int32          `yaml:"maxRestarts,omitempty"`
+	DestroyOnExit      bool           `yaml:"destroyOnExit,omitempty"`
+	TtlSeconds         int32          `yaml:"ttlSeconds,omitempty"`
+	IdleTimeoutSeconds int32          `yaml:"idleTimeoutSeconds,omitempty"`
+	ExpiryAction       string         `yaml:"expiryAction,omitempty"`
+	BootTimeoutSeconds int32          `yaml:"bootTimeoutSeconds,omitempty"`
+
+	// Dir of the file the manifest was read from, which relative file sources
+	// are resolved against.
+	dir string
+}
+
+type manifestResources struct {
+	Vcpus    int32 `yaml:"vcpus,omitempty"`
+	MemoryMb int32 `yaml:"memoryMb,omitempty"`
+}
+
+type manifestDisk struct {
+	Path     string `yaml:"path"`
+	ReadOnly bool   `yaml:"readOnly,omitempty"`
+}
+
+type manifestPort struct {
+	HostPort  int32 `yaml:"hostPort"`
+	GuestPort int32 `yaml:"guestPort"`
+	// Defaults to "tcp".
+	Protocol string `yaml:"protocol,omitempty"`
+}
+
+// manifestFile is a file written into the VM. Its content is either read from
+// `Source` on the client or given inline in `Content`.
+type manifestFile struct {
+	// Absolute path in the guest.
+	Path    string `yaml:"path"`
+	Source  string `yaml:"source,omitempty"`
+	Content string `yaml:"content,omitempty"`
+	// Defaults to 0644.
+	Mode uint32 `yaml:"mode,omitempty"`
+}
+
+// readManifests reads the manifests in the YAML file at `path`, which can hold
+// several documents. "-" reads stdin.
+func readManifests(path string) ([]vmManifest, error) {
+	var r io.Reader
+	dir := "."
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open manifest: %w", err)
+		}
+		defer f.Close()
+		r = f
+		dir = filepath.Dir(path)
+	}
+
+	var manifests []vmManifest
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	for {
+		var manifest vmManifest
+		err := decoder.Decode(&manifest)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %s: %w", path, err)
+		}
+
+		manifest.dir = dir
+		err = manifest.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest: %s: %w", path, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("no manifests in: %s", path)
+	}
+	return manifests, nil
+}
+
+func (m *vmManifest) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+
+	for _, network := range m.Networks {
+		if network != defaultNetwork {
+			return fmt.Errorf("vm %s: unsupported network: %q, only %q is supported", m.Name, network, defaultNetwork)
+		}
+	}
+
+	if m.EntryPoint != "" && len(m.Args) > 0 {
+		return fmt.Errorf("vm %s: only one of entryPoint and args can be set", m.Name)
+	}
+
+	for _, name := range m.SecretsFromEnv {
+		if _, ok := os.LookupEnv(name); !ok {
+			return fmt.Errorf("vm %s: secret %s isn't set in the environment", m.Name, name)
+		}
+	}
+
+	for _, file := range m.Files {
+		if !filepath.IsAbs(file.Path) {
+			return fmt.Errorf("vm %s: file path isn't absolute: %q", m.Name, file.Path)
+		}
+		if (file.Source == "") == (file.Content == "") {
+			return fmt.Errorf("vm %s: file %s needs exactly one of source and content", m.Name, file.Path)
+		}
+	}
+	return nil
+}
+
+// toStartVMRequest returns the request that creates the VM of `m`.
+func (m *vmManifest) toStartVMRequest() serverapi.StartVMRequest {
+	var disks []serverapi.DiskSpec
+	for _, disk := range m.Disks {
+		disks = append(disks, serverapi.DiskSpec{
+			Path:     serverapi.PtrString(disk.Path),
+			ReadOnly: serverapi.PtrBool(disk.ReadOnly),
+		})
+	}
+
+	var ports []serverapi.PortForward
+	for _, port := range m.Ports {
+		ports = append(ports, serverapi.PortForward{
+			HostPort:  serverapi.PtrInt32(port.HostPort),
+			GuestPort: serverapi.PtrInt32(port.GuestPort),
+			Protocol:  serverapi.PtrString(port.Protocol),
+		})
+	}
+
+	req := serverapi.StartVMRequest{
+		VmName:             serverapi.PtrString(m.Name),
+		Kernel:             serverapi.PtrString(m.Kernel),
+		Rootfs:             serverapi.PtrString(m.Rootfs),
+		EntryPoint:         serverapi.PtrString(m.EntryPoint),
+		Args:               m.Args,
+		WorkingDir:         serverapi.PtrString(m.WorkingDir),
+		User:               serverapi.PtrString(m.User),
+		Hostname:           serverapi.PtrString(m.Hostname),
+		SshKeys:            m.SSHKeys,
+		UserData:           serverapi.PtrString(m.UserData),
+		DisabledServices:   m.DisabledServices,
+		WaitForReady:       serverapi.PtrBool(true),
+		BootTimeoutSeconds: serverapi.PtrInt32(m.BootTimeoutSeconds),
+		RestartPolicy:      serverapi.PtrString(m.RestartPolicy),
+		MaxRestarts:        serverapi.PtrInt32(m.MaxRestarts),
+		DestroyOnExit:      serverapi.PtrBool(m.DestroyOnExit),
+		TtlSeconds:         serverapi.PtrInt32(m.TtlSeconds),
+		IdleTimeoutSeconds: serverapi.PtrInt32(m.IdleTimeoutSeconds),
+		ExpiryAction:       serverapi.PtrString(m.ExpiryAction),
+		Vcpus:              serverapi.PtrInt32(m.Resources.Vcpus),
+		MemoryMb:           serverapi.PtrInt32(m.Resources.MemoryMb),
+		Disks:              disks,
+		Ports:              ports,
+	}
+	if len(m.Env) > 0 {
+		req.Env = &m.Env
+	}
+	if len(m.SecretsFromEnv) > 0 {
+		secrets := make(map[string]string, len(m.SecretsFromEnv))
+		for _, name := range m.SecretsFromEnv {
+			secrets[name] = os.Getenv(name)
+		}
+		req.Secrets = &secrets
+	}
+	return req
+}
+
+// toUploadFilesRequest reads the files of `m`.
+func (m *vmManifest) toUploadFilesRequest() (serverapi.UploadFilesRequest, error) {
+	var files []serverapi.GuestFile
+	for _, file := range m.Files {
+		content := []byte(file.Content)
+		if file.Source != "" {
+			source := file.Source
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(m.dir, source)
+			}
+
+			var err error
+			content, err = os.ReadFile(source)
+			if err != nil {
+				return serverapi.UploadFilesRequest{}, fmt.Errorf("failed to read file: %w", err)
+			}
+		}
+
+		guestFile := serverapi.GuestFile{
+			Path:    serverapi.PtrString(file.Path),
+			Content: serverapi.PtrString(base64.StdEncoding.EncodeToString(content)),
+		}
+		if file.Mode != 0 {
+			guestFile.Mode = serverapi.PtrInt32(int32(file.Mode))
+		}
+		files = append(files, guestFile)
+	}
+	return serverapi.UploadFilesRequest{Files: files}, nil
+}
+
+// manifestFromSpec returns the manifest of a VM running with `spec`. Files
+// aren't part of it.
+func manifestFromSpec(spec *serverapi.StartVMRequest) vmManifest {
+	m := vmManifest{
+		Name:             spec.GetVmName(),
+		Kernel:           spec.GetKernel(),
+		Rootfs:           spec.GetRootfs(),
+		EntryPoint:       spec.GetEntryPoint(),
+		Args:             spec.GetArgs(),
+		WorkingDir:       spec.GetWorkingDir(),
+		User:             spec.GetUser(),
+		Env:              spec.GetEnv(),
+		Hostname:         spec.GetHostname(),
+		SSHKeys:          spec.GetSshKeys(),
+		UserData:         spec.GetUserData(),
+		DisabledServices: spec.GetDisabledServices(),
+		Resources: manifestResources{
+			Vcpus:    spec.GetVcpus(),
+			MemoryMb: spec.GetMemoryMb(),
+		},
+		Networks:           []string{defaultNetwork},
+		RestartPolicy:      spec.GetRestartPolicy(),
+		MaxRestarts:        spec.GetMaxRestarts(),
+		DestroyOnExit:      spec.GetDestroyOnExit(),
+		TtlSeconds:         spec.GetTtlSeconds(),
+		IdleTimeoutSeconds: spec.GetIdleTimeoutSeconds(),
+		ExpiryAction:       spec.GetExpiryAction(),
+	}
+	for _, disk := range spec.GetDisks() {
+		m.Disks = append(m.Disks, manifestDisk{Path: disk.GetPath(), ReadOnly: disk.GetReadOnly()})
+	}
+	for _, port := range spec.GetPorts() {
+		m.Ports = append(m.Ports, manifestPort{
+			HostPort:  port.GetHostPort(),
+			GuestPort: port.GetGuestPort(),
+			Protocol:  port.GetProtocol(),
+		})
+	}
+	return m
+}
+
+// specChange is a difference between the manifest of a VM and the spec it's
+// running with.
+type specChange struct {
+	field   string
+	current string
+	desired string
+}
+
+func (c specChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.field, c.current, c.desired)
+}
+
+// disabledSeconds normalizes a negative TTL or idle timeout, which disables it,
+// to how the server reports it.
+func disabledSeconds(seconds int32) int32 {
+	if seconds < 0 {
+		return -1
+	}
+	return seconds
+}
+
+// diffSpec returns what has to change for a VM running with `current` to match
+// `desired`.
+func diffSpec(current *serverapi.StartVMRequest, desired vmManifest) []specChange {
+	var changes []specChange
+	add := func(field string, currentValue string, desiredValue string) {
+		if currentValue != desiredValue {
+			changes = append(changes, specChange{field, currentValue, desiredValue})
+		}
+	}
+	// Compares fields that fall back to the server default if unset.
+	addIfSet := func(field string, currentValue string, desiredValue string, set bool) {
+		if set {
+			add(field, currentValue, desiredValue)
+		}
+	}
+	itoa := func(i int32) string {
+		return strconv.Itoa(int(i))
+	}
+
+	m := manifestFromSpec(current)
+	addIfSet("kernel", m.Kernel, desired.Kernel, desired.Kernel != "")
+	addIfSet("rootfs", m.Rootfs, desired.Rootfs, desired.Rootfs != "")
+	add("entryPoint", m.EntryPoint, desired.EntryPoint)
+	if !slices.Equal(m.Args, desired.Args) {
+		add("args", fmt.Sprintf("%q", m.Args), fmt.Sprintf("%q", desired.Args))
+	}
+	add("workingDir", m.WorkingDir, desired.WorkingDir)
+	add("user", m.User, desired.User)
+	if !maps.Equal(m.Env, desired.Env) && (len(m.Env) > 0 || len(desired.Env) > 0) {
+		add("env", fmt.Sprint(m.Env), fmt.Sprint(desired.Env))
+	}
+	addIfSet("hostname", m.Hostname, desired.Hostname, desired.Hostname != "")
+	if !slices.Equal(m.SSHKeys, desired.SSHKeys) {
+		add("sshKeys", fmt.Sprint(len(m.SSHKeys)), fmt.Sprint(len(desired.SSHKeys)))
+	}
+	if m.UserData != desired.UserData {
+		add("userData", fmt.Sprintf("%d bytes", len(m.UserData)), fmt.Sprintf("%d bytes", len(desired.UserData)))
+	}
+	if !slices.Equal(m.DisabledServices, desired.DisabledServices) {
+		add("disabledServices", fmt.Sprint(m.DisabledServices), fmt.Sprint(desired.DisabledServices))
+	}
+	addIfSet("resources.vcpus", itoa(m.Resources.Vcpus), itoa(desired.Resources.Vcpus), desired.Resources.Vcpus > 0)
+	addIfSet("resources.memoryMb", itoa(m.Resources.MemoryMb), itoa(desired.Resources.MemoryMb), desired.Resources.MemoryMb > 0)
+	if !slices.Equal(m.Disks, desired.Disks) {
+		add("disks", fmt.Sprint(m.Disks), fmt.Sprint(desired.Disks))
+	}
+
+	desiredPorts := slices.Clone(desired.Ports)
+	for i := range desiredPorts {
+		if desiredPorts[i].Protocol == "" {
+			desiredPorts[i].Protocol = "tcp"
+		}
+	}
+	if !slices.Equal(m.Ports, desiredPorts) {
+		add("ports", fmt.Sprint(m.Ports), fmt.Sprint(desiredPorts))
+	}
+
+	addIfSet("restartPolicy", m.RestartPolicy, desired.RestartPolicy, desired.RestartPolicy != "")
+	add("maxRestarts", itoa(m.MaxRestarts), itoa(desired.MaxRestarts))
+	add("destroyOnExit", strconv.FormatBool(m.DestroyOnExit), strconv.FormatBool(desired.DestroyOnExit))
+	addIfSet("ttlSeconds", itoa(m.TtlSeconds), itoa(disabledSeconds(desired.TtlSeconds)), desired.TtlSeconds != 0)
+	addIfSet("idleTimeoutSeconds", itoa(m.IdleTimeoutSeconds), itoa(disabledSeconds(desired.IdleTimeoutSeconds)), desired.IdleTimeoutSeconds != 0)
+	addIfSet("expiryAction", m.ExpiryAction, desired.ExpiryAction, desired.ExpiryAction != "")
+	return changes
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the listing commands.
+const (
+	outputTable = ""
+	outputWide  = "wide"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputName  = "name"
+)
+
+// vmRow is the VM shown by the listing commands.
+type vmRow struct {
+	Name           string `json:"vmName" yaml:"vmName"`
+	Status         string `json:"status" yaml:"status"`
+	IP             string `json:"ip,omitempty" yaml:"ip,omitempty"`
+	TapDeviceName  string `json:"tapDeviceName,omitempty" yaml:"tapDeviceName,omitempty"`
+	RestartPolicy  string `json:"restartPolicy,omitempty" yaml:"restartPolicy,omitempty"`
+	Restarts       int32  `json:"restarts" yaml:"restarts"`
+	CreatedAt      string `json:"createdAt,omitempty" yaml:"createdAt,omitempty"`
+	LastActivityAt string `json:"lastActivityAt,omitempty" yaml:"lastActivityAt,omitempty"`
+}
+
+func validateOutput(output string) error {
+	switch output {
+	case outputTable, outputWide, outputJSON, outputYAML, outputName:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
+
+// formatAge returns how long ago the RFC3339 `timestamp` was in a short form
+// e.g. 5m or 3d.
+func formatAge(timestamp string, now time.Time) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return "<unknown>"
+	}
+
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
+
+// printVMs writes `vms` to `w` in `output` format. A single VM is printed as an
+// object rather than a list in the JSON and YAML formats.
+func printVMs(w io.Writer, vms []vmRow, output string, single bool) error {
+	switch output {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if single && len(vms) == 1 {
+			return encoder.Encode(vms[0])
+		}
+		return encoder.Encode(vms)
+
+	case outputYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		var err error
+		if single && len(vms) == 1 {
+			err = encoder.Encode(vms[0])
+		} else {
+			err = encoder.Encode(vms)
+		}
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+
+	case outputName:
+		for _, vm := range vms {
+			fmt.Fprintf(w, "vm/%s\n", vm.Name)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	if output == outputWide {
+		fmt.Fprintln(tw, "NAME\tSTATUS\tIP\tRESTARTS\tAGE\tTAP\tRESTART POLICY\tLAST ACTIVITY")
+	} else {
+		fmt.Fprintln(tw, "NAME\tSTATUS\tIP\tRESTARTS\tAGE")
+	}
+	for _, vm := range vms {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s", vm.Name, vm.Status, orNone(vm.IP), vm.Restarts, formatAge(vm.CreatedAt, now))
+		if output == outputWide {
+			lastActivity := "<none>"
+			if vm.LastActivityAt != "" {
+				lastActivity = formatAge(vm.LastActivityAt, now) + " ago"
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s", orNone(vm.TapDeviceName), orNone(vm.RestartPolicy), lastActivity)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// watch calls `render` every `interval` until `ctx` is done. Tables are
+// redrawn in place while the other formats are appended so that they can be
+// piped.
+func watch(ctx context.Context, interval time.Duration, output string, render func() error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if output == outputTable || output == outputWide {
+			// Clear the screen and move the cursor to the top left.
+			fmt.Fprint(os.Stdout, "\033[H\033[2J")
+		}
+		err := render()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
+)
+
+// Uploaded code is limited to this size so that it fits in one request.
+const maxCodeSize = 16 << 20
+
+// readCodeFiles returns the files to send with `entryPoint` by their path
+// relative to the code's working directory. If `dir` is set every file in it is
+// sent and `entryPoint` is relative to it. Otherwise only `entryPoint` is sent.
+// Returns the entry point relative to the working directory too.
+func readCodeFiles(dir string, entryPoint string) (map[string]string, string, error) {
+	if dir == "" {
+		content, err := os.ReadFile(entryPoint)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read entry point: %w", err)
+		}
+		if !utf8.Valid(content) {
+			return nil, "", fmt.Errorf("entry point isn't a text file: %s", entryPoint)
+		}
+		name := filepath.Base(entryPoint)
+		return map[string]string{name: string(content)}, name, nil
+	}
+
+	if !filepath.IsLocal(entryPoint) {
+		return nil, "", fmt.Errorf("entry point must be relative to %s: %s", dir, entryPoint)
+	}
+
+	files := make(map[string]string)
+	total := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden files and directories e.g. .git.
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(content) {
+			return fmt.Errorf("binary files aren't supported: %s", path)
+		}
+		total += len(content)
+		if total > maxCodeSize {
+			return fmt.Errorf("%s is larger than %d bytes", dir, maxCodeSize)
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relPath)] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	entryPoint = filepath.ToSlash(filepath.Clean(entryPoint))
+	if _, ok := files[entryPoint]; !ok {
+		return nil, "", fmt.Errorf("entry point %s isn't in %s", entryPoint, dir)
+	}
+	return files, entryPoint, nil
+}
+
+// streamFromVM posts `body` to `path` of VM `vmName` and copies the streamed
+// output to stdout and stderr. A process that doesn't succeed is returned as a
+// `processError`.
+func streamFromVM(ctx context.Context, action string, vmName string, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	reqURL := fmt.Sprintf("%s/vm/%s/%s", serverURL, url.PathEscape(vmName), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return apiError(action, nil, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(action, resp, errors.New(resp.Status))
+	}
+
+	result, err := execstream.Read(resp.Body, func(chunk execstream.Chunk) {
+		if chunk.Stream == execstream.StreamStderr {
+			os.Stderr.WriteString(chunk.Data)
+		} else {
+			os.Stdout.WriteString(chunk.Data)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read output: %w", err)
+	}
+
+	if result.Status == execstream.StatusSuccess {
+		return nil
+	}
+	exitCode := -1
+	if result.ExitCode != nil {
+		exitCode = *result.ExitCode
+	}
+	return &processError{status: result.Status, exitCode: exitCode, message: result.Error}
+}
+
+// runCode runs the code in `dir` or just `entryPoint` in VM `vmName` after
+// installing `dependencies`.
+func runCode(ctx context.Context, vmName string, lang string, dir string, entryPoint string, dependencies []string, timeoutSeconds int32) error {
+	files, entryPoint, err := readCodeFiles(dir, entryPoint)
+	if err != nil {
+		return err
+	}
+
+	req := serverapi.ExecuteCodeRequest{
+		Lang:           serverapi.PtrString(lang),
+		Files:          &files,
+		EntryPoint:     serverapi.PtrString(entryPoint),
+		Dependencies:   dependencies,
+		TimeoutSeconds: serverapi.PtrInt32(timeoutSeconds),
+	}
+	return streamFromVM(ctx, "execute code", vmName, "execute", req)
+}
+
+// execCommand runs `args` in VM `vmName`.
+func execCommand(ctx context.Context, vmName string, args []string, timeoutSeconds int32) error {
+	if len(args) == 0 {
+		return errors.New("no command given, pass it after --")
+	}
+
+	req := serverapi.ExecCommandRequest{
+		Args:           args,
+		TimeoutSeconds: serverapi.PtrInt32(timeoutSeconds),
+	}
+	return streamFromVM(ctx, "exec command", vmName, "exec", req)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/fs"
@@ -9,11 +10,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
 	"github.com/mattn/go-shellwords"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
 )
 
 const (
@@ -109,7 +113,7 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handler for POST /run_command
-// Expects JSON body with "cmd"
+// Expects JSON body with "cmd" or "args"
 func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		log.WithField("api", "run_cmd").Error("method not allowed")
@@ -119,6 +123,13 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		Cmd string `json:"cmd"`
+		// Run this argv directly instead of `Cmd` through bash.
+		Args []string `json:"args"`
+		// Stream the output as newline delimited JSON chunks instead of
+		// returning it once the command exits.
+		Stream bool `json:"stream"`
+		// Seconds after which a streamed command is killed, 0 means no limit.
+		Timeout int `json:"timeout"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -128,15 +139,18 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if strings.TrimSpace(req.Cmd) == "" {
+	if len(req.Args) == 0 && strings.TrimSpace(req.Cmd) == "" {
 		log.WithField("api", "run_cmd").Error("empty command")
 		http.Error(w, "Empty Command", http.StatusBadRequest)
 		return
 	}
 
 	// Parse the command string using shellwords to handle quotes and escaped spaces
-	parser := shellwords.NewParser()
-	parts, err := parser.Parse(req.Cmd)
+	parts := req.Args
+	if len(parts) == 0 {
+		parser := shellwords.NewParser()
+		parts, err = parser.Parse(req.Cmd)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"api": "run_cmd",
@@ -163,6 +177,9 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create the command
 	cmd := exec.Command("bash", "-c", req.Cmd)
+	if len(req.Args) > 0 {
+		cmd = exec.Command(req.Args[0], req.Args[1:]...)
+	}
 	cmd.Env = env
 	cmd.Dir = baseDir
 
@@ -174,6 +191,21 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		"workingDir": cmd.Dir,
 	}).Info("Executing command")
 
+	if req.Stream {
+		ctx := r.Context()
+		if req.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+			defer cancel()
+		}
+
+		err = execstream.Run(ctx, cmd, execstream.NewWriter(w))
+		if err != nil {
+			log.WithField("api", "run_cmd").WithError(err).Warn("failed to stream output")
+		}
+		return
+	}
+
 	// Execute the command and capture the combined output
 	output, err := cmd.CombinedOutput()
 	if err != nil {
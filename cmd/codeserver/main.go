@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,9 +16,14 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/abshkbh/chv-starter-pack/pkg/config"
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
 )
 
 type codeServer struct {
+	// Runtimes whose toolchain is in the rootfs by language, detected at
+	// startup.
+	runtimes     map[string]Runtime
+	runtimeInfos []RuntimeInfo
 }
 
 type ExecuteRequest struct {
@@ -24,7 +31,15 @@ type ExecuteRequest struct {
 	Files        map[string]string `json:"files"`
 	EntryPoint   string            `json:"entry_point"`
 	Dependencies []string          `json:"dependencies"`
-	Timeout      int               `json:"timeout"`
+	// Dir with dependencies installed ahead of time, which is added to the
+	// code's import path.
+	DependenciesDir string `json:"dependencies_dir"`
+	Timeout         int    `json:"timeout"`
+	// Passed to the code on its stdin e.g. the input of a function.
+	Stdin string `json:"stdin"`
+	// Stream the output as newline delimited JSON chunks instead of returning
+	// it once the code exits.
+	Stream bool `json:"stream"`
 }
 
 type ExecuteResponse struct {
@@ -33,6 +48,18 @@ type ExecuteResponse struct {
 	Status string `json:"status"`
 }
 
+type GuestFile struct {
+	Path string `json:"path"`
+	// Base64 encoded in JSON.
+	Content []byte `json:"content"`
+	// Defaults to 0644.
+	Mode os.FileMode `json:"mode"`
+}
+
+type UploadFilesRequest struct {
+	Files []GuestFile `json:"files"`
+}
+
 func (cs *codeServer) indexRoute(w http.ResponseWriter, r *http.Request) {
 	response := map[string]string{
 		"msg": "Hello from codeserver",
@@ -42,64 +69,42 @@ func (cs *codeServer) indexRoute(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func (cs *codeServer) executePythonCode(req *ExecuteRequest, w http.ResponseWriter, r *http.Request) {
-	tempDir, err := os.MkdirTemp("/tmp", "execute-*")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create temporary directory: %v", err.Error()), http.StatusInternalServerError)
-		return
-	}
-	defer os.RemoveAll(tempDir)
-
-	// Write files to the temporary directory
+// writeCodeFiles writes the files of `req` to `dir`. Returns false if it
+// failed, in which case the error has been written to `w`.
+func writeCodeFiles(req *ExecuteRequest, dir string, w http.ResponseWriter) bool {
 	for filename, content := range req.Files {
-		filePath := filepath.Join(tempDir, filename)
+		if !filepath.IsLocal(filename) {
+			http.Error(w, fmt.Sprintf("file path isn't relative: %q", filename), http.StatusBadRequest)
+			return false
+		}
+		filePath := filepath.Join(dir, filename)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			http.Error(w, fmt.Sprintf("failed to create dir: %v", err.Error()), http.StatusInternalServerError)
+			return false
+		}
 		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
 			http.Error(w, fmt.Sprintf("failed to write file: %v", err.Error()), http.StatusInternalServerError)
-			return
+			return false
 		}
 	}
+	return true
+}
 
-	// Install dependencies
-	venvPythonPath := ""
-	if len(req.Dependencies) > 0 {
-		venvDir := filepath.Join(tempDir, "venv")
-
-		// Create virtual environment
-		cmd := exec.Command("python3", "-m", "venv", venvDir)
-		if err := cmd.Run(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to create virtual environment: %v", err.Error()), http.StatusInternalServerError)
-			return
-		}
-
-		// Activate virtual environment and install dependencies
-		pipPath := filepath.Join(venvDir, "bin", "pip")
-		cmd = exec.Command(pipPath, append([]string{
-			"install",
-			"--no-cache-dir",
-		}, req.Dependencies...)...)
-
-		if err := cmd.Run(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to install dependencies: %v", err.Error()), http.StatusInternalServerError)
-			return
+// runCode runs `cmd` and writes its output to `w`, either streamed or once it
+// exits. It's killed along with the processes it started once `ctx` is done,
+// i.e. if its timeout expires or the client goes away.
+func runCode(ctx context.Context, req *ExecuteRequest, cmd *exec.Cmd, w http.ResponseWriter) {
+	if req.Stream {
+		err := execstream.Run(ctx, cmd, execstream.NewWriter(w))
+		if err != nil {
+			log.WithError(err).Warn("failed to stream output")
 		}
-
-		// Set the PATH to use the virtual environment's Python
-		venvPythonPath = filepath.Join(venvDir, "bin", "python")
-		os.Setenv("PATH", filepath.Join(venvDir, "bin")+":"+os.Getenv("PATH"))
+		return
 	}
 
-	// Execute the Python script
-	var pythonPath string
-	if venvPythonPath == "" {
-		pythonPath = "python3"
-	} else {
-		pythonPath = venvPythonPath
-	}
-	cmd := exec.Command(pythonPath, filepath.Join(tempDir, req.EntryPoint))
-	cmd.Dir = tempDir
-
-	outputChan := make(chan []byte)
-	errorChan := make(chan error)
+	execstream.SetProcessGroup(cmd)
+	outputChan := make(chan []byte, 1)
+	errorChan := make(chan error, 1)
 	go func() {
 		output, err := cmd.CombinedOutput()
 		if err != nil {
@@ -127,20 +132,28 @@ func (cs *codeServer) executePythonCode(req *ExecuteRequest, w http.ResponseWrit
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 
-	case <-time.After(time.Duration(req.Timeout) * time.Second):
-		cmd.Process.Kill()
-		response := ExecuteResponse{
-			Error:  "Execution timed out",
-			Status: "timeout",
+	case <-ctx.Done():
+		execstream.KillProcessGroup(cmd)
+		// Its files are removed once this returns.
+		select {
+		case <-outputChan:
+		case <-errorChan:
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			writeTimeout(w)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusRequestTimeout)
-		json.NewEncoder(w).Encode(response)
 	}
 }
 
-func (cs *codeServer) executeTypescriptCode(req *ExecuteRequest, w http.ResponseWriter, r *http.Request) {
-	// TODO: Unimplemented.
+// writeTimeout responds that the execution timed out.
+func writeTimeout(w http.ResponseWriter) {
+	response := ExecuteResponse{
+		Error:  "Execution timed out",
+		Status: "timeout",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestTimeout)
+	json.NewEncoder(w).Encode(response)
 }
 
 func (cs *codeServer) executeRoute(w http.ResponseWriter, r *http.Request) {
@@ -155,31 +168,153 @@ func (cs *codeServer) executeRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.EntryPoint == "" || !filepath.IsLocal(req.EntryPoint) {
+		http.Error(w, fmt.Sprintf("invalid entry point: %q", req.EntryPoint), http.StatusBadRequest)
+		return
+	}
+
 	lang := strings.ToLower(req.Lang)
-	if lang != "python" && lang != "typescript" {
+	runtime, ok := cs.runtimes[lang]
+	if !ok {
 		http.Error(w, fmt.Sprintf("unsupported language: %s", lang), http.StatusBadRequest)
 		return
 	}
 
-	if lang == "python" {
-		cs.executePythonCode(&req, w, r)
-	} else {
-		cs.executeTypescriptCode(&req, w, r)
+	tempDir, err := os.MkdirTemp("/tmp", "execute-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create temporary directory: %v", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	if !writeCodeFiles(&req, tempDir, w) {
+		return
+	}
+
+	// The timeout covers installing dependencies as well as running the code.
+	// A timeout of 0 means no limit.
+	ctx := r.Context()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	env, err := runtime.Prepare(ctx, &req, tempDir)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeTimeout(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to prepare %s code: %v", runtime.Name(), err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(req.Dependencies) > 0 {
+		err := runtime.InstallDependencies(ctx, &req, tempDir, env)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			writeTimeout(w)
+			return
+		}
+		if errors.Is(err, errDependenciesUnsupported) {
+			http.Error(w, fmt.Sprintf("%s: %v", runtime.Name(), err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to install dependencies: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cmd := runtime.Command(&req, tempDir, env)
+	cmd.Dir = tempDir
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(req.Stdin)
+	runCode(ctx, &req, cmd, w)
+}
+
+func (cs *codeServer) runtimesRoute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]RuntimeInfo{"runtimes": cs.runtimeInfos})
+}
+
+// writeFile writes `file`, creating its parent directories.
+func writeFile(file GuestFile) error {
+	if !filepath.IsAbs(file.Path) {
+		return fmt.Errorf("path isn't absolute: %q", file.Path)
+	}
+
+	mode := file.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err := os.MkdirAll(filepath.Dir(file.Path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create parent dir of: %s: %w", file.Path, err)
+	}
+
+	// Write to a temporary file first so that a failed upload doesn't leave a
+	// partially written file behind.
+	tmpFile, err := os.CreateTemp(filepath.Dir(file.Path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for: %s: %w", file.Path, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(file.Content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write: %s: %w", file.Path, err)
+	}
+
+	err = os.Chmod(tmpFile.Name(), mode)
+	if err != nil {
+		return fmt.Errorf("failed to set mode of: %s: %w", file.Path, err)
+	}
+	return os.Rename(tmpFile.Name(), file.Path)
+}
+
+func (cs *codeServer) uploadFilesRoute(w http.ResponseWriter, r *http.Request) {
+	var req UploadFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	for _, file := range req.Files {
+		err := writeFile(file)
+		if err != nil {
+			log.WithError(err).Errorf("failed to write file: %s", file.Path)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("wrote file: %s (%d bytes)", file.Path, len(file.Content))
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
 func initializeRoutes(cs *codeServer) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", cs.indexRoute)
 	mux.HandleFunc("POST /execute", cs.executeRoute)
+	mux.HandleFunc("GET /runtimes", cs.runtimesRoute)
+	mux.HandleFunc("PUT /files", cs.uploadFilesRoute)
 	return mux
 }
 
 func main() {
 	log.Info("starting codeserver...")
-	var codeServerConfig *config.CodeServerConfig
 	var configFile string
+	var port string
+	var venvCacheDir string
+	var venvCacheMaxSizeMB int
+	var venvCacheMaxEntries int
+	var wheelhouseDir string
 
 	app := &cli.App{
 		Name:  "chv-codeserver",
@@ -188,18 +323,66 @@ func main() {
 			&cli.StringFlag{
 				Name:        "config",
 				Aliases:     []string{"c"},
-				Required:    true,
-				Usage:       "Path to config file",
+				Usage:       "Path to config file. Its settings take precedence over the other flags",
 				Destination: &configFile,
 			},
+			// guestinit starts the code server without a config file.
+			&cli.StringFlag{
+				Name:        "port",
+				Usage:       "Port to listen on",
+				Value:       "4030",
+				Destination: &port,
+			},
+			&cli.StringFlag{
+				Name:        "venv-cache-dir",
+				Usage:       "Dir Python venvs are cached in by their dependencies, empty disables the cache",
+				Value:       defaultVenvCacheDir,
+				Destination: &venvCacheDir,
+			},
+			&cli.IntFlag{
+				Name:        "venv-cache-max-size-mb",
+				Usage:       "Size past which the least recently used venvs are evicted",
+				Value:       defaultVenvCacheMaxSizeMB,
+				Destination: &venvCacheMaxSizeMB,
+			},
+			&cli.IntFlag{
+				Name:        "venv-cache-max-entries",
+				Usage:       "Number of venvs past which the least recently used ones are evicted",
+				Value:       defaultVenvCacheMaxEntries,
+				Destination: &venvCacheMaxEntries,
+			},
+			&cli.StringFlag{
+				Name:        "wheelhouse",
+				Usage:       "Dir with wheels Python dependencies are installed from without network access, if it exists",
+				Value:       defaultWheelhouseDir,
+				Destination: &wheelhouseDir,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			var err error
-			codeServerConfig, err = config.GetCodeServerConfig(configFile)
+			if configFile == "" {
+				return nil
+			}
+
+			codeServerConfig, err := config.GetCodeServerConfig(configFile)
 			if err != nil {
 				return fmt.Errorf("server config not found: %v", err)
 			}
 			log.Infof("code server config: %v", codeServerConfig)
+			if codeServerConfig.Port != "" {
+				port = codeServerConfig.Port
+			}
+			if codeServerConfig.VenvCache.Dir != "" {
+				venvCacheDir = codeServerConfig.VenvCache.Dir
+			}
+			if codeServerConfig.VenvCache.MaxSizeMB > 0 {
+				venvCacheMaxSizeMB = codeServerConfig.VenvCache.MaxSizeMB
+			}
+			if codeServerConfig.VenvCache.MaxEntries > 0 {
+				venvCacheMaxEntries = codeServerConfig.VenvCache.MaxEntries
+			}
+			if codeServerConfig.WheelhouseDir != "" {
+				wheelhouseDir = codeServerConfig.WheelhouseDir
+			}
 			return nil
 		},
 	}
@@ -209,11 +392,29 @@ func main() {
 		log.WithError(err).Fatal("code server exited with error")
 	}
 
-	cs := &codeServer{}
+	if wheelhouseDir != "" {
+		if _, err := os.Stat(wheelhouseDir); err != nil {
+			log.Infof("not using missing wheelhouse: %s", wheelhouseDir)
+			wheelhouseDir = ""
+		}
+	}
+	var venvs *venvCache
+	if venvCacheDir != "" {
+		venvs, err = newVenvCache(venvCacheDir, venvCacheMaxSizeMB, venvCacheMaxEntries, wheelhouseDir)
+		if err != nil {
+			// Executions still work, just without the cache.
+			log.WithError(err).Error("failed to set up the venv cache")
+		}
+	}
+	runtimes, runtimeInfos := detectRuntimes(allRuntimes(venvs, wheelhouseDir))
+	cs := &codeServer{
+		runtimes:     runtimes,
+		runtimeInfos: runtimeInfos,
+	}
 	router := initializeRoutes(cs)
 
 	server := &http.Server{
-		Addr:    codeServerConfig.Port,
+		Addr:    ":" + port,
 		Handler: router,
 	}
 
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
+)
+
+const (
+	// How long a toolchain gets to report its version at startup.
+	detectTimeout = 10 * time.Second
+	// Shared by every execution of Go code. The module and build caches are
+	// content addressed so sharing them is safe and saves downloads.
+	goCacheDir = "/tmp/codeserver/go"
+)
+
+// errDependenciesUnsupported is returned by runtimes that can't install
+// dependencies.
+var errDependenciesUnsupported = errors.New("dependencies aren't supported")
+
+// Runtime runs code in one language. The code is written to a dir that's
+// removed after it exits.
+type Runtime interface {
+	// Name is the language requests ask for.
+	Name() string
+	// Aliases are other languages the runtime handles.
+	Aliases() []string
+	// Detect returns the version of the toolchain, or an error if it isn't
+	// in the rootfs.
+	Detect(ctx context.Context) (string, error)
+	// Prepare sets up the code in `dir` to be built and returns the
+	// environment to install dependencies and run it with.
+	Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error)
+	// InstallDependencies installs the dependencies of `req` so that the code
+	// in `dir` can use them. Anything held for the code, like a cached venv,
+	// is released once `ctx` is done.
+	InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error
+	// Command returns the command that runs the entry point of `req`. It's
+	// run in its own process group, which is killed on a timeout along with
+	// any compiler or interpreter it started.
+	Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd
+}
+
+// RuntimeInfo is returned by the /runtimes endpoint.
+type RuntimeInfo struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	Version string   `json:"version"`
+}
+
+// allRuntimes returns the runtimes the code server knows of, whether or not
+// their toolchain is in the rootfs. Python venvs are cached in `venvs` unless
+// it's nil.
+func allRuntimes(venvs *venvCache, wheelhouseDir string) []Runtime {
+	return []Runtime{
+		pythonRuntime{venvs: venvs, wheelhouseDir: wheelhouseDir},
+		nodeRuntime{},
+		bashRuntime{},
+		goRuntime{},
+		rustRuntime{},
+	}
+}
+
+// detectRuntimes returns those of `all` whose toolchain is in the rootfs by
+// name and alias, and their info.
+func detectRuntimes(all []Runtime) (map[string]Runtime, []RuntimeInfo) {
+	runtimes := make(map[string]Runtime)
+	var infos []RuntimeInfo
+	for _, runtime := range all {
+		ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+		version, err := runtime.Detect(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Infof("runtime %s isn't available", runtime.Name())
+			continue
+		}
+		log.Infof("runtime %s available: %s", runtime.Name(), version)
+
+		runtimes[runtime.Name()] = runtime
+		for _, alias := range runtime.Aliases() {
+			runtimes[alias] = runtime
+		}
+		infos = append(infos, RuntimeInfo{
+			Name:    runtime.Name(),
+			Aliases: runtime.Aliases(),
+			Version: version,
+		})
+	}
+	return runtimes, infos
+}
+
+// commandVersion returns the first line of the output of `name` `args`.
+func commandVersion(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", name, err)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return version, nil
+}
+
+// runInstall runs an install command created with `exec.CommandContext`,
+// returning its output on failure.
+func runInstall(cmd *exec.Cmd, dir string, env []string) error {
+	cmd.Dir = dir
+	cmd.Env = env
+	// Package managers start processes of their own, which would otherwise
+	// outlive a timeout and keep the output open.
+	execstream.SetProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		execstream.KillProcessGroup(cmd)
+		return nil
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// pythonRuntime installs dependencies into a venv, shared with other
+// executions with the same dependencies if `venvs` is set.
+type pythonRuntime struct {
+	venvs *venvCache
+	// Dependencies are installed from here without network access if they're
+	// all in it.
+	wheelhouseDir string
+}
+
+func (pythonRuntime) Name() string {
+	return "python"
+}
+
+func (pythonRuntime) Aliases() []string {
+	return nil
+}
+
+func (pythonRuntime) Detect(ctx context.Context) (string, error) {
+	return commandVersion(ctx, "python3", "--version")
+}
+
+func (pythonRuntime) Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error) {
+	env := os.Environ()
+	if len(req.Dependencies) > 0 {
+		// The venv created for the dependencies comes first.
+		env = append(env, "PATH="+filepath.Join(dir, "venv", "bin")+":"+os.Getenv("PATH"))
+	}
+	if req.DependenciesDir != "" {
+		env = append(env, "PYTHONPATH="+req.DependenciesDir)
+	}
+	return env, nil
+}
+
+// InstallDependencies links the cached venv with the dependencies to the venv
+// dir of the code, so that running it doesn't depend on whether it's cached.
+// Cached venvs are read-only so the code can't change them for later
+// executions.
+func (p pythonRuntime) InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error {
+	venvDir := filepath.Join(dir, "venv")
+	if p.venvs == nil {
+		return createVenv(ctx, venvDir, req.Dependencies, p.wheelhouseDir, env)
+	}
+
+	cachedDir, release, err := p.venvs.acquire(ctx, req.Dependencies, env)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, release)
+	return os.Symlink(cachedDir, venvDir)
+}
+
+func (pythonRuntime) Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd {
+	pythonPath := "python3"
+	if len(req.Dependencies) > 0 {
+		pythonPath = filepath.Join(dir, "venv", "bin", "python")
+	}
+	return exec.Command(pythonPath, filepath.Join(dir, req.EntryPoint))
+}
+
+// nodeRuntime runs TypeScript with tsx and JavaScript with node.
+type nodeRuntime struct{}
+
+func (nodeRuntime) Name() string {
+	return "typescript"
+}
+
+func (nodeRuntime) Aliases() []string {
+	return []string{"javascript", "node"}
+}
+
+func (nodeRuntime) Detect(ctx context.Context) (string, error) {
+	return commandVersion(ctx, "node", "--version")
+}
+
+func (nodeRuntime) Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error) {
+	// npm's cache is kept with the code so that executions don't share it.
+	env := append(os.Environ(), "npm_config_cache="+filepath.Join(dir, ".npm"))
+	if req.DependenciesDir != "" {
+		env = append(env, "NODE_PATH="+req.DependenciesDir)
+	}
+	return env, nil
+}
+
+// InstallDependencies installs the dependencies into the node_modules of the
+// code, where node resolves them from.
+func (nodeRuntime) InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error {
+	return runInstall(exec.CommandContext(ctx, "npm", append([]string{
+		"install",
+		"--prefix", dir,
+		"--no-save",
+		"--no-audit",
+		"--no-fund",
+		"--no-package-lock",
+	}, req.Dependencies...)...), dir, env)
+}
+
+func (nodeRuntime) Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd {
+	entryPoint := filepath.Join(dir, req.EntryPoint)
+	if isJavascriptFile(req.EntryPoint) {
+		return exec.Command("node", entryPoint)
+	}
+	return typescriptCommand(entryPoint)
+}
+
+// isJavascriptFile returns whether `path` can be run by node without
+// transpiling it first.
+func isJavascriptFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".js", ".mjs", ".cjs":
+		return true
+	}
+	return false
+}
+
+// typescriptCommand returns the command that runs the TypeScript file
+// `entryPoint`. The tsx installed in the rootfs is preferred, falling back to
+// fetching it with npx.
+func typescriptCommand(entryPoint string) *exec.Cmd {
+	if tsxPath, err := exec.LookPath("tsx"); err == nil {
+		return exec.Command(tsxPath, entryPoint)
+	}
+	return exec.Command("npx", "--yes", "tsx", entryPoint)
+}
+
+type bashRuntime struct{}
+
+func (bashRuntime) Name() string {
+	return "bash"
+}
+
+func (bashRuntime) Aliases() []string {
+	return []string{"shell"}
+}
+
+func (bashRuntime) Detect(ctx context.Context) (string, error) {
+	return commandVersion(ctx, "bash", "--version")
+}
+
+func (bashRuntime) Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error) {
+	return os.Environ(), nil
+}
+
+func (bashRuntime) InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error {
+	return errDependenciesUnsupported
+}
+
+func (bashRuntime) Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd {
+	return exec.Command("bash", filepath.Join(dir, req.EntryPoint))
+}
+
+// goRuntime builds the package of the entry point as module "main", unless
+// the code comes with its own go.mod.
+type goRuntime struct{}
+
+func (goRuntime) Name() string {
+	return "go"
+}
+
+func (goRuntime) Aliases() []string {
+	return []string{"golang"}
+}
+
+func (goRuntime) Detect(ctx context.Context) (string, error) {
+	return commandVersion(ctx, "go", "version")
+}
+
+// Prepare creates a go.mod if the code doesn't have one. Imports missing from
+// it are resolved when building.
+func (goRuntime) Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error) {
+	// $HOME isn't set when started by guestinit, which go needs for its
+	// caches otherwise.
+	env := append(os.Environ(),
+		"GOPATH="+filepath.Join(goCacheDir, "path"),
+		"GOCACHE="+filepath.Join(goCacheDir, "build"),
+		"GOFLAGS=-mod=mod",
+	)
+
+	_, err := os.Stat(filepath.Join(dir, "go.mod"))
+	if err == nil {
+		return env, nil
+	}
+	err = runInstall(exec.CommandContext(ctx, "go", "mod", "init", "main"), dir, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create go.mod: %w", err)
+	}
+	return env, nil
+}
+
+func (goRuntime) InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error {
+	return runInstall(exec.CommandContext(ctx, "go", append([]string{"get"}, req.Dependencies...)...), dir, env)
+}
+
+// Command builds the package of the entry point and then execs it rather than
+// using `go run`, so that the code's exit code and signals aren't those of the
+// go tool. The build is part of the command and counts against the timeout.
+func (goRuntime) Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd {
+	pkg := "./" + filepath.Dir(req.EntryPoint)
+	binary := filepath.Join(dir, ".bin", "main")
+	return exec.Command("sh", "-c", `go build -o "$1" "$2" && exec "$1"`, "sh", binary, pkg)
+}
+
+// rustRuntime builds the entry point as the only binary of package "main",
+// unless the code comes with its own Cargo.toml.
+type rustRuntime struct{}
+
+func (rustRuntime) Name() string {
+	return "rust"
+}
+
+func (rustRuntime) Aliases() []string {
+	return nil
+}
+
+func (rustRuntime) Detect(ctx context.Context) (string, error) {
+	return commandVersion(ctx, "cargo", "--version")
+}
+
+// Prepare creates a Cargo.toml if the code doesn't have one.
+func (rustRuntime) Prepare(ctx context.Context, req *ExecuteRequest, dir string) ([]string, error) {
+	env := append(os.Environ(), "CARGO_TARGET_DIR="+filepath.Join(dir, "target"))
+
+	manifestPath := filepath.Join(dir, "Cargo.toml")
+	_, err := os.Stat(manifestPath)
+	if err == nil {
+		return env, nil
+	}
+
+	manifest := fmt.Sprintf(`[package]
+name = "main"
+version = "0.1.0"
+edition = "2021"
+
+[[bin]]
+name = "main"
+path = %q
+
+[dependencies]
+`, req.EntryPoint)
+	err = os.WriteFile(manifestPath, []byte(manifest), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cargo.toml: %w", err)
+	}
+	return env, nil
+}
+
+func (rustRuntime) InstallDependencies(ctx context.Context, req *ExecuteRequest, dir string, env []string) error {
+	return runInstall(exec.CommandContext(ctx, "cargo", append([]string{"add", "--quiet"}, req.Dependencies...)...), dir, env)
+}
+
+// Command builds the binary and then execs it, like the go runtime does, with
+// the build counting against the timeout. Packages that come with their own
+// Cargo.toml are run with `cargo run` as their binary's name isn't known.
+func (rustRuntime) Command(req *ExecuteRequest, dir string, env []string) *exec.Cmd {
+	if req.Files["Cargo.toml"] != "" {
+		return exec.Command("cargo", "run", "--quiet")
+	}
+	return exec.Command("sh", "-c", `cargo build --quiet --bin main && exec "$1"`, "sh", filepath.Join(dir, "target", "debug", "main"))
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Suffix of the file written next to a cached venv once its dependencies
+	// are installed. Its modification time is when the venv was last used.
+	// It's outside the venv as the venv is read-only.
+	venvCompleteMarker         = ".complete"
+	defaultVenvCacheDir        = "/var/cache/chv-codeserver/venvs"
+	defaultVenvCacheMaxSizeMB  = 2048
+	defaultVenvCacheMaxEntries = 16
+	// Venvs are built independently of the executions waiting for them, so
+	// that one giving up doesn't fail the others.
+	venvBuildTimeout = 10 * time.Minute
+	// Baked into the rootfs to install dependencies without network access.
+	defaultWheelhouseDir = "/opt/wheelhouse"
+)
+
+// cachedVenv is a venv with the dependencies of its key installed.
+type cachedVenv struct {
+	path      string
+	sizeBytes int64
+	lastUsed  time.Time
+	// Executions using the venv, which isn't evicted while they run.
+	refs int
+}
+
+// venvBuild is a venv being created. Executions needing the same venv wait
+// for it instead of creating their own.
+type venvBuild struct {
+	done chan struct{}
+	err  error
+}
+
+// venvCache keeps Python venvs by their dependencies and the Python version so
+// that executions with the same dependencies don't install them again. The
+// least recently used venvs are evicted once the cache exceeds its limits.
+type venvCache struct {
+	dir           string
+	maxSizeBytes  int64
+	maxEntries    int
+	wheelhouseDir string
+	pythonVersion string
+
+	lock     sync.Mutex
+	venvs    map[string]*cachedVenv
+	building map[string]*venvBuild
+}
+
+// newVenvCache returns a cache in `dir`, keeping the venvs left there by
+// previous runs.
+func newVenvCache(dir string, maxSizeMB int, maxEntries int, wheelhouseDir string) (*venvCache, error) {
+	if maxSizeMB <= 0 || maxEntries <= 0 {
+		return nil, fmt.Errorf("venv cache limits must be positive: %d MB, %d entries", maxSizeMB, maxEntries)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+	// Includes the build so that venvs aren't shared across rebuilds of the
+	// same version.
+	output, err := exec.CommandContext(ctx, "python3", "-c", "import sys; print(sys.version)").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get python version: %w", err)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create venv cache dir: %w", err)
+	}
+
+	c := &venvCache{
+		dir:           dir,
+		maxSizeBytes:  int64(maxSizeMB) * 1024 * 1024,
+		maxEntries:    maxEntries,
+		wheelhouseDir: wheelhouseDir,
+		pythonVersion: strings.TrimSpace(string(output)),
+		venvs:         make(map[string]*cachedVenv),
+		building:      make(map[string]*venvBuild),
+	}
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	return c, nil
+}
+
+// load adds the complete venvs in the cache's dir and removes the ones whose
+// creation was interrupted.
+func (c *venvCache) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read venv cache dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(c.dir, entry.Name())
+		if !entry.IsDir() {
+			// Markers are checked along with their venv.
+			if strings.HasSuffix(entry.Name(), venvCompleteMarker) {
+				continue
+			}
+			os.Remove(path)
+			continue
+		}
+
+		info, err := os.Stat(path + venvCompleteMarker)
+		if err != nil {
+			log.Infof("removing incomplete venv: %s", path)
+			removeVenv(path)
+			continue
+		}
+
+		sizeBytes, err := dirSize(path)
+		if err == nil {
+			err = mountVenvReadOnly(path)
+		}
+		if err != nil {
+			log.WithError(err).Warnf("removing unusable venv: %s", path)
+			removeVenv(path)
+			continue
+		}
+		c.venvs[entry.Name()] = &cachedVenv{
+			path:      path,
+			sizeBytes: sizeBytes,
+			lastUsed:  info.ModTime(),
+		}
+	}
+
+	// Left behind by venvs removed while the code server wasn't running.
+	for _, entry := range entries {
+		key, ok := strings.CutSuffix(entry.Name(), venvCompleteMarker)
+		if _, cached := c.venvs[key]; ok && !cached {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+	log.Infof("loaded %d cached venvs from: %s", len(c.venvs), c.dir)
+	return nil
+}
+
+// key returns the key of the venv with `dependencies`, whatever their order.
+func (c *venvCache) key(dependencies []string) string {
+	normalized := make([]string, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		normalized = append(normalized, strings.TrimSpace(dependency))
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", c.pythonVersion)
+	for _, dependency := range normalized {
+		fmt.Fprintf(hash, "%s\n", dependency)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// acquire returns the path of a venv with `dependencies` installed, creating
+// it if it isn't cached. The venv isn't evicted until `release` is called.
+func (c *venvCache) acquire(ctx context.Context, dependencies []string, env []string) (string, func(), error) {
+	key := c.key(dependencies)
+	logger := log.WithField("venv", key)
+
+	c.lock.Lock()
+	for {
+		if venv, ok := c.venvs[key]; ok {
+			venv.refs++
+			venv.lastUsed = time.Now()
+			// A venv that was just built isn't evicted until it's used.
+			c.evict()
+			c.lock.Unlock()
+			logger.Info("using cached venv")
+			return venv.path, func() { c.release(key) }, nil
+		}
+
+		build, ok := c.building[key]
+		if !ok {
+			build = &venvBuild{done: make(chan struct{})}
+			c.building[key] = build
+			go c.build(key, dependencies, env, build)
+		}
+		c.lock.Unlock()
+		select {
+		case <-build.done:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+		if build.err != nil {
+			return "", nil, build.err
+		}
+		c.lock.Lock()
+	}
+}
+
+// build creates the venv `key` with `dependencies` and adds it to the cache.
+// It's done once `build` is.
+func (c *venvCache) build(key string, dependencies []string, env []string, build *venvBuild) {
+	ctx, cancel := context.WithTimeout(context.Background(), venvBuildTimeout)
+	defer cancel()
+
+	// Created in place as venvs can't be moved once created.
+	path := filepath.Join(c.dir, key)
+	log.WithField("venv", key).Infof("creating venv with: %v", dependencies)
+	sizeBytes, err := c.create(ctx, path, dependencies, env)
+	if err != nil {
+		removeVenv(path)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.building, key)
+	build.err = err
+	close(build.done)
+	if err != nil {
+		return
+	}
+
+	// Not evicted here so that it's still cached for the executions waiting
+	// for it, `acquire` evicts once one uses it.
+	c.venvs[key] = &cachedVenv{
+		path:      path,
+		sizeBytes: sizeBytes,
+		lastUsed:  time.Now(),
+	}
+}
+
+// create creates a read-only venv at `path` with `dependencies` installed and
+// returns its size.
+func (c *venvCache) create(ctx context.Context, path string, dependencies []string, env []string) (int64, error) {
+	// Left over by a creation that failed to clean up.
+	err := removeVenv(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = createVenv(ctx, path, dependencies, c.wheelhouseDir, env)
+	if err != nil {
+		return 0, err
+	}
+
+	sizeBytes, err := dirSize(path)
+	if err != nil {
+		return 0, err
+	}
+	err = mountVenvReadOnly(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.WriteFile(path+venvCompleteMarker, nil, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark venv complete: %w", err)
+	}
+	return sizeBytes, nil
+}
+
+// release marks the venv `key` as no longer used by an execution.
+func (c *venvCache) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	venv, ok := c.venvs[key]
+	if !ok {
+		return
+	}
+	venv.refs--
+	venv.lastUsed = time.Now()
+	// Persists when it was last used for the next run.
+	os.Chtimes(venv.path+venvCompleteMarker, venv.lastUsed, venv.lastUsed)
+	c.evict()
+}
+
+// evict removes the least recently used venvs that aren't in use until the
+// cache is within its limits.
+//
+// Must be called with `c.lock` held.
+func (c *venvCache) evict() {
+	for {
+		var totalBytes int64
+		for _, venv := range c.venvs {
+			totalBytes += venv.sizeBytes
+		}
+		if totalBytes <= c.maxSizeBytes && len(c.venvs) <= c.maxEntries {
+			return
+		}
+
+		oldestKey := ""
+		for key, venv := range c.venvs {
+			if venv.refs > 0 {
+				continue
+			}
+			if oldestKey == "" || venv.lastUsed.Before(c.venvs[oldestKey].lastUsed) {
+				oldestKey = key
+			}
+		}
+		// Evicted once they're released.
+		if oldestKey == "" {
+			return
+		}
+
+		venv := c.venvs[oldestKey]
+		delete(c.venvs, oldestKey)
+		log.WithField("venv", oldestKey).Infof("evicting venv of %d bytes", venv.sizeBytes)
+		err := removeVenv(venv.path)
+		if err != nil {
+			log.WithError(err).Warnf("failed to remove venv: %s", venv.path)
+		}
+	}
+}
+
+// mountVenvReadOnly bind mounts the venv at `path` read-only onto itself. Code
+// runs as root so file permissions wouldn't keep it from changing the venv,
+// e.g. by installing packages into it, which would also leave its size stale.
+func mountVenvReadOnly(path string) error {
+	// Left mounted by a previous run of the code server.
+	unmountVenv(path)
+
+	err := syscall.Mount(path, path, "", syscall.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount venv: %w", err)
+	}
+	err = syscall.Mount("", path, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+	if err != nil {
+		unmountVenv(path)
+		return fmt.Errorf("failed to make venv read-only: %w", err)
+	}
+	return nil
+}
+
+// unmountVenv undoes `mountVenvReadOnly`. Venvs that aren't mounted are left as
+// they are.
+func unmountVenv(path string) error {
+	err := syscall.Unmount(path, syscall.MNT_DETACH)
+	if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to unmount venv: %w", err)
+	}
+	return nil
+}
+
+// removeVenv removes the venv at `path` and its marker.
+func removeVenv(path string) error {
+	err := unmountVenv(path)
+	if err != nil {
+		return err
+	}
+	os.Remove(path + venvCompleteMarker)
+	return os.RemoveAll(path)
+}
+
+// createVenv creates a venv at `path` and installs `dependencies` into it,
+// only from `wheelhouseDir` if it has all of them.
+func createVenv(ctx context.Context, path string, dependencies []string, wheelhouseDir string, env []string) error {
+	err := runInstall(exec.CommandContext(ctx, "python3", "-m", "venv", path), "", env)
+	if err != nil {
+		return fmt.Errorf("failed to create virtual environment: %w", err)
+	}
+
+	pipPath := filepath.Join(path, "bin", "pip")
+	args := append([]string{"install", "--no-cache-dir"}, dependencies...)
+	if wheelhouseDir != "" {
+		offlineArgs := append([]string{"install", "--no-cache-dir", "--no-index", "--find-links", wheelhouseDir}, dependencies...)
+		err := runInstall(exec.CommandContext(ctx, pipPath, offlineArgs...), "", env)
+		if err == nil {
+			return nil
+		}
+		log.WithError(err).Info("dependencies aren't all in the wheelhouse, installing from the index")
+		// The wheelhouse is still preferred for the dependencies it has.
+		args = append([]string{"install", "--no-cache-dir", "--find-links", wheelhouseDir}, dependencies...)
+	}
+	return runInstall(exec.CommandContext(ctx, pipPath, args...), "", env)
+}
+
+// dirSize returns the total size of the files in `dir`.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
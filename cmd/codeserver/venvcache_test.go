@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestVenvCacheKey(t *testing.T) {
+	c := &venvCache{pythonVersion: "3.12.3 (main, Apr 10 2024, 05:33:47) [GCC 13.2.0]"}
+	base := c.key([]string{"requests==2.32.3", "numpy"})
+
+	tests := []struct {
+		name         string
+		dependencies []string
+		same         bool
+	}{
+		{name: "same order", dependencies: []string{"requests==2.32.3", "numpy"}, same: true},
+		{name: "other order", dependencies: []string{"numpy", "requests==2.32.3"}, same: true},
+		{name: "whitespace", dependencies: []string{" numpy", "requests==2.32.3 \n"}, same: true},
+		{name: "duplicates", dependencies: []string{"numpy", "requests==2.32.3", "numpy"}, same: true},
+		{name: "other version", dependencies: []string{"numpy", "requests==2.31.0"}},
+		{name: "subset", dependencies: []string{"numpy"}},
+		{name: "superset", dependencies: []string{"numpy", "requests==2.32.3", "pandas"}},
+		{name: "joined", dependencies: []string{"numpy requests==2.32.3"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key := c.key(tc.dependencies)
+			if (key == base) != tc.same {
+				t.Errorf("key of %q is %s, base is %s, want same: %v", tc.dependencies, key, base, tc.same)
+			}
+		})
+	}
+
+	other := &venvCache{pythonVersion: "3.11.9"}
+	if other.key([]string{"requests==2.32.3", "numpy"}) == base {
+		t.Error("venvs of different python versions have the same key")
+	}
+}
+
+func TestVenvCacheEvict(t *testing.T) {
+	now := time.Now()
+	type venv struct {
+		key       string
+		sizeBytes int64
+		age       time.Duration
+		refs      int
+	}
+	tests := []struct {
+		name         string
+		maxSizeBytes int64
+		maxEntries   int
+		venvs        []venv
+		want         []string
+	}{
+		{
+			name:         "within limits",
+			maxSizeBytes: 100,
+			maxEntries:   3,
+			venvs:        []venv{{key: "a", sizeBytes: 50, age: time.Hour}, {key: "b", sizeBytes: 50}},
+			want:         []string{"a", "b"},
+		},
+		{
+			name:         "too many entries",
+			maxSizeBytes: 100,
+			maxEntries:   2,
+			venvs: []venv{
+				{key: "a", sizeBytes: 10, age: time.Minute},
+				{key: "b", sizeBytes: 10, age: time.Hour},
+				{key: "c", sizeBytes: 10},
+			},
+			want: []string{"a", "c"},
+		},
+		{
+			name:         "too large",
+			maxSizeBytes: 100,
+			maxEntries:   10,
+			venvs: []venv{
+				{key: "a", sizeBytes: 60, age: 2 * time.Hour},
+				{key: "b", sizeBytes: 30, age: time.Hour},
+				{key: "c", sizeBytes: 30},
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:         "least recently used first",
+			maxSizeBytes: 100,
+			maxEntries:   10,
+			venvs: []venv{
+				{key: "a", sizeBytes: 40, age: time.Minute},
+				{key: "b", sizeBytes: 40, age: 3 * time.Hour},
+				{key: "c", sizeBytes: 40, age: 2 * time.Hour},
+			},
+			want: []string{"a", "c"},
+		},
+		{
+			name:         "in use",
+			maxSizeBytes: 100,
+			maxEntries:   1,
+			venvs: []venv{
+				{key: "a", sizeBytes: 10, age: time.Hour, refs: 1},
+				{key: "b", sizeBytes: 10},
+			},
+			want: []string{"a"},
+		},
+		{
+			name:         "all in use",
+			maxSizeBytes: 10,
+			maxEntries:   1,
+			venvs: []venv{
+				{key: "a", sizeBytes: 50, age: time.Hour, refs: 1},
+				{key: "b", sizeBytes: 50, refs: 2},
+			},
+			want: []string{"a", "b"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &venvCache{
+				dir:          t.TempDir(),
+				maxSizeBytes: tc.maxSizeBytes,
+				maxEntries:   tc.maxEntries,
+				venvs:        make(map[string]*cachedVenv),
+			}
+			for _, v := range tc.venvs {
+				path := filepath.Join(c.dir, v.key)
+				err := os.MkdirAll(filepath.Join(path, "bin"), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(path+venvCompleteMarker, nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.venvs[v.key] = &cachedVenv{
+					path:      path,
+					sizeBytes: v.sizeBytes,
+					lastUsed:  now.Add(-v.age),
+					refs:      v.refs,
+				}
+			}
+
+			c.lock.Lock()
+			c.evict()
+			c.lock.Unlock()
+
+			var got []string
+			for key := range c.venvs {
+				got = append(got, key)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got venvs %v, want %v", got, tc.want)
+			}
+
+			// Unmounting needs root even for venvs that aren't mounted.
+			if os.Geteuid() != 0 {
+				return
+			}
+			for _, v := range tc.venvs {
+				_, cached := c.venvs[v.key]
+				_, err := os.Stat(filepath.Join(c.dir, v.key))
+				if exists := err == nil; exists != cached {
+					t.Errorf("venv %s exists: %v, cached: %v", v.key, exists, cached)
+				}
+				_, err = os.Stat(filepath.Join(c.dir, v.key) + venvCompleteMarker)
+				if exists := err == nil; exists != cached {
+					t.Errorf("marker of venv %s exists: %v, cached: %v", v.key, exists, cached)
+				}
+			}
+		})
+	}
+}
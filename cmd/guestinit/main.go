@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,35 +23,24 @@ import (
 const (
 	ifname = "eth0"
 	ipBin  = "/usr/bin/ip"
-	// Node is already installed on the rootfs. But we do need to add it to the path.
-	paths          = "/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin:/usr/bin/versions/node/v22.11.0/bin"
+	// Node's bin dir is added to this if it's installed on the rootfs.
+	paths          = "/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin"
 	bashBin        = "/bin/bash"
 	serverIpEnvVar = "SERVER_IP"
 	tmpfsSize      = "1024M"
 	nodeServerDir  = "/opt/custom_scripts/node_code_server"
-	codeServerPort = "4030"
+	codeServerPort = 4030
+	cmdServerBin   = "/opt/custom_scripts/chv-lambda-cmdserver"
+	// How long to wait for guest services to be ready before signalling
+	// readiness anyway.
+	serviceStartTimeout = 30 * time.Second
+	// How long the entry point and each service get to exit when the guest
+	// shuts down.
+	stopGracePeriod     = 10 * time.Second
+	readySignalAttempts = 10
+	readySignalInterval = 500 * time.Millisecond
 )
 
-// runCommandInBg runs `cmd` in a goroutine.
-func runCommandInBg(cmd *exec.Cmd, wg *sync.WaitGroup) error {
-	wg.Add(1)
-	go func() {
-		defer func() {
-			log.Infof("END cmd: %v", cmd)
-			wg.Done()
-		}()
-		log.Infof("START cmd: %v", cmd)
-
-		err := cmd.Run()
-		if err != nil {
-			log.WithError(err).Errorf("failed to run cmd: %v err: %v", cmd, err)
-			return
-		}
-		log.Infof("cmd: %v succeeded", cmd)
-	}()
-	return nil
-}
-
 // parseKeyFromCmdLine parses a key from the kernel command line. Assumes each
 // key:val is present like key="val" in /proc/cmdline.
 func parseKeyFromCmdLine(prefix string) (string, error) {
@@ -95,46 +91,160 @@ func parseNetworkingMetadata() (string, string, error) {
 	return guestCIDR, gatewayIP.String(), nil
 }
 
-// startEntryPointInBg starts the entry point in the background.
-func startEntryPointInBg(entryPoint string, wg *sync.WaitGroup) error {
-	// Parse `entryPoint` by splitting on space.
-	parts := strings.Fields(entryPoint)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty entry point")
+// lookupUser returns the credential to run processes as `name`, which is a user
+// name or uid[:gid], and its home directory if it's known.
+func lookupUser(name string) (*syscall.Credential, string, error) {
+	uidStr, gidStr, hasGid := strings.Cut(name, ":")
+	if uid, err := strconv.ParseUint(uidStr, 10, 32); err == nil {
+		credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(uid)}
+		home := "/"
+		if u, err := user.LookupId(uidStr); err == nil {
+			home = u.HomeDir
+			if gid, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+				credential.Gid = uint32(gid)
+			}
+		}
+		if hasGid {
+			gid, err := strconv.ParseUint(gidStr, 10, 32)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid gid: %q: %w", gidStr, err)
+			}
+			credential.Gid = uint32(gid)
+		}
+		return credential, home, nil
 	}
 
-	command := parts[0]
-	args := parts[1:]
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up user: %s: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid uid of user: %s: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid gid of user: %s: %w", name, err)
+	}
 
-	// Create the command.
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIds, err := u.GroupIds()
+	if err == nil {
+		for _, groupId := range groupIds {
+			if group, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(group))
+			}
+		}
+	}
+	return credential, u.HomeDir, nil
+}
 
-	err := runCommandInBg(cmd, wg)
-	if err != nil {
-		return fmt.Errorf("failed to start entry point in bg: %w", err)
+// entryPoint is the running entry point.
+type entryPoint struct {
+	process *os.Process
+	// Receives the exit code of the entry point once it exits.
+	exitCh chan int
+	// The end of its output, which also goes to the console.
+	stdout    *tailBuffer
+	stderr    *tailBuffer
+	startedAt time.Time
+}
+
+// getExitCode returns the exit code of a process that exited with `state`,
+// which is 128 plus the signal for processes killed by a signal like shells
+// report it.
+func getExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
 	}
-	log.Infof("Started entry point command: %s", entryPoint)
-	return nil
+	return state.ExitCode()
 }
 
-func startSshServerInBg(wg *sync.WaitGroup) error {
-	// Needed to start sshd.
-	err := os.MkdirAll("/run/sshd", 0755)
-	if err != nil {
-		return fmt.Errorf("error creating /run/sshd: %w", err)
+// startEntryPoint starts the entry point as described by `config`. Its env and
+// secrets are added to the environment of init.
+func startEntryPoint(config *entryPointConfig) (*entryPoint, error) {
+	cmd := exec.Command(config.Args[0], config.Args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Dir = "/"
+	if config.WorkingDir != "" {
+		cmd.Dir = config.WorkingDir
 	}
+	// So that stopping the entry point stops everything it started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	cmd := exec.Command("/usr/sbin/sshd")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if config.User != "" {
+		credential, home, err := lookupUser(config.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = credential
+		cmd.Env = append(cmd.Env, "HOME="+home, "USER="+config.User)
+	}
 
-	err = runCommandInBg(cmd, wg)
+	for name, value := range config.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	for name, value := range config.Secrets {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	stdout := newTailBuffer(maxResultOutputSize)
+	stderr := newTailBuffer(maxResultOutputSize)
+	cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	cmd.WaitDelay = outputWaitDelay
+
+	err := cmd.Start()
 	if err != nil {
-		return fmt.Errorf("failed to start sshd: %w", err)
+		return nil, fmt.Errorf("failed to start entry point: %w", err)
+	}
+	startedAt := time.Now()
+	// Don't log the environment as it has the secrets.
+	log.Infof("Started entry point command: %q in: %s", config.Args, cmd.Dir)
+
+	exitCh := make(chan int, 1)
+	go func() {
+		err := cmd.Wait()
+		if cmd.ProcessState == nil {
+			log.WithError(err).Error("failed to wait for entry point")
+			exitCh <- -1
+			return
+		}
+		exitCh <- getExitCode(cmd.ProcessState)
+	}()
+	return &entryPoint{
+		process:   cmd.Process,
+		exitCh:    exitCh,
+		stdout:    stdout,
+		stderr:    stderr,
+		startedAt: startedAt,
+	}, nil
+}
+
+// result returns the result of the entry point once it has exited with
+// `exitCode`.
+func (e *entryPoint) result(exitCode int) *entryPointResult {
+	result := &entryPointResult{
+		ExitCode:   exitCode,
+		StartedAt:  e.startedAt,
+		FinishedAt: time.Now(),
+	}
+	result.Stdout, result.StdoutTruncated = e.stdout.contents()
+	result.Stderr, result.StderrTruncated = e.stderr.contents()
+	return result
+}
+
+// stop stops the entry point with SIGTERM, kills it if it's still running
+// after `grace` and returns its exit code.
+func (e *entryPoint) stop(grace time.Duration) int {
+	syscall.Kill(-e.process.Pid, syscall.SIGTERM)
+	select {
+	case exitCode := <-e.exitCh:
+		return exitCode
+	case <-time.After(grace):
+		log.Warnf("entry point didn't stop within %v, killing it", grace)
+		syscall.Kill(-e.process.Pid, syscall.SIGKILL)
+		return <-e.exitCh
 	}
-	return nil
 }
 
 func mount(source, target, fsType string, flags uintptr, data ...string) error {
@@ -196,43 +306,61 @@ func setupNetworking(guestCIDR string, gatewayIP string) error {
 	return nil
 }
 
-func remountRootAsReadOnly() error {
-	cmd := exec.Command("mount", "-o", "remount,ro", "/")
-	return cmd.Run()
+// setGuestToken authenticates `req` to the guest API with `guestToken`.
+func setGuestToken(req *http.Request, guestToken string) {
+	req.Header.Set("Authorization", "Bearer "+guestToken)
 }
 
-func startNodeServerInBg(wg *sync.WaitGroup) error {
-	cmd := exec.Command("npm", "run", "dev", "--", "--host", "0.0.0.0")
-	cmd.Dir = nodeServerDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// postToHost posts `body` to `path` of the guest API.
+func postToHost(gatewayIP string, guestApiPort string, guestToken string, path string, body any) error {
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(gatewayIP, guestApiPort), path)
+	client := &http.Client{Timeout: 2 * time.Second}
 
-	// We need "npm" and other node things in the path.
-	currentPath := os.Getenv("PATH")
-	combinedPath := currentPath + ":" + paths
-	cmd.Env = append(os.Environ(), "PATH="+combinedPath)
-	err := runCommandInBg(cmd, wg)
-	if err != nil {
-		return fmt.Errorf("failed to start node server in bg: %w", err)
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
 	}
-	return nil
-}
 
-func startCodeServerInBg(wg *sync.WaitGroup) error {
-	cmd := exec.Command("/opt/custom_scripts/chv-lambda-codeserver")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := runCommandInBg(cmd, wg)
-	if err != nil {
-		return fmt.Errorf("failed to start code server in bg: %w", err)
+	var err error
+	for i := 0; i < readySignalAttempts; i++ {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setGuestToken(req, guestToken)
+
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("bad status: %s", resp.Status)
+		}
+		time.Sleep(readySignalInterval)
 	}
-	return nil
+	return fmt.Errorf("failed to post to: %s: %w", url, err)
 }
 
-func main() {
-	log.Infof("starting guestinit")
+// signalReadyToHost tells the host that the guest's services are up.
+func signalReadyToHost(gatewayIP string, guestApiPort string, guestToken string) error {
+	return postToHost(gatewayIP, guestApiPort, guestToken, "/v1/ready", nil)
+}
 
-	// Setup essential mounts.
+// reportExitToHost tells the host that the entry point exited with `result`.
+func reportExitToHost(gatewayIP string, guestApiPort string, guestToken string, result *entryPointResult) error {
+	return postToHost(gatewayIP, guestApiPort, guestToken, "/v1/exit", result)
+}
+
+// setupMounts mounts the essential filesystems.
+func setupMounts() {
 	err := mount("none", "/proc", "proc", 0)
 	if err != nil {
 		log.WithError(err).Fatalf("Error mounting proc")
@@ -257,8 +385,37 @@ func main() {
 	if err != nil {
 		log.WithError(err).Fatalf("Error mounting cgroup")
 	}
+}
+
+func main() {
+	log.Infof("starting guestinit")
 
-	err = os.Setenv("PATH", paths)
+	// The child of PID 1 shares its mounts.
+	if os.Getenv(childEnvVar) == "" {
+		setupMounts()
+	} else {
+		// Not passed on to the processes it starts.
+		os.Unsetenv(childEnvVar)
+	}
+	if os.Getpid() == 1 {
+		runAsInit()
+	}
+	os.Exit(runGuest())
+}
+
+// runGuest sets up the guest, starts the entry point and services and stops
+// them again in order once the entry point exits or guestinit is asked to shut
+// down. Returns the exit code of the entry point, if any.
+func runGuest() int {
+	// Registered early so that a shutdown requested while booting isn't lost.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	path := paths
+	if nodeBinDir := findNodeBinDir(); nodeBinDir != "" {
+		path += ":" + nodeBinDir
+	}
+	err := os.Setenv("PATH", path)
 	if err != nil {
 		log.WithError(err).Fatalf("Error setting PATH")
 	}
@@ -286,46 +443,94 @@ func main() {
 		log.WithError(err).Fatal("failed to setup networking")
 	}
 
+	guestApiPort, err := parseKeyFromCmdLine("guest_api_port")
+	if err != nil {
+		log.WithError(err).Fatal("failed to parse guest api port")
+	}
+	guestToken, err := parseKeyFromCmdLine("guest_token")
+	if err != nil {
+		log.WithError(err).Fatal("failed to parse guest token")
+	}
+
+	vmMetadata, err := fetchMetadata(gatewayIP, guestApiPort, guestToken)
+	if err != nil {
+		log.WithError(err).Fatal("failed to get metadata")
+	}
+	err = ackSecrets(gatewayIP, guestApiPort, guestToken)
+	if err != nil {
+		log.WithError(err).Error("failed to acknowledge secrets to the host")
+	}
+	applyMetadata(vmMetadata, guestCIDR)
+
+	// Empty if the VM has no config drive.
+	configDrive, err := parseKeyFromCmdLine("config_drive")
+	if err != nil {
+		log.WithError(err).Fatal("failed to parse config drive")
+	}
+	// Applied before any services start so that they can rely on its files
+	// and users.
+	userData, instanceID := getUserData(configDrive, vmMetadata)
+	if userData != "" {
+		applyUserData(userData, instanceID)
+	}
+
 	var wg sync.WaitGroup
 	// Start the entry point command optionally specified by the user.
-	entryPoint, err := parseKeyFromCmdLine("entry_point")
-	entryPointSet := false
-	if err == nil && entryPoint != "" {
-		err := startEntryPointInBg(entryPoint, &wg)
+	var entry *entryPoint
+	if vmMetadata.EntryPoint != nil && len(vmMetadata.EntryPoint.Args) > 0 {
+		entry, err = startEntryPoint(vmMetadata.EntryPoint)
 		if err != nil {
 			log.WithError(err).Fatal("failed to start entry point")
 		}
-		entryPointSet = true
 	}
 
-	// Start the ssh server so that the user can log in to the VM for debugging.
-	err = startSshServerInBg(&wg)
+	// Needed to start sshd.
+	err = os.MkdirAll("/run/sshd", 0755)
 	if err != nil {
-		log.WithError(err).Fatal("failed to start ssh server")
+		log.WithError(err).Error("failed to create /run/sshd")
 	}
 
-	// This will expose a REST API to execute Python and TS code.
-	err = startCodeServerInBg(&wg)
+	services := newSupervisor(getServices(vmMetadata.DisabledServices))
+	services.start(&wg)
+
+	err = services.waitForReady(serviceStartTimeout)
 	if err != nil {
-		log.WithError(err).Fatal("failed to start code server")
+		log.WithError(err).Warn("services aren't ready, signalling readiness anyway")
 	}
 
-	// This is a React project that is used by the code server to render UI components.
-	err = startNodeServerInBg(&wg)
+	err = signalReadyToHost(gatewayIP, guestApiPort, guestToken)
 	if err != nil {
-		log.WithError(err).Fatal("failed to start node server")
+		log.WithError(err).Error("failed to signal readiness to the host")
+	} else {
+		log.Info("signalled readiness to the host")
+	}
+
+	// The guest shuts down once the entry point exits. Without one it's a long
+	// running VM that only shuts down when asked to.
+	exitCode := 0
+	if entry != nil {
+		select {
+		case exitCode = <-entry.exitCh:
+			log.Infof("entry point exited with code: %d", exitCode)
+			// Only reported if it exited on its own, stopping the VM isn't
+			// the entry point failing.
+			err = reportExitToHost(gatewayIP, guestApiPort, guestToken, entry.result(exitCode))
+			if err != nil {
+				log.WithError(err).Error("failed to report the entry point's exit to the host")
+			}
+		case sig := <-stop:
+			log.Infof("received: %v, stopping the entry point", sig)
+			exitCode = entry.stop(stopGracePeriod)
+		}
+	} else {
+		log.Info("waiting for signal...")
+		sig := <-stop
+		log.Infof("received: %v", sig)
 	}
 
-	log.Info("reaping processes...")
+	log.Info("stopping services...")
+	services.stop(stopGracePeriod)
 	wg.Wait()
-
-	// If no entry point is set we treat this as a long running VM and ensure init doesn't exit.
-	if !entryPointSet {
-		stop := make(chan os.Signal, 1)
-		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-		log.Info("waiting for signal...")
-		<-stop
-
-	}
 	log.Info("guestinit exiting...")
+	return exitCode
 }
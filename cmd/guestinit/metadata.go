@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metadata is what the host's metadata service serves to the guest.
+type metadata struct {
+	VMName     string            `json:"vmName"`
+	Hostname   string            `json:"hostname"`
+	Network    networkMetadata   `json:"network"`
+	EntryPoint *entryPointConfig `json:"entryPoint,omitempty"`
+	SSHKeys    []string          `json:"sshKeys,omitempty"`
+	UserData   string            `json:"userData,omitempty"`
+	// Names of guest services not to start.
+	DisabledServices []string `json:"disabledServices,omitempty"`
+}
+
+type networkMetadata struct {
+	// CIDR of the guest.
+	Address     string   `json:"address"`
+	Gateway     string   `json:"gateway"`
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// entryPointConfig is how the host asks for the entry point to be started.
+type entryPointConfig struct {
+	Args []string          `json:"args,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+	// Added to the environment like `Env`. They're only handed out once per
+	// boot.
+	Secrets    map[string]string `json:"secrets,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	// Name or uid[:gid].
+	User string `json:"user,omitempty"`
+}
+
+// fetchMetadata fetches the metadata of the guest from the host. The host
+// identifies the VM by `guestToken` and the source IP of the request.
+func fetchMetadata(gatewayIP string, guestApiPort string, guestToken string) (*metadata, error) {
+	url := fmt.Sprintf("http://%s/v1/metadata", net.JoinHostPort(gatewayIP, guestApiPort))
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	setGuestToken(req, guestToken)
+
+	for i := 0; i < readySignalAttempts; i++ {
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			var result metadata
+			if resp.StatusCode < 300 {
+				err = json.NewDecoder(resp.Body).Decode(&result)
+			} else {
+				err = fmt.Errorf("bad status: %s", resp.Status)
+			}
+			resp.Body.Close()
+			if err == nil {
+				return &result, nil
+			}
+		}
+		time.Sleep(readySignalInterval)
+	}
+	return nil, fmt.Errorf("failed to fetch metadata from: %s: %w", url, err)
+}
+
+// ackSecrets tells the host that the guest has received its metadata, after
+// which the host stops handing out the secrets of the entry point. Until then
+// a metadata response that got lost is simply fetched again.
+func ackSecrets(gatewayIP string, guestApiPort string, guestToken string) error {
+	return postToHost(gatewayIP, guestApiPort, guestToken, "/v1/secrets/ack", nil)
+}
+
+func setHostname(hostname string) error {
+	err := syscall.Sethostname([]byte(hostname))
+	if err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+
+	err = os.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write /etc/hostname: %w", err)
+	}
+
+	hosts, err := os.ReadFile("/etc/hosts")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read /etc/hosts: %w", err)
+	}
+	entry := "127.0.1.1 " + hostname
+	if strings.Contains(string(hosts), entry+"\n") {
+		return nil
+	}
+	f, err := os.OpenFile("/etc/hosts", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open /etc/hosts: %w", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry + "\n")
+	return err
+}
+
+func writeResolvConf(nameservers []string) error {
+	var b strings.Builder
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", nameserver)
+	}
+	// /etc/resolv.conf is often a symlink into a dir that doesn't exist this
+	// early.
+	os.Remove("/etc/resolv.conf")
+	return os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0644)
+}
+
+// authorizeSSHKeys adds `keys` to the authorized keys of `username`, keeping
+// the ones baked into the rootfs.
+func authorizeSSHKeys(username string, keys []string) error {
+	credential, home, err := lookupUser(username)
+	if err != nil {
+		return err
+	}
+	sshDir := filepath.Join(home, ".ssh")
+	authorizedKeysPath := filepath.Join(sshDir, "authorized_keys")
+
+	err = os.MkdirAll(sshDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create .ssh dir: %w", err)
+	}
+
+	existing, err := os.ReadFile(authorizedKeysPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read authorized keys: %w", err)
+	}
+
+	content := string(existing)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	for _, key := range keys {
+		if !strings.Contains(content, key+"\n") {
+			content += key + "\n"
+		}
+	}
+	err = os.WriteFile(authorizedKeysPath, []byte(content), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write authorized keys: %w", err)
+	}
+
+	// sshd refuses keys of files that aren't owned by the user.
+	for _, p := range []string{sshDir, authorizedKeysPath} {
+		err = os.Chown(p, int(credential.Uid), int(credential.Gid))
+		if err != nil {
+			return fmt.Errorf("failed to chown: %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// applyMetadata configures the guest with `m`. The entry point is started and
+// the user data is applied separately. Failures are logged rather than fatal so that the guest still
+// comes up and can be debugged.
+func applyMetadata(m *metadata, guestCIDR string) {
+	if m.Network.Address != "" && m.Network.Address != guestCIDR {
+		log.Warnf("metadata address: %s doesn't match the kernel command line: %s", m.Network.Address, guestCIDR)
+	}
+
+	if m.Hostname != "" {
+		err := setHostname(m.Hostname)
+		if err != nil {
+			log.WithError(err).Error("failed to set hostname")
+		}
+	}
+
+	if len(m.Network.Nameservers) > 0 {
+		err := writeResolvConf(m.Network.Nameservers)
+		if err != nil {
+			log.WithError(err).Error("failed to write resolv.conf")
+		}
+	}
+
+	if len(m.SSHKeys) > 0 {
+		err := authorizeSSHKeys("root", m.SSHKeys)
+		if err != nil {
+			log.WithError(err).Error("failed to authorize ssh keys")
+		}
+	}
+}
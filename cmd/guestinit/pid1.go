@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Set in the environment of the guestinit that PID 1 runs as its child.
+	childEnvVar = "GUESTINIT_CHILD"
+	// How long processes left over at shutdown get to exit after SIGTERM
+	// before they're killed.
+	shutdownGracePeriod = 5 * time.Second
+
+	// From linux/input-event-codes.h.
+	evKey    = 0x01
+	keyPower = 116
+)
+
+// inputEvent is `struct input_event` of linux/input.h on 64-bit platforms.
+type inputEvent struct {
+	Sec   int64
+	Usec  int64
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// findPowerButton returns the input device of the ACPI power button, if the
+// guest has one.
+func findPowerButton() (string, error) {
+	names, err := filepath.Glob("/sys/class/input/event*/device/name")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(content)) == "Power Button" {
+			event := filepath.Base(filepath.Dir(filepath.Dir(name)))
+			return filepath.Join("/dev/input", event), nil
+		}
+	}
+	return "", errors.New("no power button found")
+}
+
+// watchPowerButton sends on `pressed` every time the power button is pressed.
+func watchPowerButton(pressed chan<- struct{}) {
+	device, err := findPowerButton()
+	if err != nil {
+		log.WithError(err).Warn("not watching the power button")
+		return
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		log.WithError(err).Warnf("failed to open power button: %s", device)
+		return
+	}
+	defer f.Close()
+
+	log.Infof("watching power button: %s", device)
+	for {
+		var event inputEvent
+		err := binary.Read(f, binary.NativeEndian, &event)
+		if err != nil {
+			log.WithError(err).Warn("failed to read power button events")
+			return
+		}
+		if event.Type == evKey && event.Code == keyPower && event.Value == 1 {
+			log.Info("power button pressed")
+			pressed <- struct{}{}
+		}
+	}
+}
+
+// reapChildren reaps every exited child. Returns the wait status of `pid` if
+// it was one of them.
+func reapChildren(pid int) (syscall.WaitStatus, bool) {
+	var result syscall.WaitStatus
+	found := false
+	for {
+		var status syscall.WaitStatus
+		reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err != nil || reaped <= 0 {
+			return result, found
+		}
+		if reaped == pid {
+			result = status
+			found = true
+		}
+	}
+}
+
+// killAll signals every process but PID 1 and waits for them to exit, killing
+// the ones that are still around after `shutdownGracePeriod`.
+func killAll() {
+	syscall.Kill(-1, syscall.SIGTERM)
+	deadline := time.Now().Add(shutdownGracePeriod)
+	for time.Now().Before(deadline) {
+		reapChildren(0)
+		// ECHILD means that there's nothing left to wait for.
+		_, err := syscall.Wait4(-1, nil, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.ECHILD) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Warn("killing processes that didn't exit")
+	syscall.Kill(-1, syscall.SIGKILL)
+	time.Sleep(100 * time.Millisecond)
+	reapChildren(0)
+}
+
+func remountRootAsReadOnly() error {
+	cmd := exec.Command("mount", "-o", "remount,ro", "/")
+	return cmd.Run()
+}
+
+// powerOff syncs filesystems and powers off the guest, which makes the VMM
+// exit. The root filesystem is remounted read-only first so that it's clean
+// on the next boot. Must be called once every other process is gone.
+func powerOff() {
+	log.Info("powering off")
+	syscall.Sync()
+	err := remountRootAsReadOnly()
+	if err != nil {
+		log.WithError(err).Warn("failed to remount root read-only")
+	}
+	err = syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	// Returning from PID 1 panics the kernel, so wait for the power off.
+	log.WithError(err).Error("failed to power off")
+	for {
+		time.Sleep(time.Hour)
+	}
+}
+
+// runAsInit runs guestinit as PID 1. It starts guestinit again as its child to
+// do the actual work and only reaps orphans, forwards signals to the child and
+// turns power button presses into a SIGTERM of the child. The guest is powered
+// off once the child exits. Never returns.
+func runAsInit() {
+	// Have Ctrl-Alt-Del send SIGINT to PID 1 instead of rebooting right away.
+	err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_CAD_OFF)
+	if err != nil {
+		log.WithError(err).Warn("failed to disable Ctrl-Alt-Del")
+	}
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	child := exec.Command("/proc/self/exe", os.Args[1:]...)
+	child.Env = append(os.Environ(), childEnvVar+"=1")
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	err = child.Start()
+	if err != nil {
+		log.WithError(err).Error("failed to start guestinit")
+		killAll()
+		powerOff()
+	}
+	log.Infof("started guestinit: %d", child.Process.Pid)
+
+	powerButton := make(chan struct{}, 1)
+	go watchPowerButton(powerButton)
+
+	// SIGCHLDs can be coalesced or dropped if `signals` is full, so children
+	// are reaped periodically too.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-powerButton:
+			child.Process.Signal(syscall.SIGTERM)
+			continue
+
+		case sig := <-signals:
+			if sig != syscall.SIGCHLD {
+				// Ctrl-Alt-Del, which is SIGINT, shuts down the guest like
+				// the power button does.
+				if sig == syscall.SIGINT {
+					sig = syscall.SIGTERM
+				}
+				child.Process.Signal(sig)
+				continue
+			}
+
+		case <-ticker.C:
+		}
+
+		status, exited := reapChildren(child.Process.Pid)
+		if !exited {
+			continue
+		}
+		log.Infof("guestinit exited with status: %d", status.ExitStatus())
+		killAll()
+		powerOff()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Only the end of the entry point's output up to this size per stream is
+	// reported to the host.
+	maxResultOutputSize = 64 * 1024
+	// How long to wait for the entry point's output after it exits, in case
+	// processes it started in the background still hold its stdout or stderr.
+	outputWaitDelay = time.Second
+)
+
+// entryPointResult is reported to the host once the entry point exits.
+type entryPointResult struct {
+	ExitCode        int       `json:"exitCode"`
+	Stdout          string    `json:"stdout,omitempty"`
+	StdoutTruncated bool      `json:"stdoutTruncated,omitempty"`
+	Stderr          string    `json:"stderr,omitempty"`
+	StderrTruncated bool      `json:"stderrTruncated,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+}
+
+// tailBuffer keeps the last `size` bytes written to it.
+type tailBuffer struct {
+	lock      sync.Mutex
+	size      int
+	data      []byte
+	truncated bool
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.data = append(b.data, p...)
+	if excess := len(b.data) - b.size; excess > 0 {
+		b.data = append(b.data[:0], b.data[excess:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// contents returns what's kept and whether anything was dropped.
+func (b *tailBuffer) contents() (string, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return string(b.data), b.truncated
+}
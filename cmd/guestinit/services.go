@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Services are read from this file on the rootfs if it exists, otherwise
+	// `defaultServices` are started.
+	servicesManifestPath = "/etc/chv/services.yaml"
+
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+
+	// Backoff between restarts of a crashed service.
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// A service that ran for this long is considered healthy again and its
+	// backoff is reset.
+	restartBackoffResetAfter = time.Minute
+	probeInterval            = 100 * time.Millisecond
+	probeTimeout             = time.Second
+)
+
+// servicesManifest lists the services guestinit supervises.
+type servicesManifest struct {
+	Services []serviceSpec `yaml:"services"`
+}
+
+type serviceSpec struct {
+	Name string `yaml:"name"`
+	// Command and its arguments.
+	Command []string `yaml:"command"`
+	// Added to the environment of guestinit. Values can refer to it e.g.
+	// "$PATH:/opt/bin".
+	Env        map[string]string `yaml:"env,omitempty"`
+	WorkingDir string            `yaml:"workingDir,omitempty"`
+	// Names of services that have to be ready before this one starts.
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+	// always, on-failure or never. Defaults to always.
+	Restart   string          `yaml:"restart,omitempty"`
+	Readiness *readinessProbe `yaml:"readiness,omitempty"`
+	// Skipped if its command isn't installed.
+	Optional bool `yaml:"optional,omitempty"`
+	Disabled bool `yaml:"disabled,omitempty"`
+}
+
+// readinessProbe tells when a service is ready. Exactly one of its fields is
+// set. Services without one are ready once started.
+type readinessProbe struct {
+	// Ready once something listens on this port.
+	TCPPort int `yaml:"tcpPort,omitempty"`
+	// Ready once a GET of this URL on localhost succeeds.
+	HTTPGet *httpProbe `yaml:"httpGet,omitempty"`
+	// Ready once this command succeeds.
+	Exec []string `yaml:"exec,omitempty"`
+}
+
+type httpProbe struct {
+	Port int    `yaml:"port"`
+	Path string `yaml:"path,omitempty"`
+}
+
+// defaultServices are started when the rootfs doesn't have a manifest.
+func defaultServices() []serviceSpec {
+	return []serviceSpec{
+		{
+			// So that the user can log in to the VM for debugging.
+			Name:    "sshd",
+			Command: []string{"/usr/sbin/sshd", "-D", "-e"},
+		},
+		{
+			// Exposes a REST API to execute Python and TS code.
+			Name:      "codeserver",
+			Command:   []string{"/opt/custom_scripts/chv-lambda-codeserver"},
+			Readiness: &readinessProbe{TCPPort: codeServerPort},
+		},
+		{
+			// Exposes a REST API to run commands.
+			Name:     "cmdserver",
+			Command:  []string{cmdServerBin},
+			Optional: true,
+		},
+		{
+			// A React project that is used by the code server to render UI
+			// components.
+			Name:       "node-server",
+			Command:    []string{"npm", "run", "dev", "--", "--host", "0.0.0.0"},
+			WorkingDir: nodeServerDir,
+		},
+	}
+}
+
+// readServicesManifest returns the services in the manifest on the rootfs, or
+// `defaultServices` if there's none.
+func readServicesManifest() ([]serviceSpec, error) {
+	content, err := os.ReadFile(servicesManifestPath)
+	if os.IsNotExist(err) {
+		return defaultServices(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read: %s: %w", servicesManifestPath, err)
+	}
+
+	var manifest servicesManifest
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %s: %w", servicesManifestPath, err)
+	}
+	return manifest.Services, nil
+}
+
+// enabledServices returns `services` without the disabled ones and the ones
+// named in `disabled`. Dependencies on them are dropped.
+func enabledServices(services []serviceSpec, disabled []string) []serviceSpec {
+	isDisabled := func(service serviceSpec) bool {
+		return service.Disabled || slices.Contains(disabled, service.Name)
+	}
+
+	disabledNames := make(map[string]bool)
+	for _, service := range services {
+		if isDisabled(service) {
+			log.Infof("service: %s is disabled", service.Name)
+			disabledNames[service.Name] = true
+		}
+	}
+
+	var enabled []serviceSpec
+	for _, service := range services {
+		if disabledNames[service.Name] {
+			continue
+		}
+		service.DependsOn = slices.DeleteFunc(slices.Clone(service.DependsOn), func(dep string) bool {
+			if disabledNames[dep] {
+				log.Warnf("service: %s depends on disabled service: %s, starting it anyway", service.Name, dep)
+				return true
+			}
+			return false
+		})
+		enabled = append(enabled, service)
+	}
+	return enabled
+}
+
+// getServices returns the services to supervise, except for the ones named in
+// `disabled`. Falls back to the default services if the manifest is invalid so
+// that the guest can still be debugged.
+func getServices(disabled []string) []serviceSpec {
+	services, err := readServicesManifest()
+	if err == nil {
+		services = enabledServices(services, disabled)
+		err = validateServices(services)
+	}
+	if err != nil {
+		log.WithError(err).Error("invalid services manifest, starting the default services")
+		services = enabledServices(defaultServices(), disabled)
+	}
+	return services
+}
+
+func validateServices(services []serviceSpec) error {
+	names := make(map[string]bool)
+	for _, service := range services {
+		if service.Name == "" {
+			return errors.New("service without a name")
+		}
+		if names[service.Name] {
+			return fmt.Errorf("duplicate service: %s", service.Name)
+		}
+		names[service.Name] = true
+
+		if len(service.Command) == 0 {
+			return fmt.Errorf("service: %s has no command", service.Name)
+		}
+		switch service.Restart {
+		case "", restartAlways, restartOnFailure, restartNever:
+		default:
+			return fmt.Errorf("service: %s has an invalid restart policy: %q", service.Name, service.Restart)
+		}
+		if probe := service.Readiness; probe != nil {
+			set := 0
+			for _, isSet := range []bool{probe.TCPPort > 0, probe.HTTPGet != nil, len(probe.Exec) > 0} {
+				if isSet {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("service: %s needs exactly one readiness probe", service.Name)
+			}
+		}
+	}
+
+	for _, service := range services {
+		for _, dep := range service.DependsOn {
+			if !names[dep] {
+				return fmt.Errorf("service: %s depends on unknown service: %s", service.Name, dep)
+			}
+		}
+	}
+	return checkDependencyCycles(services)
+}
+
+// checkDependencyCycles returns an error if services depend on each other in a
+// cycle, in which case none of them would start.
+func checkDependencyCycles(services []serviceSpec) error {
+	deps := make(map[string][]string)
+	for _, service := range services {
+		deps[service.Name] = service.DependsOn
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("services depend on each other in a cycle: %s", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, service := range services {
+		err := visit(service.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceEnv returns the environment of a service with `env`.
+func serviceEnv(env map[string]string) []string {
+	result := os.Environ()
+	for name, value := range env {
+		result = append(result, name+"="+os.ExpandEnv(value))
+	}
+	return result
+}
+
+// probe returns whether the service probed by `p` is ready.
+func (p *readinessProbe) probe() bool {
+	switch {
+	case p.TCPPort > 0:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p.TCPPort)), probeTimeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case p.HTTPGet != nil:
+		client := &http.Client{Timeout: probeTimeout}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", net.JoinHostPort("127.0.0.1", strconv.Itoa(p.HTTPGet.Port)), p.HTTPGet.Path))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 400
+	case len(p.Exec) > 0:
+		return exec.Command(p.Exec[0], p.Exec[1:]...).Run() == nil
+	default:
+		return true
+	}
+}
+
+// supervisedService is a service and its state.
+type supervisedService struct {
+	spec serviceSpec
+	// Closed once the service is ready the first time.
+	readyCh   chan struct{}
+	readyOnce sync.Once
+
+	// Protects the fields below.
+	lock sync.Mutex
+	// The current run of the service, nil if it isn't running.
+	process *os.Process
+	// Closed once the current run exits.
+	exitedCh chan struct{}
+}
+
+func (s *supervisedService) markReady() {
+	s.readyOnce.Do(func() {
+		log.Infof("service: %s is ready", s.spec.Name)
+		close(s.readyCh)
+	})
+}
+
+// stop stops the current run of the service with SIGTERM and kills it if it's
+// still running after `grace`. Its whole process group is signalled so that
+// processes it started are stopped too.
+func (s *supervisedService) stop(grace time.Duration) {
+	s.lock.Lock()
+	process := s.process
+	exitedCh := s.exitedCh
+	s.lock.Unlock()
+	if process == nil {
+		return
+	}
+
+	logger := log.WithField("service", s.spec.Name)
+	logger.Info("stopping service")
+	syscall.Kill(-process.Pid, syscall.SIGTERM)
+	select {
+	case <-exitedCh:
+	case <-time.After(grace):
+		logger.Warnf("service didn't stop within %v, killing it", grace)
+		syscall.Kill(-process.Pid, syscall.SIGKILL)
+		<-exitedCh
+	}
+}
+
+// supervisor starts services in the order of their dependencies and restarts
+// them as per their restart policy.
+type supervisor struct {
+	services map[string]*supervisedService
+	// In the order of the manifest.
+	order []string
+	// Closed once services are being stopped, after which they aren't
+	// restarted.
+	stopCh chan struct{}
+}
+
+func newSupervisor(specs []serviceSpec) *supervisor {
+	s := &supervisor{
+		services: make(map[string]*supervisedService),
+		stopCh:   make(chan struct{}),
+	}
+	for _, spec := range specs {
+		s.services[spec.Name] = &supervisedService{spec: spec, readyCh: make(chan struct{})}
+		s.order = append(s.order, spec.Name)
+	}
+	return s
+}
+
+// start starts supervising all services in the background. `wg` is done once
+// none of them will be restarted anymore.
+func (s *supervisor) start(wg *sync.WaitGroup) {
+	for _, name := range s.order {
+		service := s.services[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, dep := range service.spec.DependsOn {
+				select {
+				case <-s.services[dep].readyCh:
+				case <-s.stopCh:
+					return
+				}
+			}
+			s.run(service)
+		}()
+	}
+}
+
+// waitForReady waits till all services are ready or `timeout` expires.
+func (s *supervisor) waitForReady(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for _, name := range s.order {
+		select {
+		case <-s.services[name].readyCh:
+		case <-deadline:
+			return fmt.Errorf("service: %s isn't ready after %v", name, timeout)
+		}
+	}
+	return nil
+}
+
+// startOrder returns the names of the services with every service after the
+// ones it depends on.
+func (s *supervisor) startOrder() []string {
+	var order []string
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, dep := range s.services[name].spec.DependsOn {
+			visit(dep)
+		}
+		order = append(order, name)
+	}
+	for _, name := range s.order {
+		visit(name)
+	}
+	return order
+}
+
+// stop stops all services, the ones depending on others first, giving each
+// `grace` to exit.
+func (s *supervisor) stop(grace time.Duration) {
+	close(s.stopCh)
+	order := s.startOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		s.services[order[i]].stop(grace)
+	}
+}
+
+func (s *supervisor) stopping() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// run runs `service` till its restart policy says to stop or the supervisor is
+// stopped.
+func (s *supervisor) run(service *supervisedService) {
+	spec := service.spec
+	logger := log.WithField("service", spec.Name)
+
+	if spec.Optional {
+		if _, err := exec.LookPath(spec.Command[0]); err != nil {
+			logger.Info("optional service isn't installed, not starting it")
+			// Don't block services depending on it.
+			service.markReady()
+			return
+		}
+	}
+
+	backoff := minRestartBackoff
+	for {
+		cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+		cmd.Dir = spec.WorkingDir
+		cmd.Env = serviceEnv(spec.Env)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		// So that stopping the service stops everything it started.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		started := time.Now()
+		logger.Infof("START service: %v", spec.Command)
+		// Checked under the lock so that `stop` either sees the process or
+		// it's never started.
+		service.lock.Lock()
+		if s.stopping() {
+			service.lock.Unlock()
+			return
+		}
+		err := cmd.Start()
+		exitedCh := make(chan struct{})
+		if err == nil {
+			service.process = cmd.Process
+			service.exitedCh = exitedCh
+		}
+		service.lock.Unlock()
+
+		if err == nil {
+			go s.probeUntilReady(service, exitedCh)
+			err = cmd.Wait()
+			service.lock.Lock()
+			service.process = nil
+			service.lock.Unlock()
+			close(exitedCh)
+		}
+
+		if s.stopping() {
+			logger.Info("service stopped")
+			return
+		}
+		if err != nil {
+			logger.WithError(err).Error("service failed")
+		} else {
+			logger.Info("service exited")
+		}
+
+		restart := spec.Restart
+		if restart == "" {
+			restart = restartAlways
+		}
+		if restart == restartNever || (restart == restartOnFailure && err == nil) {
+			// Don't block services depending on it forever.
+			service.markReady()
+			return
+		}
+
+		if time.Since(started) > restartBackoffResetAfter {
+			backoff = minRestartBackoff
+		}
+		logger.Infof("restarting service in %v", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.stopCh:
+			return
+		}
+		backoff = min(backoff*2, maxRestartBackoff)
+	}
+}
+
+// probeUntilReady marks `service` ready once its readiness probe succeeds or
+// gives up when `exited` is closed.
+func (s *supervisor) probeUntilReady(service *supervisedService, exited <-chan struct{}) {
+	probe := service.spec.Readiness
+	if probe == nil {
+		service.markReady()
+		return
+	}
+
+	for {
+		select {
+		case <-service.readyCh:
+			return
+		case <-exited:
+			return
+		default:
+		}
+		if probe.probe() {
+			service.markReady()
+			return
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// findNodeBinDir returns the bin dir of node installed on the rootfs, if any.
+// If there are several versions the last one in lexical order is used.
+func findNodeBinDir() string {
+	dirs, err := filepath.Glob("/usr/bin/versions/node/*/bin")
+	if err != nil || len(dirs) == 0 {
+		return ""
+	}
+	return dirs[len(dirs)-1]
+}
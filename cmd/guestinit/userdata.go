@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/cloudconfig"
+)
+
+const (
+	// Where the config drive is mounted while it's read.
+	configDriveMountPath = "/run/chv/config-drive"
+	// Where the user data is saved for processes in the guest.
+	userDataPath = "/run/chv/user-data"
+	// Markers of the run-once steps that already ran, per instance.
+	instancesDir = "/var/lib/chv/instances"
+	// How long a user data script or command may run.
+	userDataTimeout = 5 * time.Minute
+)
+
+// configDrive is the content of a config drive.
+type configDrive struct {
+	metaData cloudconfig.MetaData
+	userData string
+}
+
+// readConfigDrive mounts the config drive at `device`, reads it and unmounts it.
+func readConfigDrive(device string) (*configDrive, error) {
+	err := mount(device, configDriveMountPath, "iso9660", syscall.MS_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := syscall.Unmount(configDriveMountPath, 0)
+		if err != nil {
+			log.WithError(err).Warn("failed to unmount config drive")
+		}
+	}()
+
+	metaData, err := os.ReadFile(filepath.Join(configDriveMountPath, cloudconfig.MetaDataFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta data: %w", err)
+	}
+	drive := &configDrive{}
+	err = yaml.Unmarshal(metaData, &drive.metaData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse meta data: %w", err)
+	}
+
+	userData, err := os.ReadFile(filepath.Join(configDriveMountPath, cloudconfig.UserDataFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read user data: %w", err)
+	}
+	drive.userData = string(userData)
+	return drive, nil
+}
+
+// runOnce runs `step` unless it already succeeded for instance `instanceID`.
+func runOnce(instanceID string, name string, step func() error) error {
+	marker := filepath.Join(instancesDir, instanceID, name)
+	if _, err := os.Stat(marker); err == nil {
+		log.Infof("%s already ran for instance: %s", name, instanceID)
+		return nil
+	}
+
+	err := step()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(marker), 0700)
+	if err == nil {
+		err = os.WriteFile(marker, nil, 0600)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("failed to record that %s ran, it will run again on the next boot", name)
+	}
+	return nil
+}
+
+// runWithTimeout runs `args` and waits for at most `userDataTimeout`.
+func runWithTimeout(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = "/"
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start: %v: %w", args, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("%v failed: %w", args, err)
+		}
+		return nil
+	case <-time.After(userDataTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("%v didn't finish within %v", args, userDataTimeout)
+	}
+}
+
+// runCommands runs `commands` in order, stopping at the first failure.
+func runCommands(commands []cloudconfig.Command) error {
+	for _, command := range commands {
+		log.Infof("running: %s", command)
+		err := runWithTimeout(command.Args)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createUser creates `u` if it doesn't exist yet and authorizes its keys.
+func createUser(u cloudconfig.User) error {
+	_, err := user.Lookup(u.Name)
+	var unknownUser user.UnknownUserError
+	switch {
+	case errors.As(err, &unknownUser):
+		args := []string{"useradd", "--create-home"}
+		if u.Shell != "" {
+			args = append(args, "--shell", u.Shell)
+		}
+		if len(u.Groups) > 0 {
+			args = append(args, "--groups", strings.Join(u.Groups, ","))
+		}
+		output, err := exec.Command(args[0], append(args[1:], u.Name)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to create user: %s: %s: %w", u.Name, output, err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to look up user: %s: %w", u.Name, err)
+	case len(u.Groups) > 0:
+		output, err := exec.Command("usermod", "--append", "--groups", strings.Join(u.Groups, ","), u.Name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to add user: %s to groups: %s: %w", u.Name, output, err)
+		}
+	}
+
+	if len(u.SSHAuthorizedKeys) > 0 {
+		return authorizeSSHKeys(u.Name, u.SSHAuthorizedKeys)
+	}
+	return nil
+}
+
+// writeFile writes `f` into the guest.
+func writeFile(f cloudconfig.File) error {
+	content, err := f.Decode()
+	if err != nil {
+		return err
+	}
+	mode, err := f.Mode()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(f.Path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create dir of: %s: %w", f.Path, err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if f.Append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(f.Path, flags, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("failed to open: %s: %w", f.Path, err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(content)
+	if err != nil {
+		return fmt.Errorf("failed to write: %s: %w", f.Path, err)
+	}
+	// The mode of existing files isn't changed by `OpenFile`.
+	err = file.Chmod(os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("failed to chmod: %s: %w", f.Path, err)
+	}
+
+	if f.Owner != "" {
+		credential, _, err := lookupUser(f.Owner)
+		if err != nil {
+			return err
+		}
+		err = file.Chown(int(credential.Uid), int(credential.Gid))
+		if err != nil {
+			return fmt.Errorf("failed to chown: %s: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// applyCloudConfig applies `config`. Boot commands run on every boot, the rest
+// once per instance. Steps that fail are logged and the remaining ones still
+// run.
+func applyCloudConfig(config *cloudconfig.Config, instanceID string) {
+	if len(config.BootCmd) > 0 {
+		err := runCommands(config.BootCmd)
+		if err != nil {
+			log.WithError(err).Error("failed to run boot commands")
+		}
+	}
+
+	if config.Hostname != "" {
+		err := setHostname(config.Hostname)
+		if err != nil {
+			log.WithError(err).Error("failed to set hostname")
+		}
+	}
+
+	if len(config.SSHAuthorizedKeys) > 0 {
+		err := authorizeSSHKeys("root", config.SSHAuthorizedKeys)
+		if err != nil {
+			log.WithError(err).Error("failed to authorize ssh keys")
+		}
+	}
+
+	err := runOnce(instanceID, "users", func() error {
+		for _, u := range config.Users {
+			err := createUser(u)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to create users")
+	}
+
+	err = runOnce(instanceID, "write-files", func() error {
+		for _, f := range config.WriteFiles {
+			err := writeFile(f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to write files")
+	}
+
+	err = runOnce(instanceID, "runcmd", func() error {
+		return runCommands(config.RunCmd)
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to run commands")
+	}
+}
+
+// applyUserData saves `userData` for processes in the guest and applies it
+// once per instance `instanceID` if it's a script or a cloud-config. Failures
+// are logged rather than fatal so that the guest still comes up and can be
+// debugged.
+func applyUserData(userData string, instanceID string) {
+	err := os.MkdirAll(filepath.Dir(userDataPath), 0700)
+	if err == nil {
+		err = os.WriteFile(userDataPath, []byte(userData), 0700)
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to save user data")
+		return
+	}
+
+	switch {
+	case cloudconfig.IsCloudConfig(userData):
+		config, err := cloudconfig.Parse(userData)
+		if err != nil {
+			log.WithError(err).Error("failed to parse user data")
+			return
+		}
+		applyCloudConfig(config, instanceID)
+	case cloudconfig.IsScript(userData):
+		err = runOnce(instanceID, "user-data-script", func() error {
+			log.Info("running user data script")
+			return runWithTimeout([]string{userDataPath})
+		})
+		if err != nil {
+			log.WithError(err).Error("failed to run user data script")
+		}
+	}
+}
+
+// getUserData returns the user data of the guest and its instance ID. It's read
+// from the config drive at `device` if there's one, otherwise from `m`.
+func getUserData(device string, m *metadata) (string, string) {
+	if device == "" {
+		return m.UserData, m.VMName
+	}
+
+	drive, err := readConfigDrive(device)
+	if err != nil {
+		log.WithError(err).Error("failed to read config drive, falling back to metadata")
+		return m.UserData, m.VMName
+	}
+	if len(drive.metaData.PublicKeys) > 0 {
+		err = authorizeSSHKeys("root", drive.metaData.PublicKeys)
+		if err != nil {
+			log.WithError(err).Error("failed to authorize ssh keys")
+		}
+	}
+	return drive.userData, drive.metaData.InstanceID
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/audit"
+	"github.com/abshkbh/chv-starter-pack/pkg/auth"
+)
+
+// getAuditFilter parses the query parameters of an audit query. Callers
+// without the admin scope only see the records of their own tenant.
+func getAuditFilter(r *http.Request, identity *auth.Identity) (audit.Filter, error) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Tenant:    query.Get("tenant"),
+		Subject:   query.Get("subject"),
+		VmName:    query.Get("vm"),
+		Operation: query.Get("operation"),
+		Result:    query.Get("result"),
+	}
+	if !identity.HasScope(auth.ScopeAdmin) {
+		filter.Tenant = identity.Tenant
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 {
+			return filter, fmt.Errorf("invalid limit: %s", limit)
+		}
+	}
+	return filter, nil
+}
+
+func (s *restServer) queryAudit(w http.ResponseWriter, r *http.Request) {
+	identity, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := getAuditFilter(r, identity)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	records, err := s.auditLogger.Query(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []audit.Record{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/server"
+)
+
+// Comment lines keep idle event streams from being closed by proxies.
+const sseKeepAliveInterval = 15 * time.Second
+
+// getAfterEventID returns the ID of the last event a client has seen, either
+// from the "Last-Event-ID" header sent by reconnecting SSE clients or the
+// "since" query parameter.
+func getAfterEventID(r *http.Request) (uint64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("since")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func writeSSEEvent(w http.ResponseWriter, event server.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// streamEvents serves the events of the caller's VMs as server-sent events,
+// starting with the retained events after the one the client last saw. The
+// stream is closed once the retained events are sent if "follow" is false, and
+// otherwise when the server shuts down.
+func (s *restServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	afterID, err := getAfterEventID(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid event ID: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if r.URL.Query().Get("follow") == "false" {
+		for _, event := range s.vmServer.RecentEvents(r.Context(), afterID) {
+			if err := writeSSEEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		return
+	}
+
+	events := s.vmServer.SubscribeEvents(r.Context(), afterID)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			// Closed if the client fell behind, it resumes from its last
+			// event when it reconnects.
+			if !ok {
+				return
+			}
+			if err := writeSSEEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-s.shuttingDown:
+			return
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/audit"
+)
+
+// Fits the base64 encoded bundle of the largest code the server accepts.
+const maxRegisterFunctionRequestSize = 32 << 20
+
+// getVersionParam returns the version in the query of `r`, 0 if it isn't set.
+func getVersionParam(r *http.Request) (int, error) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.Atoi(version)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid version: %q", version)
+	}
+	return parsed, nil
+}
+
+func (s *restServer) registerFunction(w http.ResponseWriter, r *http.Request) {
+	var req serverapi.RegisterFunctionRequest
+	body := http.MaxBytesReader(w, r.Body, maxRegisterFunctionRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	// The bundle isn't audited.
+	audit.SetParam(r.Context(), "bundle", fmt.Sprintf("%d bytes", len(req.GetBundle())))
+
+	resp, err := s.vmServer.RegisterFunction(r.Context(), &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to register function: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listFunctions(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.vmServer.ListFunctions(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list functions: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	functionName := vars["name"]
+	version, err := getVersionParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.GetFunction(r.Context(), functionName, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get function: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) deleteFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	functionName := vars["name"]
+	version, err := getVersionParam(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.DeleteFunction(r.Context(), functionName, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete function: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) invokeFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	functionName := vars["name"]
+	var req serverapi.InvokeFunctionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Only audit the paths, not the content.
+	var paths []string
+	for path := range req.GetFiles() {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	audit.SetParam(r.Context(), "files", paths)
+
+	resp, err := s.vmServer.InvokeFunction(r.Context(), functionName, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to invoke function: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
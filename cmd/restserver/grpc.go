@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/grpcapi"
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/audit"
+	"github.com/abshkbh/chv-starter-pack/pkg/auth"
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+	"github.com/abshkbh/chv-starter-pack/pkg/server"
+)
+
+// grpcMethodScopes is the scope needed to call each method. Methods that
+// aren't listed are denied.
+var grpcMethodScopes = map[string]auth.Scope{
+	grpcapi.VMService_StartVM_FullMethodName:       auth.ScopeLifecycle,
+	grpcapi.VMService_StopVM_FullMethodName:        auth.ScopeLifecycle,
+	grpcapi.VMService_DestroyVM_FullMethodName:     auth.ScopeLifecycle,
+	grpcapi.VMService_DestroyAllVMs_FullMethodName: auth.ScopeLifecycle,
+	grpcapi.VMService_ListAllVMs_FullMethodName:    auth.ScopeRead,
+	grpcapi.VMService_ListVM_FullMethodName:        auth.ScopeRead,
+	grpcapi.VMService_PauseVM_FullMethodName:       auth.ScopeLifecycle,
+	grpcapi.VMService_ResumeVM_FullMethodName:      auth.ScopeLifecycle,
+	grpcapi.VMService_MigrateVM_FullMethodName:     auth.ScopeLifecycle,
+	grpcapi.VMService_WatchEvents_FullMethodName:   auth.ScopeRead,
+	grpcapi.VMService_StreamConsole_FullMethodName: auth.ScopeRead,
+}
+
+// authorizeGRPC authenticates the caller of `fullMethod`, checks its scope and
+// returns a context scoped to the caller's tenant.
+func authorizeGRPC(ctx context.Context, authMiddleware *auth.Middleware, fullMethod string) (context.Context, error) {
+	identity, err := authMiddleware.AuthenticateGRPC(ctx)
+	if err != nil {
+		log.WithField("method", fullMethod).Warnf("unauthenticated call: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated: %v", err)
+	}
+	audit.SetIdentity(ctx, identity.Subject, identity.Method, identity.Tenant)
+
+	scope, ok := grpcMethodScopes[fullMethod]
+	if !ok || !identity.HasScope(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "requires scope: %s", scope)
+	}
+
+	ctx = auth.WithIdentity(ctx, identity)
+	return server.WithTenant(ctx, identity.Tenant), nil
+}
+
+// serverStreamWithContext overrides the context of a stream.
+type serverStreamWithContext struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStreamWithContext) Context() context.Context {
+	return s.ctx
+}
+
+func unaryAuthInterceptor(authMiddleware *auth.Middleware) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authorizeGRPC(ctx, authMiddleware, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamAuthInterceptor(authMiddleware *auth.Middleware) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorizeGRPC(stream.Context(), authMiddleware, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStreamWithContext{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// grpcServer serves the gRPC API on top of the same `server.Server` as the
+// REST API.
+type grpcServer struct {
+	grpcapi.UnimplementedVMServiceServer
+	vmServer *server.Server
+}
+
+func (s *grpcServer) StartVM(ctx context.Context, req *grpcapi.StartVMRequest) (*grpcapi.StartVMResponse, error) {
+	if req.GetVmName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty vm name")
+	}
+
+	resp, err := s.vmServer.StartVM(ctx, toStartVMRequest(req))
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.StartVMResponse{
+		VmName:         resp.GetVmName(),
+		Status:         resp.GetStatus(),
+		Ip:             resp.GetIp(),
+		TapDeviceName:  resp.GetTapDeviceName(),
+		CodeServerPort: resp.GetCodeServerPort(),
+	}, nil
+}
+
+func toStartVMRequest(req *grpcapi.StartVMRequest) *serverapi.StartVMRequest {
+	var disks []serverapi.DiskSpec
+	for _, disk := range req.GetDisks() {
+		disks = append(disks, serverapi.DiskSpec{
+			Path:     serverapi.PtrString(disk.GetPath()),
+			ReadOnly: serverapi.PtrBool(disk.GetReadOnly()),
+		})
+	}
+
+	var ports []serverapi.PortForward
+	for _, port := range req.GetPorts() {
+		ports = append(ports, serverapi.PortForward{
+			HostPort:  serverapi.PtrInt32(port.GetHostPort()),
+			GuestPort: serverapi.PtrInt32(port.GetGuestPort()),
+			Protocol:  serverapi.PtrString(port.GetProtocol()),
+		})
+	}
+
+	startVMRequest := &serverapi.StartVMRequest{
+		VmName:             serverapi.PtrString(req.GetVmName()),
+		Kernel:             serverapi.PtrString(req.GetKernel()),
+		Rootfs:             serverapi.PtrString(req.GetRootfs()),
+		EntryPoint:         serverapi.PtrString(req.GetEntryPoint()),
+		Args:               req.GetArgs(),
+		WorkingDir:         serverapi.PtrString(req.GetWorkingDir()),
+		User:               serverapi.PtrString(req.GetUser()),
+		Hostname:           serverapi.PtrString(req.GetHostname()),
+		SshKeys:            req.GetSshKeys(),
+		UserData:           serverapi.PtrString(req.GetUserData()),
+		DisabledServices:   req.GetDisabledServices(),
+		DestroyOnExit:      serverapi.PtrBool(req.GetDestroyOnExit()),
+		DryRun:             serverapi.PtrBool(req.GetDryRun()),
+		WaitForReady:       serverapi.PtrBool(req.GetWaitForReady()),
+		BootTimeoutSeconds: serverapi.PtrInt32(req.GetBootTimeoutSeconds()),
+		RestartPolicy:      serverapi.PtrString(req.GetRestartPolicy()),
+		MaxRestarts:        serverapi.PtrInt32(req.GetMaxRestarts()),
+		TtlSeconds:         serverapi.PtrInt32(req.GetTtlSeconds()),
+		IdleTimeoutSeconds: serverapi.PtrInt32(req.GetIdleTimeoutSeconds()),
+		ExpiryAction:       serverapi.PtrString(req.GetExpiryAction()),
+		Vcpus:              serverapi.PtrInt32(req.GetVcpus()),
+		MemoryMb:           serverapi.PtrInt32(req.GetMemoryMb()),
+		Disks:              disks,
+		Ports:              ports,
+	}
+	if env := req.GetEnv(); len(env) > 0 {
+		startVMRequest.Env = &env
+	}
+	if secrets := req.GetSecrets(); len(secrets) > 0 {
+		startVMRequest.Secrets = &secrets
+	}
+	return startVMRequest
+}
+
+// toGRPCStartVMRequest is the inverse of `toStartVMRequest`.
+func toGRPCStartVMRequest(req *serverapi.StartVMRequest) *grpcapi.StartVMRequest {
+	var disks []*grpcapi.DiskSpec
+	for _, disk := range req.GetDisks() {
+		disks = append(disks, &grpcapi.DiskSpec{
+			Path:     disk.GetPath(),
+			ReadOnly: disk.GetReadOnly(),
+		})
+	}
+
+	var ports []*grpcapi.PortForward
+	for _, port := range req.GetPorts() {
+		ports = append(ports, &grpcapi.PortForward{
+			HostPort:  port.GetHostPort(),
+			GuestPort: port.GetGuestPort(),
+			Protocol:  port.GetProtocol(),
+		})
+	}
+
+	return &grpcapi.StartVMRequest{
+		VmName:             req.GetVmName(),
+		Kernel:             req.GetKernel(),
+		Rootfs:             req.GetRootfs(),
+		EntryPoint:         req.GetEntryPoint(),
+		Args:               req.GetArgs(),
+		WorkingDir:         req.GetWorkingDir(),
+		User:               req.GetUser(),
+		Hostname:           req.GetHostname(),
+		SshKeys:            req.GetSshKeys(),
+		UserData:           req.GetUserData(),
+		DisabledServices:   req.GetDisabledServices(),
+		DestroyOnExit:      req.GetDestroyOnExit(),
+		DryRun:             req.GetDryRun(),
+		WaitForReady:       req.GetWaitForReady(),
+		BootTimeoutSeconds: req.GetBootTimeoutSeconds(),
+		RestartPolicy:      req.GetRestartPolicy(),
+		MaxRestarts:        req.GetMaxRestarts(),
+		TtlSeconds:         req.GetTtlSeconds(),
+		IdleTimeoutSeconds: req.GetIdleTimeoutSeconds(),
+		ExpiryAction:       req.GetExpiryAction(),
+		Vcpus:              req.GetVcpus(),
+		MemoryMb:           req.GetMemoryMb(),
+		Disks:              disks,
+		Ports:              ports,
+		Env:                req.GetEnv(),
+		Secrets:            req.GetSecrets(),
+	}
+}
+
+func toGRPCVMResponse(resp *serverapi.VMResponse) *grpcapi.VMResponse {
+	return &grpcapi.VMResponse{
+		Success: resp.GetSuccess(),
+		Message: resp.GetMessage(),
+	}
+}
+
+func (s *grpcServer) StopVM(ctx context.Context, req *grpcapi.VMRequest) (*grpcapi.VMResponse, error) {
+	resp, err := s.vmServer.StopVM(ctx, &serverapi.VMRequest{VmName: serverapi.PtrString(req.GetVmName())})
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCVMResponse(resp), nil
+}
+
+func (s *grpcServer) DestroyVM(ctx context.Context, req *grpcapi.VMRequest) (*grpcapi.VMResponse, error) {
+	resp, err := s.vmServer.DestroyVM(ctx, &serverapi.VMRequest{VmName: serverapi.PtrString(req.GetVmName())})
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCVMResponse(resp), nil
+}
+
+func (s *grpcServer) DestroyAllVMs(ctx context.Context, req *grpcapi.DestroyAllVMsRequest) (*grpcapi.DestroyAllVMsResponse, error) {
+	resp, err := s.vmServer.DestroyAllVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcapi.DestroyAllVMsResponse{Success: resp.GetSuccess()}, nil
+}
+
+func (s *grpcServer) ListAllVMs(ctx context.Context, req *grpcapi.ListAllVMsRequest) (*grpcapi.ListAllVMsResponse, error) {
+	resp, err := s.vmServer.ListAllVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*grpcapi.VMInfo
+	for _, vm := range resp.GetVms() {
+		vms = append(vms, &grpcapi.VMInfo{
+			VmName:         vm.GetVmName(),
+			Status:         vm.GetStatus(),
+			Ip:             vm.GetIp(),
+			TapDeviceName:  vm.GetTapDeviceName(),
+			RestartPolicy:  vm.GetRestartPolicy(),
+			Restarts:       vm.GetRestarts(),
+			CreatedAt:      vm.GetCreatedAt(),
+			LastActivityAt: vm.GetLastActivityAt(),
+		})
+	}
+	return &grpcapi.ListAllVMsResponse{Vms: vms}, nil
+}
+
+func (s *grpcServer) ListVM(ctx context.Context, req *grpcapi.VMRequest) (*grpcapi.VMInfo, error) {
+	vm, err := s.vmServer.ListVM(ctx, req.GetVmName())
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.VMInfo{
+		VmName:         vm.GetVmName(),
+		Status:         vm.GetStatus(),
+		Ip:             vm.GetIp(),
+		TapDeviceName:  vm.GetTapDeviceName(),
+		RestartPolicy:  vm.GetRestartPolicy(),
+		Restarts:       vm.GetRestarts(),
+		CreatedAt:      vm.GetCreatedAt(),
+		LastActivityAt: vm.GetLastActivityAt(),
+		Spec:           toGRPCStartVMRequest(vm.Spec),
+	}, nil
+}
+
+func (s *grpcServer) PauseVM(ctx context.Context, req *grpcapi.VMRequest) (*grpcapi.VMResponse, error) {
+	resp, err := s.vmServer.PauseVM(ctx, req.GetVmName())
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCVMResponse(resp), nil
+}
+
+func (s *grpcServer) ResumeVM(ctx context.Context, req *grpcapi.VMRequest) (*grpcapi.VMResponse, error) {
+	resp, err := s.vmServer.ResumeVM(ctx, req.GetVmName())
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCVMResponse(resp), nil
+}
+
+func (s *grpcServer) MigrateVM(ctx context.Context, req *grpcapi.MigrateVMRequest) (*grpcapi.VMResponse, error) {
+	resp, err := s.vmServer.MigrateVM(ctx, req.GetVmName(), &serverapi.MigrateVMRequest{
+		Destination: serverapi.PtrString(req.GetDestination()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCVMResponse(resp), nil
+}
+
+func (s *grpcServer) WatchEvents(req *grpcapi.WatchEventsRequest, stream grpcapi.VMService_WatchEventsServer) error {
+	ctx := stream.Context()
+	for event := range s.vmServer.SubscribeEvents(ctx, req.GetAfterId()) {
+		err := stream.Send(&grpcapi.Event{
+			Id:      event.ID,
+			Type:    string(event.Type),
+			VmName:  event.VmName,
+			Time:    event.Time.Format(time.RFC3339Nano),
+			Message: event.Message,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The subscription is only closed early if the caller fell behind.
+	if ctx.Err() == nil {
+		return status.Error(codes.ResourceExhausted, "too slow to keep up with events")
+	}
+	return nil
+}
+
+func (s *grpcServer) StreamConsole(req *grpcapi.StreamConsoleRequest, stream grpcapi.VMService_StreamConsoleServer) error {
+	return s.vmServer.StreamConsole(stream.Context(), req.GetVmName(), req.GetFollow(), func(data []byte) error {
+		return stream.Send(&grpcapi.ConsoleOutput{Data: data})
+	})
+}
+
+// startGRPCServer serves the gRPC API on `Host`:`GRPCPort` if the port is set.
+// Returns nil if it isn't.
+func startGRPCServer(serverConfig *config.ServerConfig, vmServer *server.Server, authMiddleware *auth.Middleware, auditLogger *audit.Logger) (*grpc.Server, error) {
+	if serverConfig.GRPCPort == "" {
+		return nil, nil
+	}
+
+	// Calls are audited before they're authorized so that denied calls are
+	// recorded too.
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(audit.UnaryServerInterceptor(auditLogger), unaryAuthInterceptor(authMiddleware)),
+		grpc.ChainStreamInterceptor(audit.StreamServerInterceptor(auditLogger), streamAuthInterceptor(authMiddleware)),
+	}
+
+	tlsConfig, err := createTLSConfig(serverConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	addr := net.JoinHostPort(serverConfig.Host, serverConfig.GRPCPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on: %s: %w", addr, err)
+	}
+
+	grpcSrv := grpc.NewServer(opts...)
+	grpcapi.RegisterVMServiceServer(grpcSrv, &grpcServer{vmServer: vmServer})
+	go func() {
+		if err := grpcSrv.Serve(listener); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}()
+
+	log.Infof("gRPC server listening on: %s (tls: %v)", addr, tlsConfig != nil)
+	return grpcSrv, nil
+}
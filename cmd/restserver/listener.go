@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+const (
+	// First file descriptor passed by systemd, see sd_listen_fds(3).
+	systemdListenFdsStart = 3
+)
+
+// createTLSConfig returns the TLS config for the TCP listener or nil if TLS
+// isn't configured.
+func createTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls cert and key: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca file: %w", err)
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client ca file: %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// Clients without a certificate can still authenticate with a token.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.RequireClientCert {
+		if tlsConfig.ClientCAs == nil {
+			return nil, fmt.Errorf("requiring client certs needs a client ca file")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// listenUnix listens on the unix socket in `cfg`, replacing a stale socket
+// left behind by a previous run, and applies its mode and ownership.
+func listenUnix(cfg config.UnixSocketConfig) (net.Listener, error) {
+	err := os.Remove(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %s: %w", cfg.Path, err)
+	}
+
+	listener, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on: %s: %w", cfg.Path, err)
+	}
+
+	err = setSocketPermissions(cfg)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func setSocketPermissions(cfg config.UnixSocketConfig) error {
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode: %s: %w", cfg.Mode, err)
+		}
+
+		err = os.Chmod(cfg.Path, os.FileMode(mode))
+		if err != nil {
+			return fmt.Errorf("failed to chmod socket: %w", err)
+		}
+	}
+
+	// -1 leaves the owner or group unchanged.
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		u, err := user.Lookup(cfg.Owner)
+		if err != nil {
+			return fmt.Errorf("failed to look up socket owner: %w", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return fmt.Errorf("failed to look up socket group: %w", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+
+	err := os.Chown(cfg.Path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("failed to chown socket: %w", err)
+	}
+	return nil
+}
+
+// systemdListeners returns the sockets passed to this process by systemd
+// socket activation.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds <= 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+
+	// Don't pass the sockets on to children e.g. VMMs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+numFds; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", fd))
+		listener, err := net.FileListener(file)
+		// `FileListener` dups the fd.
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use socket passed by systemd: %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// createListeners returns the listeners the restserver serves on. TCP
+// listeners are wrapped with TLS if it's configured. Unix sockets are
+// protected by their permissions instead.
+func createListeners(serverConfig *config.ServerConfig) ([]net.Listener, error) {
+	tlsConfig, err := createTLSConfig(serverConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	if serverConfig.SystemdSocketActivation {
+		listeners, err = systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if serverConfig.Port != "" {
+			addr := net.JoinHostPort(serverConfig.Host, serverConfig.Port)
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen on: %s: %w", addr, err)
+			}
+			listeners = append(listeners, listener)
+		}
+
+		if serverConfig.UnixSocket.Path != "" {
+			listener, err := listenUnix(serverConfig.UnixSocket)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no port or unix socket to listen on")
+	}
+
+	for i, listener := range listeners {
+		_, isTCP := listener.Addr().(*net.TCPAddr)
+		if isTCP && tlsConfig != nil {
+			listeners[i] = tls.NewListener(listener, tlsConfig)
+		}
+		log.Infof("REST server listening on: %s://%s (tls: %v)", listener.Addr().Network(), listener.Addr(), isTCP && tlsConfig != nil)
+	}
+	return listeners, nil
+}
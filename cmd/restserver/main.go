@@ -4,22 +4,78 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
 	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/audit"
+	"github.com/abshkbh/chv-starter-pack/pkg/auth"
 	"github.com/abshkbh/chv-starter-pack/pkg/config"
 	"github.com/abshkbh/chv-starter-pack/pkg/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type restServer struct {
-	vmServer *server.Server
+	vmServer    *server.Server
+	auditLogger *audit.Logger
+	// Closed when the HTTP server shuts down to end long lived streams, which
+	// it otherwise waits for.
+	shuttingDown chan struct{}
+}
+
+// How long in flight requests get to finish when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// httpStatusFromError maps the gRPC status code of an error returned by
+// `server.Server` to an HTTP status code.
+func httpStatusFromError(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// tenantMiddleware scopes every request to the tenant of the authenticated
+// caller. It must run after the auth middleware.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.IdentityFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		audit.SetIdentity(r.Context(), identity.Subject, identity.Method, identity.Tenant)
+		next.ServeHTTP(w, r.WithContext(server.WithTenant(r.Context(), identity.Tenant)))
+	})
 }
 
 // Implement handler functions
@@ -37,7 +93,7 @@ func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := s.vmServer.StartVM(r.Context(), &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to start VM: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to start VM: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -54,7 +110,195 @@ func (s *restServer) stopVM(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := s.vmServer.StopVM(r.Context(), &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to stop VM: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to stop VM: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) pauseVM(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	resp, err := s.vmServer.PauseVM(r.Context(), vmName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to pause VM: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) resumeVM(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	resp, err := s.vmServer.ResumeVM(r.Context(), vmName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to resume VM: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) migrateVM(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	var req serverapi.MigrateVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.MigrateVM(r.Context(), vmName, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to migrate VM: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) uploadFiles(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	var req serverapi.UploadFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Only audit the paths, not the content.
+	var paths []string
+	for _, file := range req.GetFiles() {
+		paths = append(paths, file.GetPath())
+	}
+	audit.SetParam(r.Context(), "files", paths)
+
+	resp, err := s.vmServer.UploadFiles(r.Context(), vmName, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to upload files: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// streamGuestResponse copies the streamed response of a guest service to `w`,
+// flushing as output arrives.
+func streamGuestResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.WithError(err).Warn("guest response ended early")
+			}
+			return
+		}
+	}
+}
+
+func (s *restServer) executeCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	var req serverapi.ExecuteCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Only audit the paths, not the content.
+	var paths []string
+	for path := range req.GetFiles() {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	audit.SetParam(r.Context(), "files", paths)
+
+	resp, err := s.vmServer.ExecuteCode(r.Context(), vmName, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to execute code: %v", err), httpStatusFromError(err))
+		return
+	}
+	streamGuestResponse(w, resp)
+}
+
+func (s *restServer) execCommand(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	var req serverapi.ExecCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.ExecCommand(r.Context(), vmName, &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to exec command: %v", err), httpStatusFromError(err))
+		return
+	}
+	streamGuestResponse(w, resp)
+}
+
+// migrationPeer returns the addresses of the TCP connection `r` came in on.
+// They're nil for requests over the unix socket.
+func migrationPeer(r *http.Request) server.MigrationPeer {
+	var peer server.MigrationPeer
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		peer.LocalIP = localAddr.IP
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer.RemoteIP = net.ParseIP(host)
+	}
+	return peer
+}
+
+func (s *restServer) receiveMigration(w http.ResponseWriter, r *http.Request) {
+	var req serverapi.ReceiveMigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.ReceiveMigration(r.Context(), &req, migrationPeer(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to receive migration: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) abortMigration(w http.ResponseWriter, r *http.Request) {
+	var req serverapi.AbortMigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.vmServer.AbortMigration(r.Context(), &req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to abort migration: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -71,7 +315,7 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := s.vmServer.DestroyVM(r.Context(), &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to destroy VM: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to destroy VM: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -82,7 +326,7 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 	resp, err := s.vmServer.DestroyAllVMs(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to destroy all VMs: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to destroy all VMs: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -93,7 +337,7 @@ func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
 	resp, err := s.vmServer.ListAllVMs(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list all VMs: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list all VMs: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -106,7 +350,20 @@ func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
 	vmName := vars["name"]
 	resp, err := s.vmServer.ListVM(r.Context(), vmName)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list VM: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list VM: %v", err), httpStatusFromError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getVMResult(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	resp, err := s.vmServer.GetVMResult(r.Context(), vmName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get VM result: %v", err), httpStatusFromError(err))
 		return
 	}
 
@@ -153,30 +410,78 @@ func main() {
 		log.Fatalf("failed to create VM server: %v", err)
 	}
 
+	auditLogger, err := audit.NewLogger(serverConfig.Audit, serverConfig.StateDir)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
+	}
+
 	// Create REST server
-	s := &restServer{vmServer: vmServer}
+	s := &restServer{
+		vmServer:     vmServer,
+		auditLogger:  auditLogger,
+		shuttingDown: make(chan struct{}),
+	}
 	r := mux.NewRouter()
 
+	authMiddleware, err := auth.NewMiddleware(serverConfig.Auth)
+	if err != nil {
+		log.Fatalf("failed to set up authentication: %v", err)
+	}
+	// Requests are audited before they're authenticated so that denied
+	// requests are recorded too.
+	r.Use(audit.Middleware(auditLogger))
+	r.Use(authMiddleware.Handler)
+	r.Use(tenantMiddleware)
+
 	// Register routes
-	r.HandleFunc("/vm/start", s.startVM).Methods("POST")
-	r.HandleFunc("/vm/stop", s.stopVM).Methods("POST")
-	r.HandleFunc("/vm/destroy", s.destroyVM).Methods("POST")
-	r.HandleFunc("/vm/destroy-all", s.destroyAllVMs).Methods("POST")
-	r.HandleFunc("/vm/list", s.listAllVMs).Methods("GET")
-	r.HandleFunc("/vm/{name}", s.listVM).Methods("GET")
+	r.HandleFunc("/vm/start", auth.RequireScope(auth.ScopeLifecycle, s.startVM)).Methods("POST")
+	r.HandleFunc("/vm/stop", auth.RequireScope(auth.ScopeLifecycle, s.stopVM)).Methods("POST")
+	r.HandleFunc("/vm/destroy", auth.RequireScope(auth.ScopeLifecycle, s.destroyVM)).Methods("POST")
+	r.HandleFunc("/vm/destroy-all", auth.RequireScope(auth.ScopeLifecycle, s.destroyAllVMs)).Methods("POST")
+	r.HandleFunc("/vm/list", auth.RequireScope(auth.ScopeRead, s.listAllVMs)).Methods("GET")
+	r.HandleFunc("/vm/receive-migration", auth.RequireScope(auth.ScopeAdmin, s.receiveMigration)).Methods("POST")
+	r.HandleFunc("/vm/abort-migration", auth.RequireScope(auth.ScopeAdmin, s.abortMigration)).Methods("POST")
+	r.HandleFunc("/vm/{name}", auth.RequireScope(auth.ScopeRead, s.listVM)).Methods("GET")
+	r.HandleFunc("/vm/{name}/result", auth.RequireScope(auth.ScopeRead, s.getVMResult)).Methods("GET")
+	r.HandleFunc("/vm/{name}/pause", auth.RequireScope(auth.ScopeLifecycle, s.pauseVM)).Methods("POST")
+	r.HandleFunc("/vm/{name}/resume", auth.RequireScope(auth.ScopeLifecycle, s.resumeVM)).Methods("POST")
+	r.HandleFunc("/vm/{name}/migrate", auth.RequireScope(auth.ScopeLifecycle, s.migrateVM)).Methods("POST")
+	r.HandleFunc("/vm/{name}/files", auth.RequireScope(auth.ScopeExec, s.uploadFiles)).Methods("PUT")
+	r.HandleFunc("/vm/{name}/execute", auth.RequireScope(auth.ScopeExec, s.executeCode)).Methods("POST")
+	r.HandleFunc("/vm/{name}/exec", auth.RequireScope(auth.ScopeExec, s.execCommand)).Methods("POST")
+	r.HandleFunc("/functions", auth.RequireScope(auth.ScopeLifecycle, s.registerFunction)).Methods("POST")
+	r.HandleFunc("/functions", auth.RequireScope(auth.ScopeRead, s.listFunctions)).Methods("GET")
+	r.HandleFunc("/functions/{name}", auth.RequireScope(auth.ScopeRead, s.getFunction)).Methods("GET")
+	r.HandleFunc("/functions/{name}", auth.RequireScope(auth.ScopeLifecycle, s.deleteFunction)).Methods("DELETE")
+	r.HandleFunc("/functions/{name}/invoke", auth.RequireScope(auth.ScopeExec, s.invokeFunction)).Methods("POST")
+	r.HandleFunc("/events", auth.RequireScope(auth.ScopeRead, s.streamEvents)).Methods("GET")
+	r.HandleFunc("/audit", auth.RequireScope(auth.ScopeRead, s.queryAudit)).Methods("GET")
+
+	grpcSrv, err := startGRPCServer(serverConfig, vmServer, authMiddleware, auditLogger)
+	if err != nil {
+		log.Fatalf("failed to start gRPC server: %v", err)
+	}
 
 	// Start HTTP server
+	listeners, err := createListeners(serverConfig)
+	if err != nil {
+		log.Fatalf("failed to create listeners: %v", err)
+	}
+
 	srv := &http.Server{
-		Addr:    serverConfig.Host + ":" + serverConfig.Port,
 		Handler: r,
 	}
+	srv.RegisterOnShutdown(func() {
+		close(s.shuttingDown)
+	})
 
-	go func() {
-		log.Printf("REST server listening on: %s:%s", serverConfig.Host, serverConfig.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
+	for _, listener := range listeners {
+		go func() {
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+		}()
+	}
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -184,9 +489,20 @@ func main() {
 	<-sigChan
 
 	log.Println("Shutting down server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// VMs are still shut down if requests don't finish in time.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warnf("Server shutdown failed: %v", err)
+		srv.Close()
+	}
+	// Not a graceful stop as event and console streams don't end on their own.
+	if grpcSrv != nil {
+		grpcSrv.Stop()
+	}
+	vmServer.Shutdown(context.Background())
+	if err := auditLogger.Close(); err != nil {
+		log.Warnf("failed to close audit log: %v", err)
 	}
-	vmServer.DestroyAllVMs(context.Background())
 	log.Println("Server stopped")
 }
@@ -0,0 +1,327 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+const (
+	logFileName       = "audit.log"
+	defaultMaxSizeMB  = 100
+	defaultMaxFiles   = 10
+	defaultQueryLimit = 100
+	// Params of records longer than this are dropped so that they can be
+	// read back.
+	maxRecordSize = 1024 * 1024
+	// Timestamp in the name of rotated files, sorts chronologically.
+	rotatedTimeFormat = "20060102T150405.000000000"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+	// The caller wasn't authenticated or lacked the scope for the operation.
+	ResultDenied = "denied"
+)
+
+// Record is a management operation performed on behalf of a caller.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Identity of the caller. Empty if it couldn't be authenticated.
+	Subject    string `json:"subject,omitempty"`
+	AuthMethod string `json:"authMethod,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// "http" or "grpc".
+	Protocol string `json:"protocol"`
+	// e.g. "POST /vm/start" or "/chv.v1.VMService/StartVM".
+	Operation string         `json:"operation"`
+	VmName    string         `json:"vmName,omitempty"`
+	Params    map[string]any `json:"params,omitempty"`
+	Result    string         `json:"result"`
+	// HTTP status code or gRPC code name.
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Logger appends records as JSON lines to a log file that's rotated once it
+// reaches a maximum size. Only a maximum number of rotated files is kept.
+type Logger struct {
+	lock     sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewLogger opens the audit log in `cfg.Dir` or, if that isn't set, in the
+// "audit" dir under `stateDir`.
+func NewLogger(cfg config.AuditConfig, stateDir string) (*Logger, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = path.Join(stateDir, "audit")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit dir: %w", err)
+	}
+
+	maxSizeMB := defaultMaxSizeMB
+	if cfg.MaxSizeMB > 0 {
+		maxSizeMB = cfg.MaxSizeMB
+	}
+
+	maxFiles := defaultMaxFiles
+	if cfg.MaxFiles > 0 {
+		maxFiles = cfg.MaxFiles
+	}
+
+	l := &Logger{
+		dir:      dir,
+		maxSize:  int64(maxSizeMB) * 1024 * 1024,
+		maxFiles: maxFiles,
+	}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current log file for appending.
+//
+// Must be called with the logger lock held.
+func (l *Logger) open() error {
+	file, err := os.OpenFile(path.Join(l.dir, logFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames the current log file and deletes the oldest rotated files
+// beyond the maximum.
+//
+// Must be called with the logger lock held.
+func (l *Logger) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+
+	rotatedName := fmt.Sprintf("audit-%s.log", time.Now().UTC().Format(rotatedTimeFormat))
+	err = os.Rename(path.Join(l.dir, logFileName), path.Join(l.dir, rotatedName))
+	if err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.maxFiles {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return fmt.Errorf("failed to remove rotated audit log: %w", err)
+		}
+		rotated = rotated[1:]
+	}
+	return l.open()
+}
+
+// rotatedFiles returns the paths of the rotated log files, oldest first.
+func (l *Logger) rotatedFiles() ([]string, error) {
+	rotated, err := filepath.Glob(path.Join(l.dir, "audit-*.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated audit logs: %w", err)
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Log appends `record` to the audit log.
+func (l *Logger) Log(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	if len(line) >= maxRecordSize {
+		record.Params = map[string]any{"truncated": true}
+		line, err = json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit record: %w", err)
+		}
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the current log file.
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// Filter selects records in `Query`. Empty fields match every record.
+type Filter struct {
+	Tenant  string
+	Subject string
+	VmName  string
+	// Matches operations containing it e.g. "/vm/start".
+	Operation string
+	Result    string
+	Since     time.Time
+	Until     time.Time
+	// Maximum number of records returned, the most recent ones are kept.
+	// Defaults to 100.
+	Limit int
+}
+
+func (f Filter) matches(record Record) bool {
+	return (f.Tenant == "" || record.Tenant == f.Tenant) &&
+		(f.Subject == "" || record.Subject == f.Subject) &&
+		(f.VmName == "" || record.VmName == f.VmName) &&
+		(f.Operation == "" || strings.Contains(record.Operation, f.Operation)) &&
+		(f.Result == "" || record.Result == f.Result) &&
+		(f.Since.IsZero() || !record.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || record.Time.Before(f.Until))
+}
+
+// Query returns the records matching `filter`, oldest first.
+func (l *Logger) Query(filter Filter) ([]Record, error) {
+	limit := defaultQueryLimit
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.file.Close()
+		}
+	}()
+
+	// The files are read without the lock held so that a query doesn't block
+	// `Log` and with it every request.
+	var records []Record
+	for _, file := range files {
+		err = scanRecords(file, func(record Record) {
+			if !filter.matches(record) {
+				return
+			}
+			records = append(records, record)
+			if len(records) > limit {
+				records = records[1:]
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// openLog is a log file opened by `Query`.
+type openLog struct {
+	file *os.File
+	// Size of the file when it was opened. Records appended after that are
+	// left out so that a record still being written isn't read.
+	size int64
+}
+
+// openFiles opens the rotated log files, oldest first, followed by the current
+// one. The open files stay readable when they're rotated or removed after this
+// returns.
+func (l *Logger) openFiles() ([]openLog, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	paths, err := l.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, path.Join(l.dir, logFileName))
+
+	var files []openLog
+	for _, filePath := range paths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			for _, f := range files {
+				f.file.Close()
+			}
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			for _, f := range files {
+				f.file.Close()
+			}
+			return nil, fmt.Errorf("failed to stat audit log: %w", err)
+		}
+		files = append(files, openLog{file: file, size: info.Size()})
+	}
+	return files, nil
+}
+
+// scanRecords calls `handle` for every record in `log`. Lines that can't be
+// parsed e.g. one truncated by a crash are skipped.
+func scanRecords(log openLog, handle func(Record)) error {
+	scanner := bufio.NewScanner(io.LimitReader(log.file, log.size))
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var record Record
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			handle(record)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %s: %w", log.file.Name(), err)
+	}
+	return nil
+}
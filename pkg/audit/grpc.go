@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// recordRequest fills in the params and VM of `record` from a request
+// message.
+func recordRequest(record *Record, req any) {
+	if named, ok := req.(interface{ GetVmName() string }); ok {
+		record.VmName = named.GetVmName()
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	var params map[string]any
+	if json.Unmarshal(data, &params) != nil {
+		return
+	}
+	for name, value := range params {
+		record.setParam(name, value)
+	}
+}
+
+func newGRPCRecord(ctx context.Context, fullMethod string) *Record {
+	record := &Record{
+		Time:      time.Now(),
+		Protocol:  "grpc",
+		Operation: fullMethod,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		record.RemoteAddr = p.Addr.String()
+	}
+	return record
+}
+
+func finishGRPCRecord(logger *Logger, record *Record, err error) {
+	code := status.Code(err)
+	record.Status = code.String()
+	switch code {
+	case codes.OK:
+		record.Result = ResultSuccess
+	case codes.Unauthenticated, codes.PermissionDenied:
+		record.Result = ResultDenied
+	default:
+		record.Result = ResultError
+		record.Error = err.Error()
+	}
+	record.DurationMs = time.Since(record.Time).Milliseconds()
+
+	logErr := logger.Log(*record)
+	if logErr != nil {
+		log.WithError(logErr).Error("failed to write audit record")
+	}
+}
+
+// UnaryServerInterceptor records every unary call in `logger`. It must run
+// before the authentication interceptor, which reports the caller with
+// `SetIdentity`.
+func UnaryServerInterceptor(logger *Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		record := newGRPCRecord(ctx, info.FullMethod)
+		recordRequest(record, req)
+
+		resp, err := handler(context.WithValue(ctx, recordContextKey{}, record), req)
+		finishGRPCRecord(logger, record, err)
+		return resp, err
+	}
+}
+
+// recordingServerStream records the request of a server-streaming call.
+type recordingServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	record *Record
+}
+
+func (s *recordingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *recordingServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		recordRequest(s.record, m)
+	}
+	return err
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// `UnaryServerInterceptor`. Streams are recorded once they end.
+func StreamServerInterceptor(logger *Logger) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		record := newGRPCRecord(stream.Context(), info.FullMethod)
+		err := handler(srv, &recordingServerStream{
+			ServerStream: stream,
+			ctx:          context.WithValue(stream.Context(), recordContextKey{}, record),
+			record:       record,
+		})
+		finishGRPCRecord(logger, record, err)
+		return err
+	}
+}
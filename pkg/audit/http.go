@@ -0,0 +1,198 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Request bodies beyond this size aren't recorded as params.
+	maxParamsBodySize = 64 * 1024
+	// Error responses are recorded up to this size.
+	maxErrorSize = 1024
+)
+
+// Params whose name contains one of these are redacted.
+var sensitiveParams = []string{"secret", "token", "password", "key"}
+
+type recordContextKey struct{}
+
+// SetIdentity records the caller of the request with `ctx`, which the
+// authentication middleware can only do after the audit middleware has
+// started recording the request.
+func SetIdentity(ctx context.Context, subject string, authMethod string, tenant string) {
+	record, ok := ctx.Value(recordContextKey{}).(*Record)
+	if !ok {
+		return
+	}
+	record.Subject = subject
+	record.AuthMethod = authMethod
+	record.Tenant = tenant
+}
+
+// SetParam records an additional param of the request with `ctx` e.g. the
+// command of an exec that isn't in its body.
+func SetParam(ctx context.Context, name string, value any) {
+	record, ok := ctx.Value(recordContextKey{}).(*Record)
+	if !ok {
+		return
+	}
+	record.setParam(name, value)
+}
+
+func (r *Record) setParam(name string, value any) {
+	if r.Params == nil {
+		r.Params = make(map[string]any)
+	}
+	r.Params[name] = redact(name, value)
+}
+
+func redact(name string, value any) any {
+	lowerName := strings.ToLower(name)
+	for _, sensitive := range sensitiveParams {
+		if strings.Contains(lowerName, sensitive) {
+			return "REDACTED"
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(value))
+		for k, v := range value {
+			redacted[k] = redact(k, v)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(value))
+		for i, v := range value {
+			redacted[i] = redact(name, v)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+// responseRecorder captures the status and, for errors, the body of a
+// response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= 400 && r.body.Len() < maxErrorSize {
+		r.body.Write(b[:min(len(b), maxErrorSize-r.body.Len())])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// requestParams returns the path variables, query and JSON body of `r` with
+// sensitive values redacted. The body is restored for the handler.
+func requestParams(r *http.Request) map[string]any {
+	params := make(map[string]any)
+	for name, value := range mux.Vars(r) {
+		params[name] = redact(name, value)
+	}
+	for name, values := range r.URL.Query() {
+		params[name] = redact(name, strings.Join(values, ","))
+	}
+
+	if r.Body == nil || r.ContentLength > maxParamsBodySize {
+		return params
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxParamsBodySize+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || len(body) == 0 || len(body) > maxParamsBodySize {
+		return params
+	}
+
+	var bodyParams map[string]any
+	if json.Unmarshal(body, &bodyParams) == nil {
+		for name, value := range bodyParams {
+			params[name] = redact(name, value)
+		}
+	}
+	return params
+}
+
+// Middleware records every request in `logger`. It's meant to be installed
+// with `mux.Router.Use` before the authentication middleware, which reports
+// the caller with `SetIdentity`.
+func Middleware(logger *Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			operation := r.Method + " " + r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					operation = r.Method + " " + template
+				}
+			}
+
+			record := &Record{
+				Time:       start,
+				RemoteAddr: r.RemoteAddr,
+				Protocol:   "http",
+				Operation:  operation,
+				Params:     requestParams(r),
+			}
+			if vmName, ok := record.Params["name"].(string); ok {
+				record.VmName = vmName
+			} else if vmName, ok := record.Params["vmName"].(string); ok {
+				record.VmName = vmName
+			}
+
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), recordContextKey{}, record)))
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			record.Status = strconv.Itoa(recorder.status)
+			switch {
+			case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+				record.Result = ResultDenied
+			case recorder.status >= 400:
+				record.Result = ResultError
+			default:
+				record.Result = ResultSuccess
+			}
+			if recorder.status >= 400 {
+				record.Error = strings.TrimSpace(recorder.body.String())
+			}
+			record.DurationMs = time.Since(start).Milliseconds()
+
+			err := logger.Log(*record)
+			if err != nil {
+				log.WithError(err).Error("failed to write audit record")
+			}
+		})
+	}
+}
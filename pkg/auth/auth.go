@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+// Scope is a class of operations a caller is allowed to perform.
+type Scope string
+
+const (
+	// Listing and inspecting VMs.
+	ScopeRead Scope = "read"
+	// Starting, stopping, pausing, migrating and destroying VMs.
+	ScopeLifecycle Scope = "lifecycle"
+	// Running code and commands inside VMs.
+	ScopeExec Scope = "exec"
+	// Acting for any tenant e.g. when another server migrates a VM in.
+	ScopeAdmin Scope = "admin"
+)
+
+// DefaultTenant is the tenant of callers whose credentials don't name one.
+const DefaultTenant = "default"
+
+var allScopes = []Scope{ScopeRead, ScopeLifecycle, ScopeExec, ScopeAdmin}
+
+func parseScopes(scopes []string) ([]Scope, error) {
+	var result []Scope
+	for _, scope := range scopes {
+		switch Scope(scope) {
+		case ScopeRead, ScopeLifecycle, ScopeExec, ScopeAdmin:
+			result = append(result, Scope(scope))
+		default:
+			return nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+	return result, nil
+}
+
+// ErrNoCredentials is returned by an `Authenticator` when a request doesn't
+// carry credentials it recognizes, in which case the next one is tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is an authenticated caller.
+type Identity struct {
+	Subject string
+	// How the caller authenticated e.g. "token", "client-cert" or "jwt".
+	Method string
+	// The caller only sees and manages VMs of this tenant.
+	Tenant string
+	Scopes []Scope
+}
+
+func tenantOrDefault(tenant string) string {
+	if tenant == "" {
+		return DefaultTenant
+	}
+	return tenant
+}
+
+// HasScope returns true if the caller is allowed operations in `scope`. Any
+// scope allows reading.
+func (i *Identity) HasScope(scope Scope) bool {
+	if scope == ScopeRead && len(i.Scopes) > 0 {
+		return true
+	}
+
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller of a request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type contextKey struct{}
+
+// IdentityFromContext returns the caller attached to `ctx` by `Middleware`.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok
+}
+
+// WithIdentity returns a copy of `ctx` carrying `identity`.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// bearerToken returns the bearer token in the Authorization header of `r` or
+// an empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Middleware authenticates every request with the first authenticator that
+// recognizes its credentials and rejects requests that none of them do.
+type Middleware struct {
+	authenticators []Authenticator
+	// If set every request is let through as an anonymous caller with all
+	// scopes.
+	anonymous bool
+}
+
+// NewMiddleware builds the authenticators enabled in `cfg`.
+func NewMiddleware(cfg config.AuthConfig) (*Middleware, error) {
+	if !cfg.Enabled {
+		log.Warn("authentication is disabled, every caller has all scopes")
+		return &Middleware{anonymous: true}, nil
+	}
+
+	var authenticators []Authenticator
+	if len(cfg.Tokens) > 0 {
+		tokenAuthenticator, err := NewTokenAuthenticator(cfg.Tokens)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create token authenticator: %w", err)
+		}
+		authenticators = append(authenticators, tokenAuthenticator)
+	}
+
+	if len(cfg.ClientCerts) > 0 {
+		clientCertAuthenticator, err := NewClientCertAuthenticator(cfg.ClientCerts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client cert authenticator: %w", err)
+		}
+		authenticators = append(authenticators, clientCertAuthenticator)
+	}
+
+	if cfg.JWT.JWKSFile != "" {
+		jwtAuthenticator, err := NewJWTAuthenticator(cfg.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create jwt authenticator: %w", err)
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, fmt.Errorf("authentication is enabled but no tokens, client certs or jwks file are configured")
+	}
+	return &Middleware{authenticators: authenticators}, nil
+}
+
+func (m *Middleware) authenticate(r *http.Request) (*Identity, error) {
+	if m.anonymous {
+		return &Identity{Subject: "anonymous", Method: "none", Tenant: DefaultTenant, Scopes: allScopes}, nil
+	}
+
+	for _, authenticator := range m.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// Handler is meant to be installed with `mux.Router.Use`.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := m.authenticate(r)
+		if err != nil {
+			log.WithFields(log.Fields{"path": r.URL.Path, "remote": r.RemoteAddr}).Warnf("unauthenticated request: %v", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, fmt.Sprintf("Unauthenticated: %v", err), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
+
+// RequireScope wraps `next` so that it's only called for callers with
+// `scope`.
+func RequireScope(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := IdentityFromContext(r.Context())
+		if !ok || !identity.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("Forbidden: requires scope: %s", scope), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
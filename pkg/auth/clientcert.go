@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+// ClientCertAuthenticator authenticates requests by the common name of their
+// TLS client certificate. It relies on the TLS listener verifying the
+// certificate against the client CA.
+type ClientCertAuthenticator struct {
+	identities map[string]*Identity
+}
+
+func NewClientCertAuthenticator(clientCerts []config.ClientCertConfig) (*ClientCertAuthenticator, error) {
+	a := &ClientCertAuthenticator{identities: make(map[string]*Identity)}
+	for _, clientCert := range clientCerts {
+		if clientCert.CommonName == "" {
+			return nil, fmt.Errorf("empty client cert common name")
+		}
+
+		scopes, err := parseScopes(clientCert.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scopes for client cert: %s: %w", clientCert.CommonName, err)
+		}
+		a.identities[clientCert.CommonName] = &Identity{
+			Subject: clientCert.CommonName,
+			Method:  "client-cert",
+			Tenant:  tenantOrDefault(clientCert.Tenant),
+			Scopes:  scopes,
+		}
+	}
+	return a, nil
+}
+
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	// Only trust certificates that the TLS stack verified.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	identity, ok := a.identities[commonName]
+	if !ok {
+		return nil, fmt.Errorf("unknown client cert: %s", commonName)
+	}
+	return identity, nil
+}
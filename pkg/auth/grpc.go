@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// AuthenticateGRPC authenticates the caller of a gRPC call with the same
+// authenticators as HTTP requests. The call's metadata and TLS state are
+// presented to them as an HTTP request.
+func (m *Middleware) AuthenticateGRPC(ctx context.Context) (*Identity, error) {
+	r := &http.Request{Header: make(http.Header)}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("authorization") {
+			r.Header.Add("Authorization", value)
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &tlsInfo.State
+		}
+	}
+	return m.authenticate(r)
+}
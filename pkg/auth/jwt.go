@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+const (
+	// Allowed clock skew when checking the validity period of a token.
+	jwtLeeway          = 30 * time.Second
+	defaultTenantClaim = "tenant"
+)
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jsonWebKey is the subset of RFC 7517 needed for RSA and EC public keys.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type verificationKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// JWTAuthenticator authenticates requests carrying a bearer JWT signed by one
+// of the keys in a local JWKS file, e.g. one exported from an OIDC provider.
+// Scopes are read from the space separated "scope" claim or the "scopes" or
+// "scp" array claims, except for the "admin" scope which is only granted by the
+// configured admin claim.
+type JWTAuthenticator struct {
+	keys        []verificationKey
+	issuer      string
+	audience    string
+	tenantClaim string
+	adminClaim  string
+	adminValue  string
+}
+
+func NewJWTAuthenticator(cfg config.JWTConfig) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file: %w", err)
+	}
+
+	var keySet jsonWebKeySet
+	err = json.Unmarshal(data, &keySet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwks file: %w", err)
+	}
+
+	a := &JWTAuthenticator{
+		issuer:      cfg.Issuer,
+		audience:    cfg.Audience,
+		tenantClaim: cfg.TenantClaim,
+		adminClaim:  cfg.AdminClaim,
+		adminValue:  cfg.AdminValue,
+	}
+	if (a.adminClaim == "") != (a.adminValue == "") {
+		return nil, fmt.Errorf("jwt admin claim and value must be set together")
+	}
+	if a.tenantClaim == "" {
+		a.tenantClaim = defaultTenantClaim
+	}
+	for _, jwk := range keySet.Keys {
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key: %s: %w", jwk.Kid, err)
+		}
+		a.keys = append(a.keys, verificationKey{kid: jwk.Kid, key: key})
+	}
+
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("no keys in jwks file: %s", cfg.JWKSFile)
+	}
+	return a, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseJSONWebKey(jwk jsonWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
+
+func verifySignature(key crypto.PublicKey, hash crypto.Hash, signed []byte, signature []byte) bool {
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ECDSA signatures as R || S.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	default:
+		return false
+	}
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrNoCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %w", err)
+	}
+
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported jwt algorithm: %s", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt signature: %w", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range a.keys {
+		if header.Kid != "" && key.kid != header.Kid {
+			continue
+		}
+		// Don't let an RSA key verify an ES* token or vice versa.
+		_, isRSA := key.key.(*rsa.PublicKey)
+		if isRSA != strings.HasPrefix(header.Alg, "RS") {
+			continue
+		}
+		if verifySignature(key.key, hash, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid jwt signature")
+	}
+
+	var claims map[string]any
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %w", err)
+	}
+
+	err = a.validateClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	tenant, _ := claims[a.tenantClaim].(string)
+	return &Identity{
+		Subject: subject,
+		Method:  "jwt",
+		Tenant:  tenantOrDefault(tenant),
+		Scopes:  a.scopesFromClaims(claims),
+	}, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]any) error {
+	now := time.Now()
+	// Tokens that never expire can't be revoked as there's no revocation list.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("jwt has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("jwt has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("jwt isn't valid yet")
+		}
+	}
+
+	if a.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.issuer {
+			return fmt.Errorf("unexpected jwt issuer: %s", iss)
+		}
+	}
+
+	if a.audience != "" && !hasClaimValue(claims["aud"], a.audience) {
+		return fmt.Errorf("jwt isn't meant for audience: %s", a.audience)
+	}
+	return nil
+}
+
+// hasClaimValue handles `claim` being either a string or an array of strings.
+func hasClaimValue(claim any, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []any:
+		for _, v := range claim {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopesFromClaims drops scopes that this server doesn't know about as tokens
+// are often shared with other services. The "admin" scope is only granted by
+// the admin claim as users can often pick the scopes of their tokens.
+func (a *JWTAuthenticator) scopesFromClaims(claims map[string]any) []Scope {
+	var names []string
+	if scope, ok := claims["scope"].(string); ok {
+		names = append(names, strings.Fields(scope)...)
+	}
+	for _, claim := range []string{"scopes", "scp"} {
+		if values, ok := claims[claim].([]any); ok {
+			for _, value := range values {
+				if name, ok := value.(string); ok {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	var scopes []Scope
+	for _, name := range names {
+		if Scope(name) == ScopeAdmin {
+			continue
+		}
+		parsed, err := parseScopes([]string{name})
+		if err == nil {
+			scopes = append(scopes, parsed...)
+		}
+	}
+	if a.adminClaim != "" && hasClaimValue(claims[a.adminClaim], a.adminValue) {
+		scopes = append(scopes, ScopeAdmin)
+	}
+	return scopes
+}
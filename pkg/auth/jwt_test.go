@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, signed string) []byte {
+	t.Helper()
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, signed string) []byte {
+	t.Helper()
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+func newTestJWTAuthenticator(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, cfg config.JWTConfig) *JWTAuthenticator {
+	t.Helper()
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	keySet := jsonWebKeySet{Keys: []jsonWebKey{
+		{
+			Kty: "RSA",
+			Kid: "rsa",
+			N:   encode(rsaKey.N),
+			E:   encode(big.NewInt(int64(rsaKey.E))),
+		},
+		{
+			Kty: "EC",
+			Kid: "ec",
+			Crv: "P-256",
+			X:   encode(ecKey.X),
+			Y:   encode(ecKey.Y),
+		},
+	}}
+	data, err := json.Marshal(keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(cfg.JWKSFile, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestJWTAuthenticator(t, rsaKey, ecKey, config.JWTConfig{
+		Issuer:     "https://idp.example.com",
+		Audience:   "chv",
+		AdminClaim: "groups",
+		AdminValue: "chv-admins",
+	})
+
+	now := time.Now().Unix()
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"sub":    "alice",
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"chv", "other"},
+			"exp":    now + 3600,
+			"tenant": "acme",
+			"scope":  "read exec unknown",
+		}
+	}
+
+	// sign signs `claims` with `alg` and the key it needs, leaving the
+	// signature empty for "none".
+	sign := func(alg string, kid string, claims map[string]any, signer func(string) []byte) string {
+		signed := encodeSegment(t, map[string]any{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+		var signature []byte
+		if signer != nil {
+			signature = signer(signed)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	withRSA := func(signed string) []byte { return signRS256(t, rsaKey, signed) }
+	withEC := func(signed string) []byte { return signES256(t, ecKey, signed) }
+
+	tests := []struct {
+		name       string
+		token      func() string
+		wantErr    bool
+		wantScopes []Scope
+	}{
+		{
+			name:       "rs256",
+			token:      func() string { return sign("RS256", "rsa", validClaims(), withRSA) },
+			wantScopes: []Scope{ScopeRead, ScopeExec},
+		},
+		{
+			name:       "es256",
+			token:      func() string { return sign("ES256", "ec", validClaims(), withEC) },
+			wantScopes: []Scope{ScopeRead, ScopeExec},
+		},
+		{
+			name:       "no kid",
+			token:      func() string { return sign("RS256", "", validClaims(), withRSA) },
+			wantScopes: []Scope{ScopeRead, ScopeExec},
+		},
+		{
+			name: "bad signature",
+			token: func() string {
+				return sign("RS256", "rsa", validClaims(), func(signed string) []byte {
+					return signRS256(t, otherRSAKey, signed)
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				parts := strings.Split(sign("RS256", "rsa", validClaims(), withRSA), ".")
+				claims := validClaims()
+				claims["tenant"] = "other"
+				parts[1] = encodeSegment(t, claims)
+				return strings.Join(parts, ".")
+			},
+			wantErr: true,
+		},
+		{
+			name:    "alg none",
+			token:   func() string { return sign("none", "rsa", validClaims(), nil) },
+			wantErr: true,
+		},
+		{
+			name:    "alg hs256",
+			token:   func() string { return sign("HS256", "rsa", validClaims(), withRSA) },
+			wantErr: true,
+		},
+		{
+			// An RSA signature presented as ES256 mustn't be checked against
+			// the RSA key.
+			name:    "alg confusion rsa as es256",
+			token:   func() string { return sign("ES256", "rsa", validClaims(), withRSA) },
+			wantErr: true,
+		},
+		{
+			name:    "alg confusion ec as rs256",
+			token:   func() string { return sign("RS256", "ec", validClaims(), withEC) },
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = now - 3600
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired within leeway",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = now - 5
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantScopes: []Scope{ScopeRead, ScopeExec},
+		},
+		{
+			name: "missing exp",
+			token: func() string {
+				claims := validClaims()
+				delete(claims, "exp")
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantErr: true,
+		},
+		{
+			name: "not valid yet",
+			token: func() string {
+				claims := validClaims()
+				claims["nbf"] = now + 3600
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := validClaims()
+				claims["iss"] = "https://evil.example.com"
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validClaims()
+				claims["aud"] = "other"
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantErr: true,
+		},
+		{
+			name: "admin scope requested",
+			token: func() string {
+				claims := validClaims()
+				claims["scope"] = "read admin"
+				claims["scp"] = []string{"admin"}
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantScopes: []Scope{ScopeRead},
+		},
+		{
+			name: "admin claim",
+			token: func() string {
+				claims := validClaims()
+				claims["groups"] = []string{"users", "chv-admins"}
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantScopes: []Scope{ScopeRead, ScopeExec, ScopeAdmin},
+		},
+		{
+			name: "other admin claim value",
+			token: func() string {
+				claims := validClaims()
+				claims["groups"] = "users"
+				return sign("RS256", "rsa", claims, withRSA)
+			},
+			wantScopes: []Scope{ScopeRead, ScopeExec},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+tc.token())
+
+			identity, err := a.Authenticate(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity: %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if identity.Subject != "alice" || identity.Tenant != "acme" || identity.Method != "jwt" {
+				t.Errorf("unexpected identity: %+v", identity)
+			}
+			if !slices.Equal(identity.Scopes, tc.wantScopes) {
+				t.Errorf("got scopes %v, want %v", identity.Scopes, tc.wantScopes)
+			}
+		})
+	}
+}
+
+func TestNewJWTAuthenticatorAdminClaimWithoutValue(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksFile, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewJWTAuthenticator(config.JWTConfig{JWKSFile: jwksFile, AdminClaim: "groups"})
+	if err == nil {
+		t.Fatal("expected an error for an admin claim without a value")
+	}
+}
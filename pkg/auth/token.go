@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+type staticToken struct {
+	token    []byte
+	identity *Identity
+}
+
+// TokenAuthenticator authenticates requests carrying one of a fixed set of
+// bearer tokens.
+type TokenAuthenticator struct {
+	tokens []staticToken
+}
+
+func NewTokenAuthenticator(tokens []config.TokenConfig) (*TokenAuthenticator, error) {
+	a := &TokenAuthenticator{}
+	for _, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("empty token for: %s", token.Name)
+		}
+
+		scopes, err := parseScopes(token.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scopes for token: %s: %w", token.Name, err)
+		}
+
+		a.tokens = append(a.tokens, staticToken{
+			token: []byte(token.Token),
+			identity: &Identity{
+				Subject: token.Name,
+				Method:  "token",
+				Tenant:  tenantOrDefault(token.Tenant),
+				Scopes:  scopes,
+			},
+		})
+	}
+	return a, nil
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// Compare against every token so that the time taken doesn't reveal which
+	// one matched.
+	var identity *Identity
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t.token, []byte(token)) == 1 {
+			identity = t.identity
+		}
+	}
+
+	// Let other authenticators e.g. the JWT one have a go at the token.
+	if identity == nil {
+		return nil, ErrNoCredentials
+	}
+	return identity, nil
+}
@@ -0,0 +1,187 @@
+// Package cloudconfig implements the subset of cloud-init's user data that
+// guests are bootstrapped with. It's validated by the server and applied by
+// guestinit.
+package cloudconfig
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Header user data starts with to be parsed as a cloud-config.
+	Header = "#cloud-config"
+	// Prefix of user data that's run as a script.
+	ScriptPrefix = "#!"
+
+	// Volume label of config drives, as used by cloud-init's NoCloud
+	// datasource.
+	VolumeLabel = "cidata"
+	// Names of the files on a config drive.
+	MetaDataFile = "meta-data"
+	UserDataFile = "user-data"
+)
+
+// IsCloudConfig returns whether `userData` is a cloud-config.
+func IsCloudConfig(userData string) bool {
+	return strings.HasPrefix(userData, Header)
+}
+
+// IsScript returns whether `userData` is a script.
+func IsScript(userData string) bool {
+	return strings.HasPrefix(userData, ScriptPrefix)
+}
+
+// MetaData is the instance metadata on a config drive.
+type MetaData struct {
+	// Identifies the VM and its user data. Run-once steps run again when it
+	// changes.
+	InstanceID    string   `yaml:"instance-id"`
+	LocalHostname string   `yaml:"local-hostname,omitempty"`
+	PublicKeys    []string `yaml:"public-keys,omitempty"`
+}
+
+// Config is the supported subset of cloud-config.
+type Config struct {
+	Hostname string `yaml:"hostname,omitempty"`
+	// Authorized for root.
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+	Users             []User   `yaml:"users,omitempty"`
+	WriteFiles        []File   `yaml:"write_files,omitempty"`
+	// Run on every boot before anything else.
+	BootCmd []Command `yaml:"bootcmd,omitempty"`
+	// Run once per instance after files are written and users are created.
+	RunCmd []Command `yaml:"runcmd,omitempty"`
+}
+
+// User is created if it doesn't exist yet.
+type User struct {
+	Name string `yaml:"name"`
+	// Defaults to the rootfs' default shell.
+	Shell             string   `yaml:"shell,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// File is written into the guest.
+type File struct {
+	// Absolute path in the guest.
+	Path    string `yaml:"path"`
+	Content string `yaml:"content,omitempty"`
+	// "b64" or "base64" if `Content` is base64 encoded, plain text otherwise.
+	Encoding string `yaml:"encoding,omitempty"`
+	// Octal mode e.g. "0644", which is the default.
+	Permissions string `yaml:"permissions,omitempty"`
+	// user[:group], defaults to root.
+	Owner  string `yaml:"owner,omitempty"`
+	Append bool   `yaml:"append,omitempty"`
+}
+
+// Command is run with "sh -c" if it's given as a string, or as is if it's given
+// as a list.
+type Command struct {
+	Args []string
+}
+
+func (c *Command) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		c.Args = []string{"sh", "-c", node.Value}
+		return nil
+	case yaml.SequenceNode:
+		err := node.Decode(&c.Args)
+		if err != nil {
+			return err
+		}
+		if len(c.Args) == 0 {
+			return fmt.Errorf("line %d: empty command", node.Line)
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: command must be a string or a list", node.Line)
+	}
+}
+
+func (c Command) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Parse parses and validates the cloud-config `userData`. Keys outside of the
+// supported subset are rejected so that they aren't silently ignored.
+func Parse(userData string) (*Config, error) {
+	if !IsCloudConfig(userData) {
+		return nil, fmt.Errorf("user data doesn't start with %q", Header)
+	}
+
+	var config Config
+	decoder := yaml.NewDecoder(strings.NewReader(userData))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid cloud-config: %w", err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud-config: %w", err)
+	}
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	for _, user := range c.Users {
+		if user.Name == "" {
+			return errors.New("user without a name")
+		}
+	}
+
+	for _, file := range c.WriteFiles {
+		if !path.IsAbs(file.Path) {
+			return fmt.Errorf("file path isn't absolute: %q", file.Path)
+		}
+		_, err := file.Decode()
+		if err != nil {
+			return fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		_, err = file.Mode()
+		if err != nil {
+			return fmt.Errorf("file %s: %w", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// Decode returns the content of the file.
+func (f File) Decode() ([]byte, error) {
+	switch f.Encoding {
+	case "", "text/plain":
+		return []byte(f.Content), nil
+	case "b64", "base64":
+		content, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content: %w", err)
+		}
+		return content, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %q", f.Encoding)
+	}
+}
+
+// Mode returns the permissions of the file.
+func (f File) Mode() (uint32, error) {
+	if f.Permissions == "" {
+		return 0644, nil
+	}
+	mode, err := strconv.ParseUint(f.Permissions, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid permissions: %q", f.Permissions)
+	}
+	return uint32(mode), nil
+}
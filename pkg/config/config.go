@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/viper"
 )
@@ -23,6 +24,184 @@ type ServerConfig struct {
 	KernelPath     string `mapstructure:"kernel"`
 	RootfsPath     string `mapstructure:"rootfs"`
 	CodeServerPort string `mapstructure:"code_server_port"`
+	// Port the command server in guests listens on.
+	CmdServerPort string `mapstructure:"cmd_server_port"`
+	// Port on the bridge IP where guests call back into the host e.g. to
+	// signal readiness. It also serves the guests' metadata.
+	GuestApiPort string `mapstructure:"guest_api_port"`
+	// DNS servers guests are configured with. Guests keep the resolv.conf of
+	// their rootfs if empty.
+	GuestNameservers []string `mapstructure:"guest_nameservers"`
+	// Defaults for VMs that don't set their own TTL and idle timeout. 0
+	// disables reclaiming VMs.
+	DefaultTTLSeconds         int `mapstructure:"default_ttl_seconds"`
+	DefaultIdleTimeoutSeconds int `mapstructure:"default_idle_timeout_seconds"`
+	// One of "destroy", "snapshot" or "pause".
+	DefaultExpiryAction   string     `mapstructure:"default_expiry_action"`
+	ReaperIntervalSeconds int        `mapstructure:"reaper_interval_seconds"`
+	Auth                  AuthConfig `mapstructure:"auth"`
+	// Applies to tenants without an entry in `TenantQuotas`.
+	DefaultQuota QuotaConfig `mapstructure:"default_quota"`
+	// Keyed by tenant name.
+	TenantQuotas map[string]QuotaConfig `mapstructure:"tenant_quotas"`
+	// Serves the TCP listener over TLS if set.
+	TLS TLSConfig `mapstructure:"tls"`
+	// Additionally serves on a unix socket if its path is set.
+	UnixSocket UnixSocketConfig `mapstructure:"unix_socket"`
+	// Serve on the sockets passed by systemd instead of `Host`:`Port` and
+	// `UnixSocket`.
+	SystemdSocketActivation bool `mapstructure:"systemd_socket_activation"`
+	// Serves the gRPC API on `Host`:`GRPCPort` if set. It uses the same TLS
+	// config as the REST API.
+	GRPCPort string `mapstructure:"grpc_port"`
+	// Endpoints VM events are sent to.
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+	// Where management operations are recorded.
+	Audit AuditConfig `mapstructure:"audit"`
+	// Disk images VMs can attach in addition to their rootfs must be under one
+	// of these dirs. Extra disks are rejected if it's empty.
+	AllowedDiskDirs []string `mapstructure:"allowed_disk_dirs"`
+	// VMs that functions are invoked in.
+	Functions FunctionsConfig `mapstructure:"functions"`
+}
+
+// FunctionsConfig configures the VMs functions are invoked in. Each function of
+// each tenant has its own VMs.
+type FunctionsConfig struct {
+	// Ready VMs kept per function to serve invocations without booting one. 0
+	// boots a VM for every invocation.
+	PoolSize int `mapstructure:"pool_size"`
+	// Pooled VMs are destroyed once they've been unused for this long.
+	// Defaults to 300.
+	PoolIdleTimeoutSeconds int `mapstructure:"pool_idle_timeout_seconds"`
+	// Invocations of a function that can run at once, further ones are
+	// rejected. Defaults to 10.
+	MaxConcurrency int `mapstructure:"max_concurrency"`
+	// Resources of function VMs. Default to those of other VMs.
+	Vcpus    int `mapstructure:"vcpus"`
+	MemoryMB int `mapstructure:"memory_mb"`
+}
+
+// AuditConfig is the audit log of the operations performed through the
+// restserver. The log is rotated once it reaches `MaxSizeMB`.
+type AuditConfig struct {
+	// Defaults to the "audit" dir under the state dir.
+	Dir string `mapstructure:"dir"`
+	// Defaults to 100.
+	MaxSizeMB int `mapstructure:"max_size_mb"`
+	// Number of rotated files kept. Defaults to 10.
+	MaxFiles int `mapstructure:"max_files"`
+}
+
+// WebhookConfig sends VM events to `URL` as JSON POST requests, retrying
+// failed deliveries with backoff.
+type WebhookConfig struct {
+	URL string `mapstructure:"url"`
+	// If set the body is signed with HMAC-SHA256 using this secret. The hex
+	// encoded signature is sent in the "X-Chv-Signature" header as
+	// "sha256=<signature>".
+	Secret string `mapstructure:"secret"`
+	// Only sends the events of this tenant if set.
+	Tenant string `mapstructure:"tenant"`
+	// Only sends these event types if set.
+	Events []string `mapstructure:"events"`
+	// Defaults to 5.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Timeout of each attempt. Defaults to 10.
+	TimeoutSeconds int `mapstructure:"timeout_seconds"`
+}
+
+// String doesn't print the secret.
+func (c WebhookConfig) String() string {
+	return fmt.Sprintf("{URL: %s Tenant: %s Events: %v}", c.URL, c.Tenant, c.Events)
+}
+
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// If set client certificates signed by this CA are verified and can be
+	// used to authenticate.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	// Reject clients without a valid certificate.
+	RequireClientCert bool `mapstructure:"require_client_cert"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+type UnixSocketConfig struct {
+	Path string `mapstructure:"path"`
+	// Octal file mode e.g. "0660".
+	Mode  string `mapstructure:"mode"`
+	Owner string `mapstructure:"owner"`
+	Group string `mapstructure:"group"`
+}
+
+// QuotaConfig limits the resources a tenant's VMs can use. 0 means unlimited.
+type QuotaConfig struct {
+	MaxVMs      int `mapstructure:"max_vms"`
+	MaxVcpus    int `mapstructure:"max_vcpus"`
+	MaxMemoryMB int `mapstructure:"max_memory_mb"`
+	MaxIPs      int `mapstructure:"max_ips"`
+}
+
+// AuthConfig configures how callers of the restserver are authenticated. Each
+// credential is granted a subset of the "read", "lifecycle" and "exec"
+// scopes.
+type AuthConfig struct {
+	// If false every caller is allowed everything.
+	Enabled bool `mapstructure:"enabled"`
+	// Static bearer tokens.
+	Tokens []TokenConfig `mapstructure:"tokens"`
+	// TLS client certificates, identified by their common name. Requires the
+	// restserver to be served over TLS with a client CA.
+	ClientCerts []ClientCertConfig `mapstructure:"client_certs"`
+	JWT         JWTConfig          `mapstructure:"jwt"`
+	// Bearer token this server presents to other servers e.g. when migrating
+	// VMs to them. It needs the "admin" scope on them.
+	PeerToken string `mapstructure:"peer_token"`
+}
+
+// Credentials without a tenant act for the "default" tenant.
+type TokenConfig struct {
+	Name   string   `mapstructure:"name"`
+	Token  string   `mapstructure:"token"`
+	Tenant string   `mapstructure:"tenant"`
+	Scopes []string `mapstructure:"scopes"`
+}
+
+type ClientCertConfig struct {
+	CommonName string   `mapstructure:"common_name"`
+	Tenant     string   `mapstructure:"tenant"`
+	Scopes     []string `mapstructure:"scopes"`
+}
+
+// JWTConfig enables verifying bearer JWTs e.g. issued by an OIDC provider.
+// It's disabled if `JWKSFile` is empty.
+type JWTConfig struct {
+	JWKSFile string `mapstructure:"jwks_file"`
+	// Optional. If set the "iss" and "aud" claims must match.
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// Claim holding the caller's tenant. Defaults to "tenant".
+	TenantClaim string `mapstructure:"tenant_claim"`
+	// Optional. Tokens get the "admin" scope only if `AdminClaim` is set and
+	// holds `AdminValue`, e.g. a "groups" claim containing "chv-admins". An
+	// "admin" scope requested in the token's scope claims is ignored.
+	AdminClaim string `mapstructure:"admin_claim"`
+	AdminValue string `mapstructure:"admin_value"`
+}
+
+// String doesn't print the tokens.
+func (c AuthConfig) String() string {
+	return fmt.Sprintf(
+		"{Enabled: %v Tokens: %d ClientCerts: %d JWKSFile: %s}",
+		c.Enabled,
+		len(c.Tokens),
+		len(c.ClientCerts),
+		c.JWT.JWKSFile,
+	)
 }
 
 func (c ServerConfig) String() string {
@@ -36,6 +215,24 @@ BridgeSubnet: %s
 KernelPath: %s
 ChvBinPath: %s
 CodeServerPort: %s
+CmdServerPort: %s
+GuestApiPort: %s
+GuestNameservers: %v
+DefaultTTLSeconds: %d
+DefaultIdleTimeoutSeconds: %d
+DefaultExpiryAction: %s
+ReaperIntervalSeconds: %d
+Auth: %v
+DefaultQuota: %+v
+TenantQuotas: %+v
+TLS: %+v
+UnixSocket: %+v
+SystemdSocketActivation: %v
+GRPCPort: %s
+Webhooks: %v
+Audit: %+v
+AllowedDiskDirs: %v
+Functions: %+v
 }`,
 		c.Host,
 		c.Port,
@@ -46,29 +243,90 @@ CodeServerPort: %s
 		c.KernelPath,
 		c.ChvBinPath,
 		c.CodeServerPort,
+		c.CmdServerPort,
+		c.GuestApiPort,
+		c.GuestNameservers,
+		c.DefaultTTLSeconds,
+		c.DefaultIdleTimeoutSeconds,
+		c.DefaultExpiryAction,
+		c.ReaperIntervalSeconds,
+		c.Auth,
+		c.DefaultQuota,
+		c.TenantQuotas,
+		c.TLS,
+		c.UnixSocket,
+		c.SystemdSocketActivation,
+		c.GRPCPort,
+		c.Webhooks,
+		c.Audit,
+		c.AllowedDiskDirs,
+		c.Functions,
 	)
 }
 
 type ClientConfig struct {
 	ServerHost string `mapstructure:"server_host"`
 	ServerPort string `mapstructure:"server_port"`
+	// Connect over this unix socket instead of `ServerHost`:`ServerPort`.
+	// Overridden by the `ClientSocketEnvVar` environment variable.
+	SocketPath string `mapstructure:"socket_path"`
+	// Connect over https. `CAFile` verifies the server's certificate instead
+	// of the system roots. `CertFile` and `KeyFile` are presented as a client
+	// certificate.
+	UseTLS   bool   `mapstructure:"use_tls"`
+	CAFile   string `mapstructure:"ca_file"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Bearer token sent to the server. Overridden by the `ClientTokenEnvVar`
+	// environment variable.
+	Token string `mapstructure:"token"`
 }
 
+const (
+	// ClientTokenEnvVar is the environment variable the client reads its
+	// bearer token from.
+	ClientTokenEnvVar = "CHV_TOKEN"
+	// ClientSocketEnvVar is the environment variable the client reads the
+	// server's unix socket path from.
+	ClientSocketEnvVar = "CHV_SOCKET"
+)
+
 func (c ClientConfig) String() string {
 	return fmt.Sprintf(`{
 ServerHost: %s
 ServerPort: %s
-}`, c.ServerHost, c.ServerPort)
+SocketPath: %s
+UseTLS: %v
+CAFile: %s
+CertFile: %s
+Token: %v
+}`, c.ServerHost, c.ServerPort, c.SocketPath, c.UseTLS, c.CAFile, c.CertFile, c.Token != "")
 }
 
 type CodeServerConfig struct {
 	Port string `mapstructure:"port"`
+	// Python venvs are cached by their dependencies. Its settings take
+	// precedence over the code server's flags.
+	VenvCache VenvCacheConfig `mapstructure:"venv_cache"`
+	// Dir with wheels that Python dependencies are installed from without
+	// network access if they're all in it.
+	WheelhouseDir string `mapstructure:"wheelhouse_dir"`
+}
+
+// VenvCacheConfig bounds the cache of Python venvs. The least recently used
+// venvs are evicted once either limit is exceeded.
+type VenvCacheConfig struct {
+	Dir        string `mapstructure:"dir"`
+	MaxSizeMB  int    `mapstructure:"max_size_mb"`
+	MaxEntries int    `mapstructure:"max_entries"`
 }
 
 func (c CodeServerConfig) String() string {
 	return fmt.Sprintf(`{
 Port: %s
-}`, c.Port)
+VenvCache: %+v
+WheelhouseDir: %s
+}`, c.Port, c.VenvCache, c.WheelhouseDir)
 }
 
 func GetServerConfig(configFile string) (*ServerConfig, error) {
@@ -106,6 +364,14 @@ func GetClientConfig(configFile string) (*ClientConfig, error) {
 	if err := clientConfig.Unmarshal(&result); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
+
+	if token := os.Getenv(ClientTokenEnvVar); token != "" {
+		result.Token = token
+	}
+
+	if socketPath := os.Getenv(ClientSocketEnvVar); socketPath != "" {
+		result.SocketPath = socketPath
+	}
 	return &result, nil
 }
 
@@ -116,13 +382,13 @@ func GetCodeServerConfig(configFile string) (*CodeServerConfig, error) {
 		return nil, fmt.Errorf("failed to read config: %v", err)
 	}
 
-	clientConfig := viper.Sub(clientConfigKey)
-	if clientConfig == nil {
-		return nil, fmt.Errorf("client configuration not found")
+	codeServerConfig := viper.Sub(codeServerConfigKey)
+	if codeServerConfig == nil {
+		return nil, fmt.Errorf("codeserver configuration not found")
 	}
 
 	var result CodeServerConfig
-	if err := clientConfig.Unmarshal(&result); err != nil {
+	if err := codeServerConfig.Unmarshal(&result); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
 	return &result, nil
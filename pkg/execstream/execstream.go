@@ -0,0 +1,191 @@
+// Package execstream implements the newline delimited JSON stream used to send
+// the output of processes run in guests as they produce it.
+package execstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+const (
+	// ContentType of streamed responses.
+	ContentType = "application/x-ndjson"
+
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+
+	StatusSuccess = "success"
+	StatusError   = "error"
+	StatusTimeout = "timeout"
+
+	// Lines are read up to this size.
+	maxLineSize = 1 << 20
+)
+
+// Chunk is one line of a stream. Every chunk but the last carries output. The
+// last one carries the result.
+type Chunk struct {
+	Stream string `json:"stream,omitempty"`
+	Data   string `json:"data,omitempty"`
+	// Only set in the last chunk.
+	Status   string `json:"status,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Done returns whether the chunk is the last of a stream.
+func (c Chunk) Done() bool {
+	return c.Status != ""
+}
+
+// Writer writes chunks to an HTTP response, flushing each one so that clients
+// see output as soon as it's produced.
+type Writer struct {
+	lock    sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	encoder *json.Encoder
+}
+
+// NewWriter returns a writer streaming to `w` and sets the content type of the
+// response.
+func NewWriter(w http.ResponseWriter) *Writer {
+	w.Header().Set("Content-Type", ContentType)
+	flusher, _ := w.(http.Flusher)
+	return &Writer{
+		w:       w,
+		flusher: flusher,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (w *Writer) write(chunk Chunk) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.encoder.Encode(chunk)
+	if err != nil {
+		return err
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return nil
+}
+
+type streamWriter struct {
+	w      *Writer
+	stream string
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	err := s.w.write(Chunk{Stream: s.stream, Data: string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stdout returns a writer whose writes are sent as stdout chunks.
+func (w *Writer) Stdout() io.Writer {
+	return &streamWriter{w: w, stream: StreamStdout}
+}
+
+// Stderr returns a writer whose writes are sent as stderr chunks.
+func (w *Writer) Stderr() io.Writer {
+	return &streamWriter{w: w, stream: StreamStderr}
+}
+
+// Finish writes the last chunk of the stream.
+func (w *Writer) Finish(status string, exitCode int, err error) error {
+	chunk := Chunk{Status: status, ExitCode: &exitCode}
+	if err != nil {
+		chunk.Error = err.Error()
+	}
+	return w.write(chunk)
+}
+
+// SetProcessGroup makes `cmd` the leader of a new process group once started
+// so that `KillProcessGroup` also kills the processes it starts, e.g. the
+// compiler or the program behind `npx tsx`.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// KillProcessGroup kills the started `cmd` and every process in its group.
+// Processes left running would otherwise also keep its output open.
+func KillProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// Run runs `cmd` streaming its output to `w` and finishes the stream with its
+// result. `cmd` and the processes it started are killed if `ctx` is done
+// before it exits.
+func Run(ctx context.Context, cmd *exec.Cmd, w *Writer) error {
+	cmd.Stdout = w.Stdout()
+	cmd.Stderr = w.Stderr()
+	SetProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return w.Finish(StatusError, -1, fmt.Errorf("failed to start: %w", err))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		KillProcessGroup(cmd)
+		<-done
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return w.Finish(StatusTimeout, -1, errors.New("execution timed out"))
+		}
+		return w.Finish(StatusError, -1, ctx.Err())
+	}
+
+	if err == nil {
+		return w.Finish(StatusSuccess, 0, nil)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return w.Finish(StatusError, exitErr.ExitCode(), err)
+	}
+	return w.Finish(StatusError, -1, err)
+}
+
+// Read calls `handle` for every output chunk in `r` and returns the last chunk.
+// An error is returned if the stream ends without one.
+func Read(r io.Reader, handle func(Chunk)) (Chunk, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var chunk Chunk
+		err := json.Unmarshal(scanner.Bytes(), &chunk)
+		if err != nil {
+			return Chunk{}, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		if chunk.Done() {
+			return chunk, nil
+		}
+		handle(chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		return Chunk{}, err
+	}
+	return Chunk{}, io.ErrUnexpectedEOF
+}
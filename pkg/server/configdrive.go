@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/cloudconfig"
+)
+
+const (
+	// Builds the ISO9660 image of config drives.
+	genisoimageBin = "genisoimage"
+	// Name of the config drive in the VM state dir.
+	configDriveFileName = "config-drive.iso"
+)
+
+// needsConfigDrive returns whether VMs with `spec` get a config drive.
+func (spec vmSpec) needsConfigDrive() bool {
+	return spec.userData != "" || len(spec.sshKeys) > 0
+}
+
+// getInstanceID returns the instance ID of VM `vmName` with `spec`. It changes
+// with the user data so that guests run their run-once steps again.
+func getInstanceID(tenant string, vmName string, spec vmSpec) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", tenant, vmName, spec.userData)
+	for _, key := range spec.sshKeys {
+		fmt.Fprintf(h, "%s\x00", key)
+	}
+	return fmt.Sprintf("%s-%x", vmName, h.Sum(nil)[:6])
+}
+
+// getConfigDriveDevice returns the device the config drive shows up as in the
+// guest. It's attached after the rootfs and `numDisks` other disks.
+func getConfigDriveDevice(numDisks int) (string, error) {
+	index := numDisks + 1
+	if index >= 26 {
+		return "", fmt.Errorf("too many disks for a config drive: %d", numDisks)
+	}
+	return fmt.Sprintf("/dev/vd%c", 'a'+index), nil
+}
+
+// buildConfigDrive builds the config drive of VM `vmName` in its state dir
+// `vmStateDir` and returns its path. It follows the layout of cloud-init's
+// NoCloud datasource.
+func buildConfigDrive(vmStateDir string, tenant string, vmName string, spec vmSpec) (string, error) {
+	hostname := spec.hostname
+	if hostname == "" {
+		hostname = hostnameFromVMName(vmName)
+	}
+	metaData, err := yaml.Marshal(cloudconfig.MetaData{
+		InstanceID:    getInstanceID(tenant, vmName, spec),
+		LocalHostname: hostname,
+		PublicKeys:    spec.sshKeys,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal meta data: %w", err)
+	}
+
+	contentDir, err := os.MkdirTemp(vmStateDir, "config-drive-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create config drive dir: %w", err)
+	}
+	defer os.RemoveAll(contentDir)
+
+	metaDataPath := path.Join(contentDir, cloudconfig.MetaDataFile)
+	err = os.WriteFile(metaDataPath, metaData, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write meta data: %w", err)
+	}
+	userDataPath := path.Join(contentDir, cloudconfig.UserDataFile)
+	err = os.WriteFile(userDataPath, []byte(spec.userData), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write user data: %w", err)
+	}
+
+	imagePath := path.Join(vmStateDir, configDriveFileName)
+	output, err := exec.Command(
+		genisoimageBin,
+		"-quiet",
+		"-output", imagePath,
+		"-volid", cloudconfig.VolumeLabel,
+		"-joliet",
+		"-rock",
+		metaDataPath,
+		userDataPath,
+	).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to build config drive: %s: %w", output, err)
+	}
+	return imagePath, nil
+}
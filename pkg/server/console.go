@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	consoleChunkSize    = 32 * 1024
+	consolePollInterval = 200 * time.Millisecond
+)
+
+// StreamConsole calls `send` with the serial console output of `vmName`, which
+// the VMM writes to the log in the VM's state dir. If `follow` is set it keeps
+// sending new output till `ctx` is done or the VM is destroyed.
+func (s *Server) StreamConsole(ctx context.Context, vmName string, follow bool, send func([]byte) error) error {
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return err
+	}
+
+	// Attaching to the console counts as activity. Following it doesn't keep
+	// the VM from being reclaimed for being idle.
+	err = s.TouchVM(ctx, vmName)
+	if err != nil {
+		return fmt.Errorf("failed to resume idle VM: %w", err)
+	}
+
+	logFile, err := os.Open(path.Join(vm.stateDirPath, "log"))
+	if err != nil {
+		return fmt.Errorf("failed to open console log: %w", err)
+	}
+	defer logFile.Close()
+
+	buf := make([]byte, consoleChunkSize)
+	for {
+		n, err := logFile.Read(buf)
+		if n > 0 {
+			sendErr := send(buf[:n])
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read console log: %w", err)
+		}
+		if !follow {
+			return nil
+		}
+
+		// A restarted VM gets a new log, so stop once `vm` is gone.
+		s.lock.Lock()
+		current, exists := s.vms[vm.key()]
+		s.lock.Unlock()
+		if !exists || current != vm {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(consolePollInterval):
+		}
+	}
+}
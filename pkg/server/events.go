@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Events buffered per subscriber. A subscriber that falls further behind
+	// is dropped.
+	eventSubscriberBufferSize = 256
+	// Recent events kept so that subscribers can resume after reconnecting.
+	eventHistorySize = 1024
+	// Leaves room for 2^31 events per server start while keeping IDs below
+	// 2^63 for JSON clients that parse them as int64.
+	eventIDEpochShift = 31
+)
+
+// EventType is what happened to a VM.
+type EventType string
+
+const (
+	EventCreated       EventType = "created"
+	EventBooted        EventType = "booted"
+	EventReady         EventType = "ready"
+	EventStopped       EventType = "stopped"
+	EventPaused        EventType = "paused"
+	EventResumed       EventType = "resumed"
+	EventCrashed       EventType = "crashed"
+	EventExited        EventType = "exited"
+	EventResized       EventType = "resized"
+	EventSnapshotTaken EventType = "snapshot-taken"
+	EventMigrated      EventType = "migrated"
+	EventDestroyed     EventType = "destroyed"
+	// Not about a VM. Sent first to subscribers resuming after an event whose
+	// successors may have been lost, because the server restarted since or
+	// they're no longer retained. Its ID is the one before the first event
+	// that's still available.
+	EventReset EventType = "reset"
+)
+
+var allEventTypes = []EventType{
+	EventCreated,
+	EventBooted,
+	EventReady,
+	EventStopped,
+	EventPaused,
+	EventResumed,
+	EventCrashed,
+	EventExited,
+	EventResized,
+	EventSnapshotTaken,
+	EventMigrated,
+	EventDestroyed,
+}
+
+// ParseEventType returns an error for unknown event types.
+func ParseEventType(eventType string) (EventType, error) {
+	for _, t := range allEventTypes {
+		if string(t) == eventType {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type: %s", eventType)
+}
+
+// Event is a change in the lifecycle of a VM.
+type Event struct {
+	// Increases by one with every event published by a server. It starts at
+	// the time the server started shifted by `eventIDEpochShift` so that IDs
+	// keep increasing across restarts.
+	ID      uint64    `json:"id"`
+	Type    EventType `json:"type"`
+	Tenant  string    `json:"tenant"`
+	VmName  string    `json:"vmName"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message,omitempty"`
+}
+
+type eventSubscriber struct {
+	// Empty to receive the events of every tenant.
+	tenant string
+	ch     chan Event
+}
+
+func (subscriber *eventSubscriber) wants(event Event) bool {
+	return subscriber.tenant == "" || subscriber.tenant == event.Tenant
+}
+
+// eventBus fans out events to subscribers. It has its own lock so that events
+// can be published with the server lock held.
+type eventBus struct {
+	lock        sync.Mutex
+	lastID      uint64
+	subscribers map[*eventSubscriber]struct{}
+	// The last `eventHistorySize` events, oldest first.
+	history []Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		lastID:      uint64(time.Now().Unix()) << eventIDEpochShift,
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// publish never blocks. Subscribers whose buffer is full are dropped and see
+// their channel closed.
+func (b *eventBus) publish(event Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for subscriber := range b.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+
+		select {
+		case subscriber.ch <- event:
+		default:
+			log.WithField("tenant", subscriber.tenant).Warn("dropping event subscriber that fell behind")
+			delete(b.subscribers, subscriber)
+			close(subscriber.ch)
+		}
+	}
+}
+
+// eventsAfter returns the retained events after `afterID` that `subscriber`
+// wants, preceded by a reset event if events after `afterID` may have been
+// lost.
+//
+// Must be called with the bus lock held.
+func (b *eventBus) eventsAfter(subscriber *eventSubscriber, afterID uint64) []Event {
+	firstID := b.lastID + 1
+	if len(b.history) > 0 {
+		firstID = b.history[0].ID
+	}
+
+	var events []Event
+	if afterID != 0 && afterID < firstID-1 {
+		events = append(events, Event{
+			ID:      firstID - 1,
+			Type:    EventReset,
+			Time:    time.Now(),
+			Message: fmt.Sprintf("events after: %d may have been lost", afterID),
+		})
+	}
+	for _, event := range b.history {
+		if event.ID > afterID && subscriber.wants(event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// subscribe replays the retained events after `afterID` before any new event.
+// Events that are no longer retained are skipped after a reset event.
+func (b *eventBus) subscribe(tenant string, afterID uint64) *eventSubscriber {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subscriber := &eventSubscriber{tenant: tenant}
+	replay := b.eventsAfter(subscriber, afterID)
+	subscriber.ch = make(chan Event, max(eventSubscriberBufferSize, len(replay)))
+	for _, event := range replay {
+		subscriber.ch <- event
+	}
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (b *eventBus) unsubscribe(subscriber *eventSubscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subscribers[subscriber]; ok {
+		delete(b.subscribers, subscriber)
+		close(subscriber.ch)
+	}
+}
+
+// publishEvent publishes an event about `vm`. It can be called with the server
+// lock held.
+func (s *Server) publishEvent(vm *vm, eventType EventType, message string) {
+	s.events.publish(Event{
+		Type:    eventType,
+		Tenant:  vm.tenant,
+		VmName:  vm.name,
+		Time:    time.Now(),
+		Message: message,
+	})
+}
+
+// SubscribeEvents returns a channel receiving the events of the VMs of the
+// tenant in `ctx` after the event with ID `afterID` till `ctx` is done,
+// starting with the retained ones. The channel is closed early if the caller
+// doesn't keep up, in which case it can resubscribe after the last event it
+// received.
+func (s *Server) SubscribeEvents(ctx context.Context, afterID uint64) <-chan Event {
+	subscriber := s.events.subscribe(tenantFromContext(ctx), afterID)
+	go func() {
+		<-ctx.Done()
+		s.events.unsubscribe(subscriber)
+	}()
+	return subscriber.ch
+}
+
+// RecentEvents returns the retained events of the VMs of the tenant in `ctx`
+// after the event with ID `afterID`.
+func (s *Server) RecentEvents(ctx context.Context, afterID uint64) []Event {
+	s.events.lock.Lock()
+	defer s.events.lock.Unlock()
+	return s.events.eventsAfter(&eventSubscriber{tenant: tenantFromContext(ctx)}, afterID)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+const defaultCmdServerPort = "8080"
+
+// getCmdServerPort returns the port the command server in guests listens on.
+func (s *Server) getCmdServerPort() string {
+	if s.config.CmdServerPort == "" {
+		return defaultCmdServerPort
+	}
+	return s.config.CmdServerPort
+}
+
+// guestServicePorts returns the ports of the unauthenticated servers in guests
+// that only the host may connect to.
+func (s *Server) guestServicePorts() []string {
+	return []string{s.getCodeServerPort(), s.getCmdServerPort()}
+}
+
+// guestExecuteRequest is the request of the code server's /execute endpoint.
+type guestExecuteRequest struct {
+	Lang         string            `json:"lang"`
+	Files        map[string]string `json:"files"`
+	EntryPoint   string            `json:"entry_point"`
+	Dependencies []string          `json:"dependencies"`
+	// Dir in the guest with the dependencies installed ahead of time.
+	DependenciesDir string `json:"dependencies_dir,omitempty"`
+	Timeout         int32  `json:"timeout"`
+	Stdin           string `json:"stdin,omitempty"`
+	Stream          bool   `json:"stream"`
+}
+
+// guestRunCommandRequest is the request of the command server's /run_command
+// endpoint.
+type guestRunCommandRequest struct {
+	Args    []string `json:"args"`
+	Timeout int32    `json:"timeout"`
+	Stream  bool     `json:"stream"`
+}
+
+// postToGuest sends `body` to `path` of the service listening on `port` in
+// `vmName`. Using the VM counts as activity and resumes it if it was paused for
+// being idle.
+func (s *Server) postToGuest(ctx context.Context, vmName string, port string, path string, body any) (*http.Response, error) {
+	err := s.TouchVM(ctx, vmName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resume idle VM: %v", err)
+	}
+
+	guestIP, err := s.getReadyGuestIP(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal request: %v", err)
+	}
+
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(guestIP, port), path)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	// No timeout as the response streams for as long as the process runs. It's
+	// bounded by `ctx` instead.
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to reach guest service: %v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxCodeServerErrorSize))
+		code := codes.Unavailable
+		if resp.StatusCode == http.StatusBadRequest {
+			code = codes.InvalidArgument
+		}
+		return nil, status.Errorf(code, "guest service failed: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// ExecuteCode runs code in `vmName` through the code server in the guest. The
+// body of the returned response streams the output as execstream chunks and
+// must be closed by the caller.
+func (s *Server) ExecuteCode(ctx context.Context, vmName string, req *serverapi.ExecuteCodeRequest) (*http.Response, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to execute %s code", req.GetLang())
+
+	if req.GetEntryPoint() == "" {
+		return nil, status.Error(codes.InvalidArgument, "entry point is required")
+	}
+
+	return s.postToGuest(ctx, vmName, s.getCodeServerPort(), "/execute", guestExecuteRequest{
+		Lang:         req.GetLang(),
+		Files:        req.GetFiles(),
+		EntryPoint:   req.GetEntryPoint(),
+		Dependencies: req.GetDependencies(),
+		Timeout:      req.GetTimeoutSeconds(),
+		Stream:       true,
+	})
+}
+
+// ExecCommand runs a command in `vmName` through the command server in the
+// guest. The body of the returned response streams the output as execstream
+// chunks and must be closed by the caller.
+func (s *Server) ExecCommand(ctx context.Context, vmName string, req *serverapi.ExecCommandRequest) (*http.Response, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to exec: %v", req.GetArgs())
+
+	if len(req.GetArgs()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "command is required")
+	}
+
+	return s.postToGuest(ctx, vmName, s.getCmdServerPort(), "/run_command", guestRunCommandRequest{
+		Args:    req.GetArgs(),
+		Timeout: req.GetTimeoutSeconds(),
+		Stream:  true,
+	})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+const (
+	defaultCodeServerPort = "4030"
+	uploadFilesTimeout    = 60 * time.Second
+	// Error responses of the code server are read up to this size.
+	maxCodeServerErrorSize = 4096
+)
+
+// getCodeServerPort returns the port the code server in guests listens on.
+func (s *Server) getCodeServerPort() string {
+	if s.config.CodeServerPort == "" {
+		return defaultCodeServerPort
+	}
+	return s.config.CodeServerPort
+}
+
+// getReadyGuestIP returns the IP of `vmName` once its guest services are up.
+func (s *Server) getReadyGuestIP(ctx context.Context, vmName string) (string, error) {
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm.status != vmStatusReady {
+		return "", status.Errorf(codes.FailedPrecondition, "vm %s isn't ready: %v", vmName, vm.status)
+	}
+	return vm.ip.IP.String(), nil
+}
+
+// UploadFiles writes files into `vmName` through the code server in the guest.
+func (s *Server) UploadFiles(ctx context.Context, vmName string, req *serverapi.UploadFilesRequest) (*serverapi.VMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to upload %d files", len(req.GetFiles()))
+
+	for _, file := range req.GetFiles() {
+		if !filepath.IsAbs(file.GetPath()) {
+			return nil, status.Errorf(codes.InvalidArgument, "file path isn't absolute: %q", file.GetPath())
+		}
+	}
+
+	// Like executing code, uploading files counts as activity.
+	err := s.TouchVM(ctx, vmName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resume idle VM: %v", err)
+	}
+
+	guestIP, err := s.getReadyGuestIP(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal files: %v", err)
+	}
+
+	url := fmt.Sprintf("http://%s/files", net.JoinHostPort(guestIP, s.getCodeServerPort()))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: uploadFilesTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to reach code server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxCodeServerErrorSize))
+		return nil, status.Errorf(codes.Unavailable, "code server failed to write files: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	logger.Infof("uploaded files")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
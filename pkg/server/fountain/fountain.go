@@ -1,8 +1,11 @@
 package fountain
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os/exec"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -15,8 +18,48 @@ func NewFountain(bridgeDevice string) *Fountain {
 	return &Fountain{bridgeDevice: bridgeDevice}
 }
 
+const (
+	// Linux limits interface names to 15 characters.
+	maxInterfaceNameLen = 15
+	tapDevicePrefix     = "tap-"
+)
+
+// getTapDeviceName returns the name of the tap device of `vmName`, which is
+// unique across tenants. Names that don't make a valid interface name are
+// hashed.
+func getTapDeviceName(vmName string) string {
+	tapDevice := tapDevicePrefix + vmName
+	if len(tapDevice) <= maxInterfaceNameLen && !strings.ContainsAny(vmName, "/: \t") {
+		return tapDevice
+	}
+
+	hash := sha256.Sum256([]byte(vmName))
+	return tapDevicePrefix + hex.EncodeToString(hash[:])[:maxInterfaceNameLen-len(tapDevicePrefix)]
+}
+
+func tapDeviceExists(tapDevice string) bool {
+	return exec.Command("ip", "link", "show", tapDevice).Run() == nil
+}
+
+// getTapDeviceMaster returns the bridge `tapDevice` is attached to or an empty
+// string if it isn't attached to any.
+func getTapDeviceMaster(tapDevice string) (string, error) {
+	output, err := exec.Command("ip", "-o", "link", "show", tapDevice).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to show: %v: %w", tapDevice, err)
+	}
+
+	fields := strings.Fields(string(output))
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "master" {
+			return fields[i+1], nil
+		}
+	}
+	return "", nil
+}
+
 func (f *Fountain) CreateTapDevice(vmName string) (string, error) {
-	tapDevice := fmt.Sprintf("tap-%s", vmName)
+	tapDevice := getTapDeviceName(vmName)
 	if err := exec.Command("ip", "tuntap", "add", "dev", tapDevice, "mode", "tap").Run(); err != nil {
 		return "", fmt.Errorf("failed to create: %v: %w", tapDevice, err)
 	}
@@ -32,8 +75,53 @@ func (f *Fountain) CreateTapDevice(vmName string) (string, error) {
 	return tapDevice, nil
 }
 
+// AdoptTapDevice attaches the tap device of `vmName` to this fountain's bridge,
+// creating it if it doesn't exist. It's used when a VM migrates in as its tap
+// device name is part of the migrated VM config. When both ends of a migration
+// are on the same host the tap device already exists and is attached to the
+// source's bridge, which is returned so that it can be restored if the
+// migration fails.
+func (f *Fountain) AdoptTapDevice(vmName string) (string, string, error) {
+	tapDevice := getTapDeviceName(vmName)
+	if !tapDeviceExists(tapDevice) {
+		createdTapDevice, err := f.CreateTapDevice(vmName)
+		return createdTapDevice, "", err
+	}
+
+	previousBridge, err := getTapDeviceMaster(tapDevice)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = f.MoveTapDevice(vmName, f.bridgeDevice)
+	if err != nil {
+		return "", "", err
+	}
+	return tapDevice, previousBridge, nil
+}
+
+// MoveTapDevice attaches the tap device of `vmName` to `bridgeDevice`.
+func (f *Fountain) MoveTapDevice(vmName string, bridgeDevice string) error {
+	tapDevice := getTapDeviceName(vmName)
+	if err := exec.Command("ip", "l", "set", "dev", tapDevice, "master", bridgeDevice).Run(); err != nil {
+		return fmt.Errorf("failed to add: %v to: %v: %w", tapDevice, bridgeDevice, err)
+	}
+	return nil
+}
+
+// IsTapDeviceOnBridge returns true if the tap device of `vmName` is attached to
+// this fountain's bridge. It isn't after the VM has migrated to another bridge
+// on the same host.
+func (f *Fountain) IsTapDeviceOnBridge(vmName string) (bool, error) {
+	master, err := getTapDeviceMaster(getTapDeviceName(vmName))
+	if err != nil {
+		return false, err
+	}
+	return master == f.bridgeDevice, nil
+}
+
 func (f *Fountain) DestroyTapDevice(vmName string) error {
-	tapDevice := fmt.Sprintf("tap-%s", vmName)
+	tapDevice := getTapDeviceName(vmName)
 	log.WithFields(log.Fields{
 		"vmName":    vmName,
 		"tapDevice": tapDevice,
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/execstream"
+)
+
+const (
+	functionVMPrefix               = "fn-"
+	defaultFunctionMaxConcurrency  = 10
+	defaultFunctionPoolIdleTimeout = 5 * time.Minute
+	// How long to wait for the guest to report a result after the code's own
+	// timeout has expired.
+	functionTimeoutGracePeriod = 10 * time.Second
+)
+
+var functionNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// functionPool is the state of a function of a tenant.
+type functionPool struct {
+	tenant string
+	// Invocations in flight.
+	running int
+	// Ready VMs waiting for an invocation, the most recently used last.
+	idle []pooledVM
+}
+
+type pooledVM struct {
+	name string
+	// Path of the layer disk the VM has attached, if any. VMs without one can
+	// run any version.
+	layer    string
+	lastUsed time.Time
+}
+
+// outputTail keeps the end of a stream of output that fits in
+// `maxResultOutputSize`.
+type outputTail struct {
+	data      strings.Builder
+	truncated bool
+}
+
+func (o *outputTail) write(data string) {
+	o.data.WriteString(data)
+	// Trimming only once there's twice as much as kept keeps copying linear.
+	if o.data.Len() > 2*maxResultOutputSize {
+		tail, _ := truncateOutput(o.data.String())
+		o.data.Reset()
+		o.data.WriteString(tail)
+		o.truncated = true
+	}
+}
+
+// contents returns what's kept and whether anything was dropped.
+func (o *outputTail) contents() (string, bool) {
+	tail, truncated := truncateOutput(o.data.String())
+	return tail, o.truncated || truncated
+}
+
+func (s *Server) getFunctionMaxConcurrency() int {
+	if s.config.Functions.MaxConcurrency <= 0 {
+		return defaultFunctionMaxConcurrency
+	}
+	return s.config.Functions.MaxConcurrency
+}
+
+func (s *Server) getFunctionPoolIdleTimeout() time.Duration {
+	if s.config.Functions.PoolIdleTimeoutSeconds <= 0 {
+		return defaultFunctionPoolIdleTimeout
+	}
+	return time.Duration(s.config.Functions.PoolIdleTimeoutSeconds) * time.Second
+}
+
+// getFunctionVMName returns a new name for a VM of `functionName`.
+func getFunctionVMName(functionName string) (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate VM name: %w", err)
+	}
+	return functionVMPrefix + functionName + "-" + hex.EncodeToString(suffix), nil
+}
+
+// acquireFunctionSlot counts an invocation of the function `key` against its
+// concurrency limit. The returned func must be called once it's done.
+func (s *Server) acquireFunctionSlot(tenant string, key string, functionName string) (func(), error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pool, ok := s.functions[key]
+	if !ok {
+		pool = &functionPool{tenant: tenant}
+		s.functions[key] = pool
+	}
+	maxConcurrency := s.getFunctionMaxConcurrency()
+	if pool.running >= maxConcurrency {
+		return nil, status.Errorf(codes.ResourceExhausted, "function %s is at its limit of %d concurrent invocations", functionName, maxConcurrency)
+	}
+	pool.running++
+
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		pool.running--
+		if pool.running == 0 && len(pool.idle) == 0 {
+			delete(s.functions, key)
+		}
+	}, nil
+}
+
+// claimPooledVM takes a ready VM with `layer` attached out of the pool of the
+// function `key`. Returns an empty name if there's none.
+func (s *Server) claimPooledVM(tenant string, key string, layer string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pool, ok := s.functions[key]
+	if !ok {
+		return ""
+	}
+	for i := len(pool.idle) - 1; i >= 0; i-- {
+		pooled := pool.idle[i]
+		if pooled.layer != layer {
+			continue
+		}
+		pool.idle = slices.Delete(pool.idle, i, i+1)
+		// The VM could have been destroyed or stopped through the VM API
+		// while it was pooled.
+		vm, ok := s.vms[vmKey(tenant, pooled.name)]
+		if ok && vm.status == vmStatusReady {
+			return pooled.name
+		}
+	}
+	return ""
+}
+
+// startFunctionVM boots a VM for `functionName` with the layer disk `layer`
+// attached, if set, and waits for it to be ready.
+func (s *Server) startFunctionVM(ctx context.Context, functionName string, layer string) (string, error) {
+	vmName, err := getFunctionVMName(functionName)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	req := &serverapi.StartVMRequest{
+		VmName:           serverapi.PtrString(vmName),
+		DisabledServices: []string{"node-server"},
+		Vcpus:            serverapi.PtrInt32(int32(s.config.Functions.Vcpus)),
+		MemoryMb:         serverapi.PtrInt32(int32(s.config.Functions.MemoryMB)),
+		// Pooled VMs are reclaimed by `reapIdleFunctionVMs` instead.
+		TtlSeconds:         serverapi.PtrInt32(-1),
+		IdleTimeoutSeconds: serverapi.PtrInt32(-1),
+	}
+	if layer != "" {
+		req.UserData = serverapi.PtrString(layerCloudConfig)
+	}
+	spec, err := s.getVMSpec(req)
+	if err != nil {
+		return "", err
+	}
+	if layer != "" {
+		// Added after validation as layer disks aren't in the allowed disk
+		// dirs.
+		spec.disks = append(spec.disks, diskSpec{path: layer, readOnly: true})
+	}
+
+	_, err = s.startVM(ctx, vmName, spec, true, defaultBootTimeout)
+	if err != nil {
+		return "", err
+	}
+	return vmName, nil
+}
+
+// recycleFunctionVM returns `vmName` with `layer` attached to the pool of the
+// function `key` if it has room, otherwise destroys it.
+func (s *Server) recycleFunctionVM(tenant string, key string, vmName string, layer string, reuse bool) {
+	s.lock.Lock()
+	pool, ok := s.functions[key]
+	if reuse && ok && len(pool.idle) < s.config.Functions.PoolSize {
+		pool.idle = append(pool.idle, pooledVM{name: vmName, layer: layer, lastUsed: time.Now()})
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	// Destroying the VM shouldn't hold up the response.
+	go func() {
+		err := s.destroyVM(context.Background(), vmKey(tenant, vmName))
+		if err != nil {
+			log.WithError(err).WithField("vmname", vmName).Warn("failed to destroy function VM")
+		}
+	}()
+}
+
+// drainFunctionPool destroys the pooled VMs of `functionName` with a layer
+// disk under `dir`, or all of them if `all` is set.
+func (s *Server) drainFunctionPool(tenant string, functionName string, dir string, all bool) {
+	s.lock.Lock()
+	var keys []string
+	if pool, ok := s.functions[vmKey(tenant, functionName)]; ok {
+		pool.idle = slices.DeleteFunc(pool.idle, func(pooled pooledVM) bool {
+			drain := all || (pooled.layer != "" && strings.HasPrefix(pooled.layer, dir+"/"))
+			if drain {
+				keys = append(keys, vmKey(tenant, pooled.name))
+			}
+			return drain
+		})
+	}
+	s.lock.Unlock()
+
+	for _, key := range keys {
+		err := s.destroyVM(context.Background(), key)
+		if err != nil {
+			log.WithError(err).WithField("vmKey", key).Warn("failed to destroy pooled function VM")
+		}
+	}
+}
+
+// reapIdleFunctionVMs destroys pooled VMs that haven't been used for the pool
+// idle timeout.
+func (s *Server) reapIdleFunctionVMs() {
+	idleTimeout := s.getFunctionPoolIdleTimeout()
+	now := time.Now()
+
+	s.lock.Lock()
+	var keys []string
+	for key, pool := range s.functions {
+		var idle []pooledVM
+		for _, pooled := range pool.idle {
+			if now.Sub(pooled.lastUsed) < idleTimeout {
+				idle = append(idle, pooled)
+				continue
+			}
+			keys = append(keys, vmKey(pool.tenant, pooled.name))
+		}
+		pool.idle = idle
+		if pool.running == 0 && len(pool.idle) == 0 {
+			delete(s.functions, key)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, key := range keys {
+		log.WithField("vmKey", key).Info("destroying idle function VM")
+		err := s.destroyVM(context.Background(), key)
+		if err != nil {
+			log.WithError(err).WithField("vmKey", key).Warn("failed to destroy idle function VM")
+		}
+	}
+}
+
+// InvokeFunction runs the code in `req`, or else the registered bundle of
+// `functionName`, in a VM of the function and returns its result once it
+// exits. The VM comes from the function's pool unless there's none or a fresh
+// one is asked for. Only VMs that ran the registered bundle are pooled as
+// ad-hoc code could leave anything behind for later invocations.
+func (s *Server) InvokeFunction(ctx context.Context, functionName string, req *serverapi.InvokeFunctionRequest) (*serverapi.InvokeFunctionResponse, error) {
+	tenant := tenantFromContext(ctx)
+	logger := log.WithFields(log.Fields{"function": functionName, "tenant": tenant})
+	logger.Info("received request to invoke function")
+	startedAt := time.Now()
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if !functionNameRegexp.MatchString(functionName) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid function name: %q", functionName)
+	}
+	lang := req.GetLang()
+	files := req.GetFiles()
+	entryPoint := req.GetEntryPoint()
+	dependencies := req.GetDependencies()
+	dependenciesDir := ""
+	layer := ""
+	registered := len(files) == 0 && entryPoint == ""
+	if registered {
+		fn, _, err := s.loadFunctionVersion(tenant, functionName, int(req.GetVersion()))
+		if err != nil {
+			return nil, err
+		}
+		files, err = fn.readCode()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		lang = fn.Lang
+		entryPoint = fn.Handler
+		dependencies = fn.Dependencies
+		if fn.usesLayer() {
+			layer = fn.layerPath()
+			dependencies = nil
+			dependenciesDir = guestLayerMountDir + "/python"
+		}
+		logger = logger.WithField("version", fn.Version)
+	} else if entryPoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "entry point is required")
+	}
+
+	var stdin string
+	if req.HasInput() {
+		input, err := json.Marshal(req.GetInput())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid input: %v", err)
+		}
+		stdin = string(input)
+	}
+
+	// Keyed like VMs so that functions are only shared within a tenant.
+	key := vmKey(tenant, functionName)
+	release, err := s.acquireFunctionSlot(tenant, key, functionName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	fresh := req.GetFresh() || s.config.Functions.PoolSize <= 0 || !registered
+	vmName := ""
+	if !fresh {
+		vmName = s.claimPooledVM(tenant, key, layer)
+	}
+	coldStart := vmName == ""
+	if coldStart {
+		vmName, err = s.startFunctionVM(ctx, functionName, layer)
+		if err != nil {
+			logger.WithError(err).Error("failed to start function VM")
+			return nil, err
+		}
+	}
+	logger = logger.WithField("vmname", vmName)
+
+	// Don't wait forever on a guest that doesn't enforce the timeout.
+	execCtx := ctx
+	if req.GetTimeoutSeconds() > 0 {
+		var cancel context.CancelFunc
+		timeout := time.Duration(req.GetTimeoutSeconds())*time.Second + functionTimeoutGracePeriod
+		execCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, err := s.postToGuest(execCtx, vmName, s.getCodeServerPort(), "/execute", guestExecuteRequest{
+		Lang:            lang,
+		Files:           files,
+		EntryPoint:      entryPoint,
+		Dependencies:    dependencies,
+		DependenciesDir: dependenciesDir,
+		Timeout:         req.GetTimeoutSeconds(),
+		Stdin:           stdin,
+		Stream:          true,
+	})
+	if err != nil {
+		// The VM is in an unknown state so it isn't reused.
+		s.recycleFunctionVM(tenant, key, vmName, layer, false)
+		logger.WithError(err).Error("failed to invoke function")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var stdout, stderr outputTail
+	result, err := execstream.Read(resp.Body, func(chunk execstream.Chunk) {
+		if chunk.Stream == execstream.StreamStderr {
+			stderr.write(chunk.Data)
+		} else {
+			stdout.write(chunk.Data)
+		}
+	})
+	if err != nil {
+		s.recycleFunctionVM(tenant, key, vmName, layer, false)
+		logger.WithError(err).Error("failed to read function output")
+		return nil, status.Errorf(codes.Unavailable, "failed to read output: %v", err)
+	}
+	// A timed out process may have left things behind in the VM.
+	s.recycleFunctionVM(tenant, key, vmName, layer, !fresh && result.Status != execstream.StatusTimeout)
+
+	exitCode := -1
+	if result.ExitCode != nil {
+		exitCode = *result.ExitCode
+	}
+	logger.Infof("function exited with status: %s and code: %d", result.Status, exitCode)
+
+	response := &serverapi.InvokeFunctionResponse{
+		FunctionName: serverapi.PtrString(functionName),
+		VmName:       serverapi.PtrString(vmName),
+		ColdStart:    serverapi.PtrBool(coldStart),
+		Status:       serverapi.PtrString(result.Status),
+		ExitCode:     serverapi.PtrInt32(int32(exitCode)),
+		Error:        serverapi.PtrString(result.Error),
+		DurationMs:   serverapi.PtrInt64(time.Since(startedAt).Milliseconds()),
+	}
+	stdoutTail, stdoutTruncated := stdout.contents()
+	stderrTail, stderrTruncated := stderr.contents()
+	response.Stdout = serverapi.PtrString(stdoutTail)
+	response.StdoutTruncated = serverapi.PtrBool(stdoutTruncated)
+	response.Stderr = serverapi.PtrString(stderrTail)
+	response.StderrTruncated = serverapi.PtrBool(stderrTruncated)
+	return response, nil
+}
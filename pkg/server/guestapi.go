@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultGuestApiPort = "7001"
+)
+
+// getGuestApiPort returns the port on which the host serves the guest API.
+func (s *Server) getGuestApiPort() string {
+	if s.config.GuestApiPort == "" {
+		return defaultGuestApiPort
+	}
+	return s.config.GuestApiPort
+}
+
+// startGuestApiServer starts the HTTP server that guests use to call back into
+// the host. It only listens on the bridge IP so that it's not reachable from
+// outside the host.
+func (s *Server) startGuestApiServer() error {
+	bridgeIP, _, err := net.ParseCIDR(s.config.BridgeIP)
+	if err != nil {
+		return fmt.Errorf("failed to parse bridge ip: %v: %w", s.config.BridgeIP, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/ready", s.guestReadyRoute)
+	mux.HandleFunc("POST /v1/exit", s.guestExitRoute)
+	mux.HandleFunc("GET /v1/metadata", s.guestMetadataRoute)
+	mux.HandleFunc("POST /v1/secrets/ack", s.guestSecretsAckRoute)
+
+	addr := net.JoinHostPort(bridgeIP.String(), s.getGuestApiPort())
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on: %s: %w", addr, err)
+	}
+
+	go func() {
+		log.Infof("guest api server listening on: %s", addr)
+		if err := http.Serve(listener, mux); err != nil {
+			log.WithError(err).Errorf("guest api server exited")
+		}
+	}()
+	return nil
+}
+
+// newGuestToken returns a token for a guest to authenticate to the guest API
+// with. It's passed to the guest on its kernel command line.
+func newGuestToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate guest token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// vmFromGuestRequest returns the VM that sent `r`. Guests are identified by
+// their token as any guest on the bridge can send requests from the IP of
+// another. The source IP has to match too so that a leaked token is only
+// usable by the guest with its IP.
+//
+// Must be called with `s.lock` held.
+func (s *Server) vmFromGuestRequest(r *http.Request) (*vm, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse remote addr: %v: %w", r.RemoteAddr, err)
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("no guest token from: %s", host)
+	}
+
+	// A VM being restarted keeps its entry until its replacement is created,
+	// by which time its IP may have been given to another VM.
+	for _, vm := range s.vms {
+		if vm.ip == nil || vm.ip.IP.String() != host {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(vm.guestToken), []byte(token)) == 1 {
+			return vm, nil
+		}
+	}
+	return nil, fmt.Errorf("no vm found with ip: %s and its token", host)
+}
+
+func (s *Server) guestReadyRoute(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	vm, err := s.vmFromGuestRequest(r)
+	if err != nil {
+		log.WithError(err).Warn("ready signal from unknown guest")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.WithField("vmname", vm.name).Info("guest is ready")
+	// The guest fetched its metadata before signalling readiness, even if
+	// acknowledging its secrets failed.
+	vm.secretsFetched = true
+	if vm.status == vmStatusRunning {
+		s.publishEvent(vm, EventReady, "")
+	}
+	vm.markReady()
+	w.WriteHeader(http.StatusNoContent)
+}
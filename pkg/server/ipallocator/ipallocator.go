@@ -71,6 +71,29 @@ func (a *IPAllocator) AllocateIP() (*net.IPNet, error) {
 	}, nil
 }
 
+// ReserveIP allocates a specific IP e.g. for a VM that migrated in with its IP
+// already configured in the guest.
+func (a *IPAllocator) ReserveIP(ip net.IP) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.subnet.Contains(ip) {
+		return nil, fmt.Errorf("IP %v is not in the subnet", ip)
+	}
+
+	for i, availableIP := range a.available {
+		if availableIP.Equal(ip) {
+			a.available = append(a.available[:i], a.available[i+1:]...)
+			a.allocated[availableIP.String()] = true
+			return &net.IPNet{
+				IP:   availableIP,
+				Mask: a.subnet.Mask,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("IP %v is not available", ip)
+}
+
 func (a *IPAllocator) FreeIP(ip net.IP) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
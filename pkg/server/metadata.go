@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// guestMetadata is what guestinit configures the guest with at boot. The
+// kernel command line only carries what's needed to reach the guest API that
+// serves it.
+type guestMetadata struct {
+	VMName     string                 `json:"vmName"`
+	Hostname   string                 `json:"hostname"`
+	Network    guestNetworkMetadata   `json:"network"`
+	EntryPoint *guestEntryPointConfig `json:"entryPoint,omitempty"`
+	SSHKeys    []string               `json:"sshKeys,omitempty"`
+	UserData   string                 `json:"userData,omitempty"`
+	// Names of guest services guestinit doesn't start.
+	DisabledServices []string `json:"disabledServices,omitempty"`
+}
+
+type guestNetworkMetadata struct {
+	// CIDR of the guest.
+	Address     string   `json:"address"`
+	Gateway     string   `json:"gateway"`
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// guestEntryPointConfig is how guestinit starts the entry point.
+type guestEntryPointConfig struct {
+	Args       []string          `json:"args,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Secrets    map[string]string `json:"secrets,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	User       string            `json:"user,omitempty"`
+}
+
+// hostnameFromVMName returns a hostname derived from `vmName` for VMs that
+// don't set one.
+func hostnameFromVMName(vmName string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(vmName) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	hostname := b.String()
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	hostname = strings.Trim(hostname, "-")
+	if hostname == "" {
+		return "vm"
+	}
+	return hostname
+}
+
+// getEntryPointConfig returns the entry point config of `vm`. Its secrets are
+// only returned until the guest acknowledges that it received them after every
+// boot.
+//
+// Must be called with `s.lock` held.
+func (s *Server) getEntryPointConfig(vm *vm) *guestEntryPointConfig {
+	config := &guestEntryPointConfig{
+		Args:       vm.spec.args,
+		Env:        vm.spec.env,
+		WorkingDir: vm.spec.workingDir,
+		User:       vm.spec.user,
+	}
+	if !vm.secretsFetched {
+		config.Secrets = vm.spec.secrets
+	} else if len(vm.spec.secrets) > 0 {
+		log.WithField("vmname", vm.name).Warn("secrets were already acknowledged since the VM booted, not returning them again")
+	}
+	return config
+}
+
+// getGuestMetadata returns the metadata of `vm`.
+//
+// Must be called with `s.lock` held.
+func (s *Server) getGuestMetadata(vm *vm) guestMetadata {
+	hostname := vm.spec.hostname
+	if hostname == "" {
+		hostname = hostnameFromVMName(vm.name)
+	}
+
+	gateway := s.config.BridgeIP
+	if ip, _, err := net.ParseCIDR(s.config.BridgeIP); err == nil {
+		gateway = ip.String()
+	}
+
+	metadata := guestMetadata{
+		VMName:   vm.name,
+		Hostname: hostname,
+		Network: guestNetworkMetadata{
+			Address:     vm.ip.String(),
+			Gateway:     gateway,
+			Nameservers: s.config.GuestNameservers,
+		},
+		SSHKeys:          vm.spec.sshKeys,
+		UserData:         vm.spec.userData,
+		DisabledServices: vm.spec.disabledServices,
+	}
+	if len(vm.spec.args) > 0 {
+		metadata.EntryPoint = s.getEntryPointConfig(vm)
+	}
+	return metadata
+}
+
+func (s *Server) guestMetadataRoute(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	vm, err := s.vmFromGuestRequest(r)
+	if err != nil {
+		s.lock.Unlock()
+		log.WithError(err).Warn("metadata request from unknown guest")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	metadata := s.getGuestMetadata(vm)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// guestSecretsAckRoute is called by the guest once it received its metadata,
+// after which its secrets aren't handed out again until it's booted again.
+func (s *Server) guestSecretsAckRoute(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	vm, err := s.vmFromGuestRequest(r)
+	if err != nil {
+		log.WithError(err).Warn("secrets ack from unknown guest")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	vm.secretsFetched = true
+	w.WriteHeader(http.StatusNoContent)
+}
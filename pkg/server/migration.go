@@ -0,0 +1,526 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/chvapi"
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+)
+
+const (
+	migrationTimeout = 10 * time.Minute
+	// The destination VMM starts listening for the migration asynchronously, so
+	// the source retries connecting to it.
+	migrationConnectAttempts = 10
+	migrationConnectInterval = 500 * time.Millisecond
+)
+
+// parseDestination returns the base URL and the host:port of the server at
+// `destination`, which is either host:port or a http(s) URL.
+func parseDestination(destination string) (string, string, error) {
+	if !strings.Contains(destination, "://") {
+		destination = "http://" + destination
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	_, _, err = net.SplitHostPort(u.Host)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Scheme + "://" + u.Host, u.Host, nil
+}
+
+// createDestinationApiClient returns a client for the server at `baseURL`.
+// `token` is sent as a bearer token if set.
+func createDestinationApiClient(baseURL string, token string) *serverapi.APIClient {
+	configuration := serverapi.NewConfiguration()
+	configuration.Servers = serverapi.ServerConfigurations{
+		{
+			URL: baseURL,
+		},
+	}
+	if token != "" {
+		configuration.AddDefaultHeader("Authorization", "Bearer "+token)
+	}
+	return serverapi.NewAPIClient(configuration)
+}
+
+// MigrationPeer is the connection a migration was requested over. The VMM
+// receiving the migration only listens on `LocalIP` and only accepts
+// connections from `RemoteIP`, the source server.
+type MigrationPeer struct {
+	LocalIP  net.IP
+	RemoteIP net.IP
+}
+
+// getFreePort returns a TCP port that's free on `ip`.
+func getFreePort(ip net.IP) (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// MigrateVM live migrates a running VM to the server at `destination`. The
+// guest keeps its IP, so the destination has to serve the same bridge subnet
+// and gateway, and the VM's kernel and rootfs have to be at the same paths on
+// it. The VM is only cleaned up here once the migration succeeds.
+func (s *Server) MigrateVM(ctx context.Context, vmName string, req *serverapi.MigrateVMRequest) (*serverapi.VMResponse, error) {
+	logger := log.WithFields(log.Fields{"vmName": vmName, "destination": req.GetDestination()})
+	logger.Infof("received request to migrate VM")
+
+	destination := req.GetDestination()
+	destinationURL, destinationAddr, err := parseDestination(destination)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid destination: %v: %v", destination, err)
+	}
+	destinationHost, _, _ := net.SplitHostPort(destinationAddr)
+
+	s.lock.Lock()
+	vm, exists := s.vms[vmKey(tenantFromContext(ctx), vmName)]
+	if !exists {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	previousStatus := vm.status
+	if previousStatus != vmStatusRunning && previousStatus != vmStatusReady {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s can't be migrated in state: %v", vmName, previousStatus)
+	}
+	vm.status = vmStatusMigrating
+	ready := isClosed(vm.readyCh)
+	s.lock.Unlock()
+
+	startVMRequest := vm.spec.toStartVMRequest(vmName)
+	receiveReq := serverapi.ReceiveMigrationRequest{
+		Spec:       &startVMRequest,
+		Tenant:     serverapi.PtrString(vm.tenant),
+		Ip:         serverapi.PtrString(vm.ip.String()),
+		Ready:      serverapi.PtrBool(ready),
+		GuestToken: serverapi.PtrString(vm.guestToken),
+	}
+
+	destinationClient := createDestinationApiClient(destinationURL, s.config.Auth.PeerToken)
+	receiveResp, httpResp, err := destinationClient.DefaultAPI.
+		VmReceiveMigrationPost(ctx).
+		ReceiveMigrationRequest(receiveReq).Execute()
+	if err != nil {
+		s.abortMigration(vm, previousStatus)
+		msg := err.Error()
+		if httpResp != nil {
+			body, _ := io.ReadAll(httpResp.Body)
+			msg = string(body)
+		}
+		return nil, status.Errorf(codes.Unavailable, "destination failed to prepare for migration: %s", msg)
+	}
+
+	destinationUrl := fmt.Sprintf("tcp:%s", net.JoinHostPort(destinationHost, fmt.Sprint(receiveResp.GetMigrationPort())))
+	logger.Infof("sending VM to: %s", destinationUrl)
+	err = sendMigration(vm, destinationUrl)
+	if err != nil {
+		s.abortMigration(vm, previousStatus)
+		// The destination VMM is only waiting for this VM so get rid of it.
+		abortReq := serverapi.AbortMigrationRequest{
+			VmName: serverapi.PtrString(vmName),
+			Tenant: serverapi.PtrString(vm.tenant),
+		}
+		_, _, abortErr := destinationClient.DefaultAPI.VmAbortMigrationPost(context.Background()).AbortMigrationRequest(abortReq).Execute()
+		if abortErr != nil {
+			logger.Warnf("failed to abort the migration on the destination: %v", abortErr)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to migrate VM: %v", err)
+	}
+
+	s.lock.Lock()
+	if !isClosed(vm.stopSupervisorCh) {
+		close(vm.stopSupervisorCh)
+	}
+	if s.vms[vm.key()] == vm {
+		delete(s.vms, vm.key())
+	}
+	s.lock.Unlock()
+	s.teardownVM(context.Background(), vm)
+	s.releasePorts(vm.key(), vm.spec.ports)
+	s.releaseResources(vm.tenant, specUsage(vm.spec))
+	s.publishEvent(vm, EventMigrated, fmt.Sprintf("migrated to: %s", destination))
+
+	logger.Infof("VM migrated")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+// sendMigration sends `vm` to the VMM listening at `destinationUrl` and
+// returns once the migration has finished.
+func sendMigration(vm *vm, destinationUrl string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	apiClient := createApiClientWithTimeout(vm.apiSocketPath, migrationTimeout)
+	sendMigrationData := chvapi.SendMigrationData{
+		DestinationUrl: destinationUrl,
+	}
+
+	var err error
+	for attempt := 1; attempt <= migrationConnectAttempts; attempt++ {
+		var resp *http.Response
+		resp, err = apiClient.DefaultAPI.VmSendMigrationPut(ctx).SendMigrationData(sendMigrationData).Execute()
+		if err == nil && resp.StatusCode >= 300 {
+			err = fmt.Errorf("bad status: %v", resp)
+		}
+		if err == nil || vm.waiter.exited() {
+			return err
+		}
+
+		log.WithField("vmname", vm.name).Warnf("failed to send migration (%d/%d): %v", attempt, migrationConnectAttempts, err)
+		time.Sleep(migrationConnectInterval)
+	}
+	return err
+}
+
+// migrationFirewallRule returns the iptables arguments that `action` e.g. "-I"
+// or "-D" the rule dropping connections to the migration port `port` from
+// anywhere but `sourceIP`.
+func migrationFirewallRule(action string, port int, sourceIP net.IP) []string {
+	return []string{
+		action, "INPUT",
+		"-p", "tcp",
+		"--dport", fmt.Sprint(port),
+		"!", "-s", sourceIP.String(),
+		"-j", "DROP",
+	}
+}
+
+// abortMigration puts `vm` back the way it was before a failed migration. If
+// its VMM died during the migration it's treated as a crash.
+func (s *Server) abortMigration(vm *vm, previousStatus vmStatus) {
+	s.lock.Lock()
+	// A VM destroyed during the migration is already torn down.
+	if vm.status != vmStatusMigrating || isClosed(vm.stopSupervisorCh) {
+		s.lock.Unlock()
+		return
+	}
+
+	if !vm.waiter.exited() {
+		vm.status = previousStatus
+		s.lock.Unlock()
+		return
+	}
+	vm.status = vmStatusCrashed
+	s.lock.Unlock()
+	s.publishEvent(vm, EventCrashed, "VMM process exited during migration")
+
+	log.WithField("vmname", vm.name).Warn("VMM process exited during migration")
+	go s.maybeRestartVM(vm, true)
+}
+
+// ReceiveMigration prepares this server to receive a VM migrated by
+// `MigrateVM` on another server. It spawns a VMM listening for the migration
+// and returns the port it listens on. The VM is tracked as migrating till the
+// migration finishes and cleaned up if it fails. The VM keeps the tenant it
+// had on the source, so callers must be allowed to act for any tenant. Only
+// the source server in `peer` can connect to the migration port.
+func (s *Server) ReceiveMigration(ctx context.Context, req *serverapi.ReceiveMigrationRequest, peer MigrationPeer) (*serverapi.ReceiveMigrationResponse, error) {
+	startVMRequest := req.GetSpec()
+	vmName := startVMRequest.GetVmName()
+	tenant := req.GetTenant()
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	key := vmKey(tenant, vmName)
+	logger := log.WithFields(log.Fields{"vmName": vmName, "tenant": tenant})
+	logger.Infof("received request to receive migration")
+
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty vm name")
+	}
+
+	if peer.LocalIP == nil || peer.RemoteIP == nil {
+		return nil, status.Error(codes.FailedPrecondition, "migrations must be requested over TCP")
+	}
+
+	// The guest keeps the token it booted with.
+	if req.GetGuestToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty guest token")
+	}
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := s.getVMSpec(&startVMRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, _, err := net.ParseCIDR(req.GetIp())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ip: %v: %v", req.GetIp(), err)
+	}
+
+	s.lock.Lock()
+	_, exists := s.vms[key]
+	_, starting := s.starting[key]
+	s.lock.Unlock()
+	if exists || starting {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+
+	cleanup := cleanup.Make(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "ReceiveMigration"}).Info("done")
+	})
+
+	defer func() {
+		// Won't do anything if no error since we call `Release` it at the end.
+		cleanup.Clean()
+	}()
+
+	err = s.reserveResources(tenant, specUsage(spec))
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		s.releaseResources(tenant, specUsage(spec))
+	})
+
+	err = s.reservePorts(key, spec.ports)
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Add(func() {
+		s.releasePorts(key, spec.ports)
+	})
+
+	// The tap device's name is part of the migrated VM config.
+	tapDevice, previousBridge, err := s.fountain.AdoptTapDevice(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to adopt tap device: %v", err)
+	}
+	cleanup.Add(func() {
+		var err error
+		if previousBridge != "" {
+			err = s.fountain.MoveTapDevice(key, previousBridge)
+		} else {
+			err = s.fountain.DestroyTapDevice(key)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("failed to release tap device: %s", tapDevice)
+		}
+	})
+
+	vm, err := s.launchVMM(ctx, tenant, vmName, &cleanup)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The migrated VM config refers to the config drive in the state dir,
+	// which is the same on both hosts if they're configured alike.
+	if spec.needsConfigDrive() {
+		_, err = buildConfigDrive(vm.stateDirPath, tenant, vmName, spec)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	guestIP, err := s.ipAllocator.ReserveIP(ip)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to reserve guest ip: %v", err)
+	}
+	cleanup.Add(func() {
+		s.ipAllocator.FreeIP(guestIP.IP)
+	})
+
+	err = isolateGuestServices(guestIP.IP.String(), s.guestServicePorts())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	cleanup.Add(func() {
+		removeGuestServiceIsolation(guestIP.IP.String(), s.guestServicePorts())
+	})
+
+	// Forward port on the host to the codeserver.
+	err = forwardPortToCodeServerInVM(s.config.BridgeName, guestIP.IP.String(), s.config.CodeServerPort)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to forward port in the code server: %v", err)
+	}
+	cleanup.Add(func() {
+		removeCodeServerPortForward(s.config.BridgeName, guestIP.IP.String(), s.config.CodeServerPort)
+	})
+
+	err = addPortForwards(s.config.BridgeName, guestIP.IP.String(), spec.ports)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	cleanup.Add(func() {
+		removePortForwards(s.config.BridgeName, guestIP.IP.String(), spec.ports)
+	})
+
+	migrationPort, err := getFreePort(peer.LocalIP)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Installed before the VMM listens so that there's no window in which
+	// anyone else can connect. Another process taking the port in the
+	// meantime only fails the migration.
+	err = exec.Command("iptables", migrationFirewallRule("-I", migrationPort, peer.RemoteIP)...).Run()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to restrict migration port: %v", err)
+	}
+	removeFirewallRule := func() {
+		err := exec.Command("iptables", migrationFirewallRule("-D", migrationPort, peer.RemoteIP)...).Run()
+		if err != nil {
+			logger.Warnf("failed to remove migration port firewall rule: %v", err)
+		}
+	}
+	cleanup.Add(removeFirewallRule)
+
+	receiveCtx, cancelReceive := context.WithTimeout(context.Background(), migrationTimeout)
+	cleanup.Add(cancelReceive)
+
+	vm.spec = spec
+	vm.ip = guestIP
+	vm.guestToken = req.GetGuestToken()
+	vm.tapDevice = tapDevice
+	vm.status = vmStatusMigrating
+	vm.cancelReceive = cancelReceive
+
+	s.lock.Lock()
+	_, exists = s.vms[key]
+	_, starting = s.starting[key]
+	if exists || starting {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	s.vms[key] = vm
+	s.lock.Unlock()
+	cleanup.Add(func() {
+		s.lock.Lock()
+		if s.vms[key] == vm {
+			delete(s.vms, key)
+		}
+		s.lock.Unlock()
+	})
+
+	// The firewall rule is only needed till the migration finishes, whether
+	// it succeeds or not.
+	undo := cleanup.Release()
+	go func() {
+		s.receiveMigration(receiveCtx, vm, peer.LocalIP, migrationPort, req.GetReady(), undo)
+		cancelReceive()
+		removeFirewallRule()
+	}()
+	return &serverapi.ReceiveMigrationResponse{
+		MigrationPort: serverapi.PtrInt32(int32(migrationPort)),
+	}, nil
+}
+
+// receiveMigration waits for the migration of `vm` on `listenIP`:`migrationPort`
+// to finish and starts supervising it. The migration fails once `ctx` is done.
+// `undo` cleans up everything `ReceiveMigration` set up and is called if the
+// migration fails.
+func (s *Server) receiveMigration(ctx context.Context, vm *vm, listenIP net.IP, migrationPort int, ready bool, undo func()) {
+	logger := log.WithFields(log.Fields{"vmname": vm.name, "migrationPort": migrationPort})
+
+	apiClient := createApiClientWithTimeout(vm.apiSocketPath, migrationTimeout)
+	receiveMigrationData := chvapi.ReceiveMigrationData{
+		ReceiverUrl: "tcp:" + net.JoinHostPort(listenIP.String(), fmt.Sprint(migrationPort)),
+	}
+	resp, err := apiClient.DefaultAPI.VmReceiveMigrationPut(ctx).ReceiveMigrationData(receiveMigrationData).Execute()
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("bad status: %v", resp)
+	}
+
+	s.lock.Lock()
+	vm.cancelReceive = nil
+	// The VM was destroyed while it was migrating, which also tore it down.
+	destroyed := isClosed(vm.stopSupervisorCh)
+	if err != nil && !destroyed {
+		close(vm.stopSupervisorCh)
+	}
+	if err == nil && !destroyed {
+		vm.status = vmStatusRunning
+		if ready {
+			vm.markReady()
+		}
+		vm.lastActivity = time.Now()
+		// The guest fetched its secrets when it booted on the source.
+		vm.secretsFetched = true
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		logger.WithError(err).Error("failed to receive migration")
+		if !destroyed {
+			undo()
+		}
+		return
+	}
+
+	if destroyed {
+		return
+	}
+	logger.Info("received migrated VM")
+	s.publishEvent(vm, EventCreated, "received migrated VM")
+	go s.superviseVM(vm)
+}
+
+// AbortMigration aborts receiving a VM whose migration failed on the source,
+// which is called by the source. The VMM waiting for the migration is killed
+// and everything `ReceiveMigration` set up is cleaned up. Like
+// `ReceiveMigration` it acts for the tenant in `req`.
+func (s *Server) AbortMigration(ctx context.Context, req *serverapi.AbortMigrationRequest) (*serverapi.VMResponse, error) {
+	vmName := req.GetVmName()
+	tenant := req.GetTenant()
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	logger := log.WithFields(log.Fields{"vmName": vmName, "tenant": tenant})
+	logger.Infof("received request to abort migration")
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	vm, exists := s.vms[vmKey(tenant, vmName)]
+	if !exists {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	cancelReceive := vm.cancelReceive
+	s.lock.Unlock()
+	if cancelReceive == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s isn't being received by a migration", vmName)
+	}
+
+	cancelReceive()
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+const (
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+// portForward forwards a port on the host to a port in the guest.
+type portForward struct {
+	hostPort  int
+	guestPort int
+	// `protocolTCP` or `protocolUDP`.
+	protocol string
+}
+
+// key identifies the host port of `p`, which only one VM can use at a time.
+func (p portForward) key() string {
+	return fmt.Sprintf("%s/%d", p.protocol, p.hostPort)
+}
+
+func (p portForward) String() string {
+	return fmt.Sprintf("%s/%d->%d", p.protocol, p.hostPort, p.guestPort)
+}
+
+func validPort(port int32) bool {
+	return port > 0 && port <= 65535
+}
+
+// parsePortForwards validates the port forwards of a start request.
+func (s *Server) parsePortForwards(ports []serverapi.PortForward) ([]portForward, error) {
+	// The server's own ports can't be forwarded to guests.
+	reservedPorts := map[string]bool{}
+	for _, port := range []string{s.config.Port, s.config.GRPCPort, s.getCodeServerPort()} {
+		if port != "" {
+			reservedPorts[port] = true
+		}
+	}
+
+	var result []portForward
+	seen := make(map[string]bool)
+	for _, port := range ports {
+		if !validPort(port.GetHostPort()) || !validPort(port.GetGuestPort()) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid port forward: %d->%d", port.GetHostPort(), port.GetGuestPort())
+		}
+
+		protocol := port.GetProtocol()
+		if protocol == "" {
+			protocol = protocolTCP
+		}
+		if protocol != protocolTCP && protocol != protocolUDP {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid port forward protocol: %s", protocol)
+		}
+
+		forward := portForward{
+			hostPort:  int(port.GetHostPort()),
+			guestPort: int(port.GetGuestPort()),
+			protocol:  protocol,
+		}
+		if reservedPorts[strconv.Itoa(forward.hostPort)] {
+			return nil, status.Errorf(codes.InvalidArgument, "host port %d is used by the server", forward.hostPort)
+		}
+		if seen[forward.key()] {
+			return nil, status.Errorf(codes.InvalidArgument, "host port %s is forwarded more than once", forward.key())
+		}
+		seen[forward.key()] = true
+		result = append(result, forward)
+	}
+	return result, nil
+}
+
+// reservePorts claims the host ports of `ports` for the VM with key `key`. They
+// must be released with `releasePorts` once the VM is gone.
+func (s *Server) reservePorts(key string, ports []portForward) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.checkPorts(key, ports)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		s.hostPorts[port.key()] = key
+	}
+	return nil
+}
+
+// checkPorts fails if any of `ports` is used by a VM other than VM `key`.
+//
+// Must be called with `s.lock` held.
+func (s *Server) checkPorts(key string, ports []portForward) error {
+	for _, port := range ports {
+		if owner, ok := s.hostPorts[port.key()]; ok && owner != key {
+			return status.Errorf(codes.AlreadyExists, "host port %s is used by another VM", port.key())
+		}
+	}
+	return nil
+}
+
+func (s *Server) releasePorts(key string, ports []portForward) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, port := range ports {
+		if s.hostPorts[port.key()] == key {
+			delete(s.hostPorts, port.key())
+		}
+	}
+}
+
+// portForwardRule returns the iptables arguments that `action` e.g. "-A" or
+// "-D" the DNAT rule of `port`. Only connections to the host's own addresses
+// from outside the bridge are forwarded so that guests can still reach the
+// same port elsewhere.
+func portForwardRule(action string, bridgeName string, guestIP string, port portForward) []string {
+	return []string{
+		"-t", "nat", action, "PREROUTING",
+		"-m", "addrtype", "--dst-type", "LOCAL",
+		"!", "-i", bridgeName,
+		"-p", port.protocol,
+		"--dport", strconv.Itoa(port.hostPort),
+		"-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%d", guestIP, port.guestPort),
+	}
+}
+
+// addPortForwards installs the DNAT rules of `ports`. Rules installed before a
+// failure are removed.
+func addPortForwards(bridgeName string, guestIP string, ports []portForward) error {
+	for i, port := range ports {
+		err := exec.Command("iptables", portForwardRule("-A", bridgeName, guestIP, port)...).Run()
+		if err != nil {
+			removePortForwards(bridgeName, guestIP, ports[:i])
+			return fmt.Errorf("failed to forward port: %v: %w", port, err)
+		}
+	}
+	return nil
+}
+
+// removePortForwards is best effort so that a missing rule doesn't keep the
+// others from being removed.
+func removePortForwards(bridgeName string, guestIP string, ports []portForward) {
+	for _, port := range ports {
+		err := exec.Command("iptables", portForwardRule("-D", bridgeName, guestIP, port)...).Run()
+		if err != nil {
+			log.Warnf("failed to remove port forward: %v to: %s: %v", port, guestIP, err)
+		}
+	}
+}
+
+// forwardedConnectionCounts returns the number of connections forwarded to
+// each guest IP by the DNAT rules of the code server and port forwards. Only
+// the first packet of a connection goes through the nat table so the packet
+// counters of the rules count connections.
+func forwardedConnectionCounts() (map[string]uint64, error) {
+	output, err := exec.Command("iptables", "-t", "nat", "-L", "PREROUTING", "-n", "-v", "-x").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list port forwards: %w", err)
+	}
+
+	// Rules look like:
+	// 3 180 DNAT tcp -- !br0 * 0.0.0.0/0 0.0.0.0/0 tcp dpt:8080 to:10.20.1.2:8080
+	counts := make(map[string]uint64)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "DNAT" {
+			continue
+		}
+		packets, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, field := range fields {
+			destination, ok := strings.CutPrefix(field, "to:")
+			if !ok {
+				continue
+			}
+			guestIP, _, err := net.SplitHostPort(destination)
+			if err == nil {
+				counts[guestIP] += packets
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/chvapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultReaperInterval = 30 * time.Second
+	countersTimeout       = 5 * time.Second
+	snapshotTimeout       = 2 * time.Minute
+	// Network traffic below this many bytes between two reaper runs doesn't
+	// count as activity. This keeps health checks from keeping a VM alive.
+	idleTrafficThresholdBytes = 64 * 1024
+	// How often VMs paused on idle are checked for connections forwarded to
+	// them. Short enough for the connection to succeed once the client
+	// retransmits its SYN.
+	idleResumeInterval = 2 * time.Second
+)
+
+// expiryAction is what the reaper does with a VM whose TTL or idle timeout has
+// expired.
+type expiryAction int
+
+const (
+	expiryActionDestroy expiryAction = iota
+	// Snapshot the VM into the snapshots dir and then destroy it.
+	expiryActionSnapshot
+	// Pause the VM till there's activity on it again. Only applies to idle
+	// timeouts, VMs past their TTL are destroyed. Activity is an API call on
+	// the VM that uses its guest, like exec, file transfers, attaching its
+	// console or starting it, or a connection to its code server or forwarded
+	// ports from outside the host.
+	expiryActionPause
+)
+
+func (action expiryAction) String() string {
+	switch action {
+	case expiryActionDestroy:
+		return "destroy"
+	case expiryActionSnapshot:
+		return "snapshot"
+	case expiryActionPause:
+		return "pause"
+	default:
+		return "unknown"
+	}
+}
+
+func parseExpiryAction(action string) (expiryAction, error) {
+	switch action {
+	case "", "destroy":
+		return expiryActionDestroy, nil
+	case "snapshot":
+		return expiryActionSnapshot, nil
+	case "pause":
+		return expiryActionPause, nil
+	default:
+		return expiryActionDestroy, fmt.Errorf("unknown expiry action: %s", action)
+	}
+}
+
+// getExpiryDuration returns the TTL or idle timeout to use for a VM given the
+// value in its request and the server default. 0 means use the default and a
+// negative value disables it.
+func getExpiryDuration(requestSeconds int32, defaultSeconds int) time.Duration {
+	if requestSeconds < 0 {
+		return 0
+	}
+
+	if requestSeconds == 0 {
+		return time.Duration(defaultSeconds) * time.Second
+	}
+	return time.Duration(requestSeconds) * time.Second
+}
+
+func getSnapshotsDirPath(stateDir string) string {
+	return path.Join(stateDir, "snapshots")
+}
+
+// TouchVM records activity on a VM, resetting its idle timeout. A VM that was
+// paused for being idle is resumed.
+func (s *Server) TouchVM(ctx context.Context, vmName string) error {
+	s.lock.Lock()
+	vm, ok := s.vms[vmKey(tenantFromContext(ctx), vmName)]
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.touchVM(ctx, vm)
+}
+
+func (s *Server) touchVM(ctx context.Context, vm *vm) error {
+	s.lock.Lock()
+	vm.lastActivity = time.Now()
+	pausedOnIdle := vm.pausedOnIdle && vm.status == vmStatusPaused
+	s.lock.Unlock()
+
+	if !pausedOnIdle {
+		return nil
+	}
+
+	log.WithField("vmname", vm.name).Info("resuming VM paused on idle")
+	return s.resumeVM(ctx, vm)
+}
+
+// resumeVMsWithConnections resumes VMs paused on idle that connections have
+// been forwarded to since they were paused. The guest can't see those
+// connections while it's paused.
+func (s *Server) resumeVMsWithConnections() {
+	s.lock.Lock()
+	var paused []*vm
+	for _, vm := range s.vms {
+		if vm.pausedOnIdle && vm.status == vmStatusPaused {
+			paused = append(paused, vm)
+		}
+	}
+	s.lock.Unlock()
+	if len(paused) == 0 {
+		return
+	}
+
+	counts, err := forwardedConnectionCounts()
+	if err != nil {
+		log.WithError(err).Warn("failed to check VMs paused on idle for connections")
+		return
+	}
+
+	for _, vm := range paused {
+		s.lock.Lock()
+		count := counts[vm.ip.IP.String()]
+		// The counters restart if the rules are recreated.
+		active := count > vm.lastForwardedConns
+		vm.lastForwardedConns = count
+		s.lock.Unlock()
+		if !active {
+			continue
+		}
+
+		err = s.touchVM(context.Background(), vm)
+		if err != nil {
+			log.WithField("vmname", vm.name).WithError(err).Error("failed to resume VM paused on idle")
+		}
+	}
+}
+
+// runReaper periodically reclaims VMs whose TTL or idle timeout has expired
+// and pooled function VMs that have been unused for too long.
+func (s *Server) runReaper() {
+	interval := defaultReaperInterval
+	if s.config.ReaperIntervalSeconds > 0 {
+		interval = time.Duration(s.config.ReaperIntervalSeconds) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	resumeTicker := time.NewTicker(idleResumeInterval)
+	defer resumeTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reapExpiredVMs()
+			s.reapIdleFunctionVMs()
+		case <-resumeTicker.C:
+			s.resumeVMsWithConnections()
+		}
+	}
+}
+
+func (s *Server) reapExpiredVMs() {
+	s.lock.Lock()
+	var vms []*vm
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	s.lock.Unlock()
+
+	for _, vm := range vms {
+		s.updateNetworkActivity(vm)
+
+		reason, ttlExpired := s.expiryReason(vm)
+		if reason == "" {
+			continue
+		}
+
+		logger := log.WithFields(log.Fields{"vmname": vm.name, "reason": reason, "action": vm.spec.expiryAction.String()})
+		logger.Info("reclaiming expired VM")
+		err := s.reclaimVM(vm, ttlExpired)
+		if err != nil {
+			logger.WithError(err).Error("failed to reclaim expired VM")
+		}
+	}
+}
+
+// expiryReason returns why `vm` has expired or an empty string if it hasn't.
+// The boolean is true if its TTL expired.
+func (s *Server) expiryReason(vm *vm) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The VM is owned by the migration till it finishes.
+	if vm.status == vmStatusMigrating {
+		return "", false
+	}
+
+	now := time.Now()
+	if vm.spec.ttl > 0 && now.Sub(vm.createdAt) > vm.spec.ttl {
+		return fmt.Sprintf("ttl of %v expired", vm.spec.ttl), true
+	}
+
+	// A VM paused on idle stays paused till there's activity.
+	if vm.status == vmStatusPaused {
+		return "", false
+	}
+
+	if vm.spec.idleTimeout > 0 && now.Sub(vm.lastActivity) > vm.spec.idleTimeout {
+		return fmt.Sprintf("idle for more than %v", vm.spec.idleTimeout), false
+	}
+	return "", false
+}
+
+// updateNetworkActivity marks `vm` as active if it has sent or received a
+// meaningful amount of traffic since the last call.
+func (s *Server) updateNetworkActivity(vm *vm) {
+	s.lock.Lock()
+	paused := vm.status == vmStatusPaused || vm.status == vmStatusMigrating
+	s.lock.Unlock()
+	if vm.waiter.exited() || paused {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), countersTimeout)
+	defer cancel()
+
+	counters, _, err := vm.apiClient.DefaultAPI.VmCountersGet(ctx).Execute()
+	if err != nil {
+		log.WithField("vmname", vm.name).Debugf("failed to get VM counters: %v", err)
+		return
+	}
+
+	netCounters, ok := counters[netDeviceId]
+	if !ok {
+		return
+	}
+	netBytes := netCounters["rx_bytes"] + netCounters["tx_bytes"]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if netBytes-vm.lastNetBytes > idleTrafficThresholdBytes {
+		vm.lastActivity = time.Now()
+	}
+	vm.lastNetBytes = netBytes
+}
+
+// reclaimVM applies the expiry action of `vm`. VMs that aren't running can't
+// be paused or snapshotted and are destroyed instead.
+func (s *Server) reclaimVM(vm *vm, ttlExpired bool) error {
+	s.lock.Lock()
+	// The VM may have been destroyed or replaced by a restart since the
+	// reaper listed it.
+	if s.vms[vm.key()] != vm {
+		s.lock.Unlock()
+		return nil
+	}
+	currentStatus := vm.status
+	s.lock.Unlock()
+	running := currentStatus == vmStatusRunning || currentStatus == vmStatusReady
+
+	if vm.spec.expiryAction == expiryActionPause && running && !ttlExpired {
+		// Connections forwarded to the VM before it's paused don't resume it.
+		// The VM isn't paused if they can't be counted as then nothing but
+		// the API would resume it.
+		counts, err := forwardedConnectionCounts()
+		if err != nil {
+			return fmt.Errorf("failed to pause VM: %w", err)
+		}
+
+		err = s.pauseVM(context.Background(), vm)
+		if err != nil {
+			return fmt.Errorf("failed to pause VM: %w", err)
+		}
+
+		s.lock.Lock()
+		vm.pausedOnIdle = true
+		vm.lastForwardedConns = counts[vm.ip.IP.String()]
+		s.lock.Unlock()
+		return nil
+	}
+
+	canSnapshot := running || currentStatus == vmStatusPaused
+	if vm.spec.expiryAction == expiryActionSnapshot && canSnapshot {
+		err := s.snapshotVM(vm)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot VM: %w", err)
+		}
+	}
+
+	err := s.destroyVMInstance(context.Background(), vm)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+// snapshotVM pauses `vm` and snapshots it into a directory under the snapshots
+// dir that outlives the VM.
+func (s *Server) snapshotVM(vm *vm) error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	snapshotDir := path.Join(getSnapshotsDirPath(s.config.StateDir), vm.tenant, fmt.Sprintf("%s-%d", vm.name, time.Now().Unix()))
+	err := os.MkdirAll(snapshotDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	removeSnapshotDir := func() {
+		if err := os.RemoveAll(snapshotDir); err != nil {
+			log.WithError(err).Warnf("failed to remove snapshot dir: %s", snapshotDir)
+		}
+	}
+
+	// A VM has to be paused before it can be snapshotted.
+	s.lock.Lock()
+	wasPaused := vm.status == vmStatusPaused
+	s.lock.Unlock()
+	if !wasPaused {
+		err = s.pauseVM(ctx, vm)
+		if err != nil {
+			removeSnapshotDir()
+			return err
+		}
+	}
+
+	snapshotConfig := chvapi.VmSnapshotConfig{
+		DestinationUrl: String("file://" + snapshotDir),
+	}
+	resp, err := vm.apiClient.DefaultAPI.VmSnapshotPut(ctx).VmSnapshotConfig(snapshotConfig).Execute()
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("bad status: %v", resp)
+	}
+	if err != nil {
+		// Leave the VM as it was so that the next reaper run can retry.
+		removeSnapshotDir()
+		if !wasPaused {
+			if resumeErr := s.resumeVM(ctx, vm); resumeErr != nil {
+				log.WithField("vmname", vm.name).Warnf("failed to resume VM after failed snapshot: %v", resumeErr)
+			}
+		}
+		return fmt.Errorf("failed to snapshot VM: %w", err)
+	}
+
+	log.WithField("vmname", vm.name).Infof("snapshotted VM to: %s", snapshotDir)
+	s.publishEvent(vm, EventSnapshotTaken, snapshotDir)
+	return nil
+}
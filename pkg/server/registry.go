@@ -0,0 +1,639 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+const (
+	functionMetadataFileName = "function.json"
+	functionCodeDirName      = "code"
+	functionLayerFileName    = "layer.img"
+	defaultFunctionLang      = "python"
+	// The extracted code is sent to the code server in a single request.
+	maxFunctionCodeSize = 16 << 20
+	mkfsExt4Bin         = "mkfs.ext4"
+	// Layer disks are sparse so only what's installed takes up space.
+	layerDiskSize     = 4 << 30
+	layerBuildTimeout = 15 * time.Minute
+	// The layer disk is the only disk of the builder VM besides its rootfs.
+	layerBuildDevice = "/dev/vdb"
+	// Function VMs mount their layer disk here. Dependencies are installed in
+	// its python dir.
+	guestLayerMountDir = "/opt/chv-layer"
+)
+
+// Installs the dependencies passed as arguments into the layer disk.
+var layerBuildScript = fmt.Sprintf(`set -e
+mkdir -p %[2]s
+mount %[1]s %[2]s
+python3 -m venv /tmp/chv-layer-venv
+/tmp/chv-layer-venv/bin/pip install --no-cache-dir --target %[2]s/python "$@"
+umount %[2]s
+`, layerBuildDevice, guestLayerMountDir)
+
+// Mounts the layer disk, which comes right after the rootfs, in function VMs.
+var layerCloudConfig = fmt.Sprintf(`#cloud-config
+bootcmd:
+  - [mkdir, -p, %[2]s]
+  - [mount, -o, ro, %[1]s, %[2]s]
+`, layerBuildDevice, guestLayerMountDir)
+
+const (
+	layerStatusNone     = "none"
+	layerStatusBuilding = "building"
+	layerStatusReady    = "ready"
+	layerStatusFailed   = "failed"
+)
+
+// functionVersion is a registered version of a function. It's stored in its
+// dir next to its code and layer disk.
+type functionVersion struct {
+	Name         string    `json:"name"`
+	Version      int       `json:"version"`
+	Lang         string    `json:"lang"`
+	Handler      string    `json:"handler"`
+	Dependencies []string  `json:"dependencies,omitempty"`
+	Sha256       string    `json:"sha256"`
+	SizeBytes    int64     `json:"sizeBytes"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LayerStatus  string    `json:"layerStatus"`
+	LayerError   string    `json:"layerError,omitempty"`
+
+	dir string
+}
+
+func getFunctionsDirPath(stateDir string, tenant string) string {
+	return path.Join(stateDir, "functions", tenant)
+}
+
+func (s *Server) getFunctionDirPath(tenant string, functionName string) string {
+	return path.Join(getFunctionsDirPath(s.config.StateDir, tenant), functionName)
+}
+
+func (fn *functionVersion) layerPath() string {
+	return path.Join(fn.dir, functionLayerFileName)
+}
+
+// usesLayer returns whether VMs running `fn` attach its layer disk.
+func (fn *functionVersion) usesLayer() bool {
+	return fn.LayerStatus == layerStatusReady
+}
+
+// save atomically writes the metadata of `fn` to its dir.
+func (fn *functionVersion) save() error {
+	data, err := json.MarshalIndent(fn, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal function: %w", err)
+	}
+	metadataPath := path.Join(fn.dir, functionMetadataFileName)
+	err = os.WriteFile(metadataPath+".tmp", data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write function: %w", err)
+	}
+	return os.Rename(metadataPath+".tmp", metadataPath)
+}
+
+// readCode returns the files of the code of `fn` by their path relative to its
+// working directory.
+func (fn *functionVersion) readCode() (map[string]string, error) {
+	codeDir := path.Join(fn.dir, functionCodeDirName)
+	files := make(map[string]string)
+	err := filepath.WalkDir(codeDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(codeDir, filePath)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relPath)] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read code of function %s: %w", fn.Name, err)
+	}
+	return files, nil
+}
+
+func (fn *functionVersion) toAPI(versions []int) *serverapi.FunctionInfo {
+	var apiVersions []int32
+	for _, version := range versions {
+		apiVersions = append(apiVersions, int32(version))
+	}
+	return &serverapi.FunctionInfo{
+		Name:         serverapi.PtrString(fn.Name),
+		Version:      serverapi.PtrInt32(int32(fn.Version)),
+		Versions:     apiVersions,
+		Lang:         serverapi.PtrString(fn.Lang),
+		Handler:      serverapi.PtrString(fn.Handler),
+		Dependencies: fn.Dependencies,
+		Sha256:       serverapi.PtrString(fn.Sha256),
+		SizeBytes:    serverapi.PtrInt64(fn.SizeBytes),
+		CreatedAt:    serverapi.PtrString(fn.CreatedAt.Format(time.RFC3339)),
+		LayerStatus:  serverapi.PtrString(fn.LayerStatus),
+		LayerError:   serverapi.PtrString(fn.LayerError),
+	}
+}
+
+// extractBundle returns the files in the tar, gzipped tar or zip archive
+// `bundle` by their path relative to its root.
+func extractBundle(bundle []byte) (map[string]string, error) {
+	files := make(map[string]string)
+	total := 0
+	add := func(name string, r io.Reader) error {
+		name = filepath.ToSlash(filepath.Clean(name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("file path isn't relative: %q", name)
+		}
+		content, err := io.ReadAll(io.LimitReader(r, int64(maxFunctionCodeSize-total+1)))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		total += len(content)
+		if total > maxFunctionCodeSize {
+			return fmt.Errorf("code is larger than %d bytes", maxFunctionCodeSize)
+		}
+		if !utf8.Valid(content) {
+			return fmt.Errorf("binary files aren't supported: %s", name)
+		}
+		files[name] = string(content)
+		return nil
+	}
+
+	if bytes.HasPrefix(bundle, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip: %w", err)
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %w", f.Name, err)
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return files, nil
+	}
+
+	var r io.Reader = bytes.NewReader(bundle)
+	if bytes.HasPrefix(bundle, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip: %w", err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = add(header.Name, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeCode writes `files` into the code dir of `fn`.
+func (fn *functionVersion) writeCode(files map[string]string) error {
+	codeDir := path.Join(fn.dir, functionCodeDirName)
+	for name, content := range files {
+		filePath := filepath.Join(codeDir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create dir: %w", err)
+		}
+		err = os.WriteFile(filePath, []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// getFunctionVersions returns the registered versions of `functionName` in
+// ascending order.
+func (s *Server) getFunctionVersions(tenant string, functionName string) ([]int, error) {
+	entries, err := os.ReadDir(s.getFunctionDirPath(tenant, functionName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of function %s: %w", functionName, err)
+	}
+
+	var versions []int
+	for _, entry := range entries {
+		version, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// Versions are only complete once their metadata is written.
+		_, err = os.Stat(path.Join(s.getFunctionDirPath(tenant, functionName), entry.Name(), functionMetadataFileName))
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// loadFunctionVersion returns `version` of `functionName`, or its latest
+// version if it's 0, along with all of its versions.
+func (s *Server) loadFunctionVersion(tenant string, functionName string, version int) (*functionVersion, []int, error) {
+	if !functionNameRegexp.MatchString(functionName) {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid function name: %q", functionName)
+	}
+
+	versions, err := s.getFunctionVersions(tenant, functionName)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(versions) == 0 {
+		return nil, nil, status.Errorf(codes.NotFound, "function %s not found", functionName)
+	}
+	if version == 0 {
+		version = versions[len(versions)-1]
+	} else if !slices.Contains(versions, version) {
+		return nil, nil, status.Errorf(codes.NotFound, "version %d of function %s not found", version, functionName)
+	}
+
+	dir := path.Join(s.getFunctionDirPath(tenant, functionName), strconv.Itoa(version))
+	data, err := os.ReadFile(path.Join(dir, functionMetadataFileName))
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "failed to read function: %v", err)
+	}
+	fn := &functionVersion{dir: dir}
+	err = json.Unmarshal(data, fn)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "failed to parse function: %v", err)
+	}
+	return fn, versions, nil
+}
+
+// createFunctionVersionDir creates the dir of the next version of
+// `functionName`. Concurrent registrations get different versions as only one
+// of them can create each dir.
+func (s *Server) createFunctionVersionDir(tenant string, functionName string) (int, string, error) {
+	functionDir := s.getFunctionDirPath(tenant, functionName)
+	err := os.MkdirAll(functionDir, 0755)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create function dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(functionDir)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to list versions: %w", err)
+	}
+	version := 1
+	for _, entry := range entries {
+		if existing, err := strconv.Atoi(entry.Name()); err == nil && existing >= version {
+			version = existing + 1
+		}
+	}
+
+	for {
+		dir := path.Join(functionDir, strconv.Itoa(version))
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			return version, dir, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return 0, "", fmt.Errorf("failed to create version dir: %w", err)
+		}
+		version++
+	}
+}
+
+// RegisterFunction stores the bundle in `req` as the next version of its
+// function and starts building its layer disk if it has dependencies.
+func (s *Server) RegisterFunction(ctx context.Context, req *serverapi.RegisterFunctionRequest) (*serverapi.FunctionInfo, error) {
+	tenant := tenantFromContext(ctx)
+	functionName := req.GetName()
+	logger := log.WithFields(log.Fields{"function": functionName, "tenant": tenant})
+	logger.Info("received request to register function")
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if !functionNameRegexp.MatchString(functionName) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid function name: %q", functionName)
+	}
+	if req.GetHandler() == "" {
+		return nil, status.Error(codes.InvalidArgument, "handler is required")
+	}
+	lang := strings.ToLower(req.GetLang())
+	if lang == "" {
+		lang = defaultFunctionLang
+	}
+
+	bundle, err := base64.StdEncoding.DecodeString(req.GetBundle())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bundle isn't base64 encoded: %v", err)
+	}
+	files, err := extractBundle(bundle)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid bundle: %v", err)
+	}
+	handler := filepath.ToSlash(filepath.Clean(req.GetHandler()))
+	if _, ok := files[handler]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "handler %s isn't in the bundle", handler)
+	}
+
+	version, dir, err := s.createFunctionVersionDir(tenant, functionName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	sum := sha256.Sum256(bundle)
+	fn := &functionVersion{
+		Name:         functionName,
+		Version:      version,
+		Lang:         lang,
+		Handler:      handler,
+		Dependencies: slices.Clone(req.GetDependencies()),
+		Sha256:       hex.EncodeToString(sum[:]),
+		CreatedAt:    time.Now(),
+		LayerStatus:  layerStatusNone,
+		dir:          dir,
+	}
+	for _, content := range files {
+		fn.SizeBytes += int64(len(content))
+	}
+	// Only Python dependencies can be installed ahead of time. Others are
+	// installed on every invocation.
+	if len(fn.Dependencies) > 0 && lang == defaultFunctionLang {
+		fn.LayerStatus = layerStatusBuilding
+	}
+
+	err = fn.writeCode(files)
+	if err == nil {
+		err = fn.save()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, status.Errorf(codes.Internal, "failed to store function: %v", err)
+	}
+	logger.Infof("registered version %d", version)
+
+	if fn.LayerStatus == layerStatusBuilding {
+		go s.buildFunctionLayer(tenant, fn)
+	}
+
+	versions, err := s.getFunctionVersions(tenant, functionName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return fn.toAPI(versions), nil
+}
+
+// GetFunction returns `version` of `functionName`, or its latest version if
+// it's 0.
+func (s *Server) GetFunction(ctx context.Context, functionName string, version int) (*serverapi.FunctionInfo, error) {
+	tenant := tenantFromContext(ctx)
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	fn, versions, err := s.loadFunctionVersion(tenant, functionName, version)
+	if err != nil {
+		return nil, err
+	}
+	return fn.toAPI(versions), nil
+}
+
+// ListFunctions returns the latest version of every function of the tenant in
+// `ctx`.
+func (s *Server) ListFunctions(ctx context.Context) (*serverapi.ListFunctionsResponse, error) {
+	tenant := tenantFromContext(ctx)
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(getFunctionsDirPath(s.config.StateDir, tenant))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "failed to list functions: %v", err)
+	}
+
+	functions := []serverapi.FunctionInfo{}
+	for _, entry := range entries {
+		fn, versions, err := s.loadFunctionVersion(tenant, entry.Name(), 0)
+		if status.Code(err) == codes.NotFound || status.Code(err) == codes.InvalidArgument {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		functions = append(functions, *fn.toAPI(versions))
+	}
+	return &serverapi.ListFunctionsResponse{Functions: functions}, nil
+}
+
+// DeleteFunction deletes `version` of `functionName`, or all of its versions
+// if it's 0, and destroys their pooled VMs.
+func (s *Server) DeleteFunction(ctx context.Context, functionName string, version int) (*serverapi.VMResponse, error) {
+	tenant := tenantFromContext(ctx)
+	logger := log.WithFields(log.Fields{"function": functionName, "tenant": tenant, "version": version})
+	logger.Info("received request to delete function")
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	fn, _, err := s.loadFunctionVersion(tenant, functionName, version)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := s.getFunctionDirPath(tenant, functionName)
+	if version != 0 {
+		dir = fn.dir
+	}
+	// VMs already running the function keep their open layer disk.
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete function: %v", err)
+	}
+
+	s.drainFunctionPool(tenant, functionName, dir, version == 0)
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+		Message: serverapi.PtrString(fmt.Sprintf("function %s deleted", functionName)),
+	}, nil
+}
+
+// createLayerDisk creates an empty ext4 disk image at `diskPath`.
+func createLayerDisk(diskPath string) error {
+	f, err := os.Create(diskPath)
+	if err != nil {
+		return fmt.Errorf("failed to create layer disk: %w", err)
+	}
+	err = f.Truncate(layerDiskSize)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to size layer disk: %w", err)
+	}
+
+	output, err := exec.Command(mkfsExt4Bin, "-q", "-F", diskPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to format layer disk: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// runLayerBuild installs the dependencies of `fn` into a new layer disk in a
+// VM that runs till the installation is done.
+func (s *Server) runLayerBuild(tenant string, fn *functionVersion) error {
+	diskPath := fn.layerPath() + ".tmp"
+	defer os.Remove(diskPath)
+	err := createLayerDisk(diskPath)
+	if err != nil {
+		return err
+	}
+
+	vmName, err := getFunctionVMName(fn.Name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(WithTenant(context.Background(), tenant), layerBuildTimeout)
+	defer cancel()
+
+	spec, err := s.getVMSpec(&serverapi.StartVMRequest{
+		VmName:             serverapi.PtrString(vmName),
+		Args:               append([]string{"/bin/sh", "-c", layerBuildScript, "sh"}, fn.Dependencies...),
+		DisabledServices:   []string{"node-server"},
+		Vcpus:              serverapi.PtrInt32(int32(s.config.Functions.Vcpus)),
+		MemoryMb:           serverapi.PtrInt32(int32(s.config.Functions.MemoryMB)),
+		TtlSeconds:         serverapi.PtrInt32(-1),
+		IdleTimeoutSeconds: serverapi.PtrInt32(-1),
+	})
+	if err != nil {
+		return err
+	}
+	// Added after validation as layer disks aren't in the allowed disk dirs.
+	spec.disks = append(spec.disks, diskSpec{path: diskPath})
+
+	_, err = s.startVM(ctx, vmName, spec, false, defaultBootTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to start builder VM: %w", err)
+	}
+	defer func() {
+		err := s.destroyVM(context.Background(), vmKey(tenant, vmName))
+		if err != nil {
+			log.WithError(err).WithField("vmname", vmName).Warn("failed to destroy builder VM")
+		}
+	}()
+
+	result, err := s.waitForEntryPointExit(ctx, tenant, vmName)
+	if err != nil {
+		return fmt.Errorf("failed to install dependencies: %w", err)
+	}
+	if result.ExitCode != 0 {
+		lines := strings.Split(strings.TrimSpace(result.Stderr), "\n")
+		return fmt.Errorf("installing dependencies failed with code %d: %s", result.ExitCode, lines[len(lines)-1])
+	}
+	return os.Rename(diskPath, fn.layerPath())
+}
+
+// buildFunctionLayer builds the layer disk of `fn` and records whether it
+// succeeded. Invocations install the dependencies themselves till it's ready.
+func (s *Server) buildFunctionLayer(tenant string, fn *functionVersion) {
+	logger := log.WithFields(log.Fields{"function": fn.Name, "tenant": tenant, "version": fn.Version})
+	logger.Info("building layer disk")
+
+	err := s.runLayerBuild(tenant, fn)
+	if err != nil {
+		logger.WithError(err).Error("failed to build layer disk")
+		fn.LayerStatus = layerStatusFailed
+		fn.LayerError = err.Error()
+	} else {
+		logger.Info("built layer disk")
+		fn.LayerStatus = layerStatusReady
+	}
+
+	// The function could have been deleted in the meantime.
+	if _, err := os.Stat(fn.dir); err != nil {
+		os.Remove(fn.layerPath())
+		return
+	}
+	err = fn.save()
+	if err != nil {
+		logger.WithError(err).Error("failed to save layer status")
+	}
+}
+
+// failInterruptedLayerBuilds marks the layer builds that were running when the
+// server last stopped as failed.
+func (s *Server) failInterruptedLayerBuilds() {
+	metadataPaths, err := filepath.Glob(path.Join(s.config.StateDir, "functions", "*", "*", "*", functionMetadataFileName))
+	if err != nil {
+		log.WithError(err).Warn("failed to list functions")
+		return
+	}
+	for _, metadataPath := range metadataPaths {
+		data, err := os.ReadFile(metadataPath)
+		if err != nil {
+			continue
+		}
+		fn := &functionVersion{dir: path.Dir(metadataPath)}
+		if json.Unmarshal(data, fn) != nil || fn.LayerStatus != layerStatusBuilding {
+			continue
+		}
+		fn.LayerStatus = layerStatusFailed
+		fn.LayerError = "interrupted by a server restart"
+		err = fn.save()
+		if err != nil {
+			log.WithError(err).WithField("function", fn.Name).Warn("failed to save layer status")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"maps"
+	"strings"
+	"testing"
+)
+
+type bundleEntry struct {
+	name     string
+	content  string
+	typeflag byte
+}
+
+func tarBundle(t *testing.T, entries []bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		typeflag := entry.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: typeflag}
+		if typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if typeflag == tar.TypeSymlink {
+			header.Linkname = entry.content
+		}
+		err := tw.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte(entry.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBundle(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipBundle(t *testing.T, entries []bundleEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		// Names ending in a slash are directories.
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(entry.name, "/") {
+			continue
+		}
+		_, err = w.Write([]byte(entry.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractBundle(t *testing.T) {
+	entries := []bundleEntry{
+		{name: "main.py", content: "print('hello')\n"},
+		{name: "./lib/util.py", content: "X = 1\n"},
+		{name: "lib/", typeflag: tar.TypeDir},
+		{name: "link.py", content: "main.py", typeflag: tar.TypeSymlink},
+	}
+	want := map[string]string{
+		"main.py":     "print('hello')\n",
+		"lib/util.py": "X = 1\n",
+	}
+
+	tests := []struct {
+		name    string
+		bundle  func() []byte
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "tar",
+			bundle: func() []byte { return tarBundle(t, entries) },
+			want:   want,
+		},
+		{
+			name:   "gzipped tar",
+			bundle: func() []byte { return gzipBundle(t, tarBundle(t, entries)) },
+			want:   want,
+		},
+		{
+			name: "zip",
+			bundle: func() []byte {
+				return zipBundle(t, []bundleEntry{
+					{name: "main.py", content: "print('hello')\n"},
+					{name: "lib/"},
+					{name: "lib/util.py", content: "X = 1\n"},
+				})
+			},
+			want: want,
+		},
+		{
+			name:   "empty tar",
+			bundle: func() []byte { return tarBundle(t, nil) },
+			want:   map[string]string{},
+		},
+		{
+			name: "absolute path",
+			bundle: func() []byte {
+				return tarBundle(t, []bundleEntry{{name: "/etc/passwd", content: "root"}})
+			},
+			wantErr: "isn't relative",
+		},
+		{
+			name: "parent path",
+			bundle: func() []byte {
+				return tarBundle(t, []bundleEntry{{name: "lib/../../escape.py", content: "x"}})
+			},
+			wantErr: "isn't relative",
+		},
+		{
+			name: "parent path in zip",
+			bundle: func() []byte {
+				return zipBundle(t, []bundleEntry{{name: "../escape.py", content: "x"}})
+			},
+			wantErr: "isn't relative",
+		},
+		{
+			name: "binary file",
+			bundle: func() []byte {
+				return tarBundle(t, []bundleEntry{{name: "data.bin", content: "\xff\xfe\x00"}})
+			},
+			wantErr: "binary files aren't supported",
+		},
+		{
+			name: "too large",
+			bundle: func() []byte {
+				half := strings.Repeat("a", maxFunctionCodeSize/2+1)
+				return gzipBundle(t, tarBundle(t, []bundleEntry{
+					{name: "a.py", content: half},
+					{name: "b.py", content: half},
+				}))
+			},
+			wantErr: "code is larger than",
+		},
+		{
+			name:    "corrupt gzip",
+			bundle:  func() []byte { return []byte{0x1f, 0x8b, 0x00} },
+			wantErr: "failed to open gzip",
+		},
+		{
+			name:    "not an archive",
+			bundle:  func() []byte { return []byte(strings.Repeat("not a tar ", 100)) },
+			wantErr: "failed to read tar",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := extractBundle(tc.bundle())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(files, tc.want) {
+				t.Errorf("got files %v, want %v", files, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+)
+
+const (
+	// Results of destroyed VMs are kept for this long so that run to
+	// completion VMs can be queried after they're gone.
+	resultRetention    = 30 * time.Minute
+	maxRetainedResults = 1024
+	// The guest only sends the end of the entry point's output up to this
+	// size per stream.
+	maxResultOutputSize = 64 * 1024
+	// Leaves room for JSON escaping of the output.
+	maxGuestExitRequestSize = 8 * maxResultOutputSize
+)
+
+// entryPointResult is what the guest reports once its entry point exits,
+// right before it powers off.
+type entryPointResult struct {
+	// 128 plus the signal if the entry point was killed by a signal.
+	ExitCode        int       `json:"exitCode"`
+	Stdout          string    `json:"stdout,omitempty"`
+	StdoutTruncated bool      `json:"stdoutTruncated,omitempty"`
+	Stderr          string    `json:"stderr,omitempty"`
+	StderrTruncated bool      `json:"stderrTruncated,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+}
+
+// retainedResult is the result of a destroyed VM.
+type retainedResult struct {
+	vmName    string
+	result    *entryPointResult
+	expiresAt time.Time
+}
+
+// truncateOutput returns the end of `output` that fits in
+// `maxResultOutputSize` and whether anything was dropped.
+func truncateOutput(output string) (string, bool) {
+	if len(output) <= maxResultOutputSize {
+		return output, false
+	}
+	return output[len(output)-maxResultOutputSize:], true
+}
+
+func (r *entryPointResult) toAPI(vmName string) *serverapi.EntryPointResult {
+	return &serverapi.EntryPointResult{
+		VmName:          serverapi.PtrString(vmName),
+		ExitCode:        serverapi.PtrInt32(int32(r.ExitCode)),
+		Stdout:          serverapi.PtrString(r.Stdout),
+		StdoutTruncated: serverapi.PtrBool(r.StdoutTruncated),
+		Stderr:          serverapi.PtrString(r.Stderr),
+		StderrTruncated: serverapi.PtrBool(r.StderrTruncated),
+		StartedAt:       serverapi.PtrString(r.StartedAt.Format(time.RFC3339Nano)),
+		FinishedAt:      serverapi.PtrString(r.FinishedAt.Format(time.RFC3339Nano)),
+		DurationMs:      serverapi.PtrInt64(r.FinishedAt.Sub(r.StartedAt).Milliseconds()),
+	}
+}
+
+// retainResult keeps the result of `vm`, if it has one, after it's destroyed.
+//
+// Must be called with `s.lock` held.
+func (s *Server) retainResult(vm *vm) {
+	now := time.Now()
+	for key, retained := range s.results {
+		if now.After(retained.expiresAt) {
+			delete(s.results, key)
+		}
+	}
+
+	if vm.result == nil {
+		return
+	}
+
+	// Make room by dropping the result that expires first.
+	if len(s.results) >= maxRetainedResults {
+		oldestKey := ""
+		for key, retained := range s.results {
+			if oldestKey == "" || retained.expiresAt.Before(s.results[oldestKey].expiresAt) {
+				oldestKey = key
+			}
+		}
+		delete(s.results, oldestKey)
+	}
+	s.results[vm.key()] = retainedResult{
+		vmName:    vm.name,
+		result:    vm.result,
+		expiresAt: now.Add(resultRetention),
+	}
+}
+
+// GetVMResult returns the result of the entry point of VM `vmName` once it has
+// exited, including for VMs destroyed since then.
+func (s *Server) GetVMResult(ctx context.Context, vmName string) (*serverapi.EntryPointResult, error) {
+	key := vmKey(tenantFromContext(ctx), vmName)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if vm, ok := s.vms[key]; ok {
+		if vm.result == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "entry point of vm %s hasn't exited", vmName)
+		}
+		return vm.result.toAPI(vm.name), nil
+	}
+
+	retained, ok := s.results[key]
+	if !ok || time.Now().After(retained.expiresAt) {
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	return retained.result.toAPI(retained.vmName), nil
+}
+
+// entryPointExitStatus returns the result of the entry point of VM `key` once
+// it has exited and the guest powered off, and whether waiting for it is over.
+func (s *Server) entryPointExitStatus(key string) (*entryPointResult, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	vm, ok := s.vms[key]
+	switch {
+	case !ok:
+		return nil, true, errors.New("vm was destroyed")
+	case vm.status == vmStatusExited:
+		return vm.result, true, nil
+	case vm.status == vmStatusCrashed:
+		return nil, true, errors.New("vm crashed")
+	}
+	return nil, false, nil
+}
+
+// waitForEntryPointExit waits for the entry point of VM `vmName` to exit and
+// the guest to power off, and returns its result.
+func (s *Server) waitForEntryPointExit(ctx context.Context, tenant string, vmName string) (*entryPointResult, error) {
+	key := vmKey(tenant, vmName)
+	// Subscribed before the VM is checked so that no change is missed, only
+	// new events are needed.
+	subscriber := s.events.subscribe(tenant, math.MaxUint64)
+	defer func() {
+		s.events.unsubscribe(subscriber)
+	}()
+
+	for {
+		result, done, err := s.entryPointExitStatus(key)
+		if done {
+			return result, err
+		}
+
+		// Any event of the tenant's VMs is a cue to check again.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case _, ok := <-subscriber.ch:
+			// Dropped for falling behind, events may have been missed.
+			if !ok {
+				subscriber = s.events.subscribe(tenant, math.MaxUint64)
+			}
+		}
+	}
+}
+
+func (s *Server) guestExitRoute(w http.ResponseWriter, r *http.Request) {
+	var result entryPointResult
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGuestExitRequestSize)).Decode(&result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Guests aren't trusted to bound their output.
+	var truncated bool
+	result.Stdout, truncated = truncateOutput(result.Stdout)
+	result.StdoutTruncated = result.StdoutTruncated || truncated
+	result.Stderr, truncated = truncateOutput(result.Stderr)
+	result.StderrTruncated = result.StderrTruncated || truncated
+
+	s.lock.Lock()
+	vm, err := s.vmFromGuestRequest(r)
+	if err != nil {
+		s.lock.Unlock()
+		log.WithError(err).Warn("exit from unknown guest")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	vm.result = &result
+	s.lock.Unlock()
+
+	log.WithField("vmname", vm.name).Infof("entry point exited with code: %d", result.ExitCode)
+	s.publishEvent(vm, EventExited, fmt.Sprintf("entry point exited with code: %d", result.ExitCode))
+	w.WriteHeader(http.StatusNoContent)
+}
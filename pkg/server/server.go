@@ -9,14 +9,19 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/mattn/go-shellwords"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/abshkbh/chv-starter-pack/out/gen/chvapi"
 	"github.com/abshkbh/chv-starter-pack/out/gen/serverapi"
+	"github.com/abshkbh/chv-starter-pack/pkg/cloudconfig"
 	"github.com/abshkbh/chv-starter-pack/pkg/config"
 	"github.com/abshkbh/chv-starter-pack/pkg/server/fountain"
 	"github.com/abshkbh/chv-starter-pack/pkg/server/ipallocator"
@@ -32,6 +37,20 @@ const (
 	vmStatusStarted vmStatus = iota
 	vmStatusRunning
 	vmStatusStopped
+	// The guest has signalled that its services are up.
+	vmStatusReady
+	// The VMM process exited without the VM being destroyed.
+	vmStatusCrashed
+	// The VMM or the guest agents are failing health checks.
+	vmStatusUnhealthy
+	// The vCPUs are stopped but the VM's memory is retained.
+	vmStatusPaused
+	// The VM is being migrated to or from another server.
+	vmStatusMigrating
+	// The guest shut down after its entry point exited.
+	vmStatusExited
+	// The VM is being recreated by its restart policy.
+	vmStatusRestarting
 )
 
 func (status vmStatus) String() string {
@@ -42,6 +61,20 @@ func (status vmStatus) String() string {
 		return "RUNNING"
 	case vmStatusStopped:
 		return "STOPPED"
+	case vmStatusReady:
+		return "READY"
+	case vmStatusCrashed:
+		return "CRASHED"
+	case vmStatusUnhealthy:
+		return "UNHEALTHY"
+	case vmStatusPaused:
+		return "PAUSED"
+	case vmStatusMigrating:
+		return "MIGRATING"
+	case vmStatusExited:
+		return "EXITED"
+	case vmStatusRestarting:
+		return "RESTARTING"
 	default:
 		return "UNKNOWN"
 	}
@@ -60,10 +93,20 @@ const (
 	netDeviceQueueSizeBytes = 256
 	netDeviceId             = "_net0"
 	reapVmTimeout           = 20 * time.Second
+	defaultBootTimeout      = 60 * time.Second
+	// How long cleaning up after a failed start waits for the VMM.
+	cleanupTimeout = 10 * time.Second
+	// The env and secrets of the entry point are each limited to this size so
+	// that they fit in its environment.
+	maxEnvSize = 128 * 1024
+	// Limits of what's served to guests by the metadata service.
+	maxUserDataSize = 64 * 1024
+	maxSSHKeys      = 32
 )
 
 var (
-	initPath = "/usr/bin/tini -- /opt/custom_scripts/guestinit"
+	// guestinit runs as PID 1 and powers off the guest when it's done.
+	initPath = "/opt/custom_scripts/guestinit"
 )
 
 func String(s string) *string {
@@ -78,27 +121,187 @@ func Bool(b bool) *bool {
 	return &b
 }
 
+// diskSpec is a disk attached to a VM in addition to its rootfs.
+type diskSpec struct {
+	path     string
+	readOnly bool
+}
+
+// vmSpec is what a VM was asked to be created with. It's retained so that the
+// VM can be recreated on restarts.
+type vmSpec struct {
+	kernelPath string
+	rootfsPath string
+	// Set if the entry point was given as a string, in which case it's
+	// returned as is. Otherwise it was given as `args`.
+	entryPoint string
+	// Command and arguments of the entry point.
+	args       []string
+	workingDir string
+	// Name or uid[:gid].
+	user        string
+	vcpus       int
+	memoryBytes int64
+	disks       []diskSpec
+	ports       []portForward
+	env         map[string]string
+	secrets     map[string]string
+	// Served to the guest by the metadata service. SSH keys and user data are
+	// also put on the VM's config drive. An empty hostname defaults to the VM
+	// name.
+	hostname string
+	sshKeys  []string
+	userData string
+	// Names of guest services not to start.
+	disabledServices []string
+	restartPolicy    restartPolicy
+	// 0 means unlimited.
+	maxRestarts int
+	// Destroy the VM once its entry point exits and it isn't restarted.
+	destroyOnExit bool
+	// 0 disables reclaiming the VM after a TTL or idle timeout.
+	ttl          time.Duration
+	idleTimeout  time.Duration
+	expiryAction expiryAction
+}
+
 type vm struct {
-	name          string
+	name string
+	// VM names are unique per tenant.
+	tenant        string
+	spec          vmSpec
 	stateDirPath  string
 	apiSocketPath string
 	apiClient     *chvapi.APIClient
 	process       *os.Process
+	waiter        *processWaiter
 	ip            *net.IPNet
 	tapDevice     string
 	status        vmStatus
+	// Closed when the guest signals that it's ready. Recreated every time the
+	// VM is booted.
+	readyCh chan struct{}
+	// Closed when the VM is destroyed or replaced by a restart.
+	stopSupervisorCh chan struct{}
+	// Number of times the supervisor has restarted this VM.
+	restarts int
+	// Set once a restart has released the VMM, tap device and IP of the VM.
+	// Its ports and resources stay reserved.
+	tornDown bool
+	// Used by the reaper to reclaim VMs after their TTL or idle timeout.
+	createdAt    time.Time
+	lastActivity time.Time
+	// Bytes sent and received by the guest as of the last reaper run.
+	lastNetBytes int64
+	// Set if the VM was paused for being idle, in which case activity resumes
+	// it.
+	pausedOnIdle bool
+	// Connections forwarded to the guest by its DNAT rules as of when it was
+	// paused on idle or last checked for activity since.
+	lastForwardedConns uint64
+	// Set while the VM is being received by a migration, fails it.
+	cancelReceive context.CancelFunc
+	// Authenticates the guest to the guest API. Passed to it on its kernel
+	// command line.
+	guestToken string
+	// Secrets are only handed to the guest until it acknowledges them once
+	// per boot, before the entry point starts, so that processes in the guest
+	// can't read them later.
+	secretsFetched bool
+	// Result of the entry point reported by the guest, nil if it hasn't
+	// exited since the VM booted.
+	result *entryPointResult
+}
+
+// markReady transitions a running VM to ready and wakes up anyone waiting on
+// it.
+//
+// Must be called with the server lock held.
+func (v *vm) markReady() {
+	if v.status != vmStatusRunning {
+		return
+	}
+	v.status = vmStatusReady
+	close(v.readyCh)
+}
+
+// bootedStatus returns the status of a booted VM that's running normally.
+//
+// Must be called with the server lock held.
+func (v *vm) bootedStatus() vmStatus {
+	if isClosed(v.readyCh) {
+		return vmStatusReady
+	}
+	return vmStatusRunning
+}
+
+// resetReadiness is called once the VM has booted as the guest will signal
+// readiness again.
+//
+// Must be called with the server lock held.
+func (v *vm) resetReadiness() {
+	v.status = vmStatusRunning
+	v.readyCh = make(chan struct{})
+	v.secretsFetched = false
+	v.result = nil
+}
+
+// waitForGuestReady waits for the guest inside `vm` to signal readiness.
+// `readyCh` is passed in as `vm.readyCh` can only be read with the server lock
+// held.
+func waitForGuestReady(ctx context.Context, vmName string, readyCh <-chan struct{}, timeout time.Duration) error {
+	select {
+	case <-readyCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return status.Errorf(codes.DeadlineExceeded, "vm %s did not become ready within %v", vmName, timeout)
+	}
 }
 
-func getKernelCmdLine(gatewayIP string, guestIP string, entryPoint string) string {
+// getKernelCmdLine returns the kernel command line of a guest. The entry point
+// and the rest of the guest's config are fetched by the guest from the guest
+// API, authenticated with `guestToken`, rather than passed here where user
+// input could break out of its quotes. `configDrive` is the device of the
+// config drive, if any.
+func getKernelCmdLine(gatewayIP string, guestIP string, guestApiPort string, guestToken string, configDrive string) string {
 	return fmt.Sprintf(
-		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" root=/dev/vda rw entry_point=\"%s\" init=%s",
+		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\" guest_api_port=\"%s\" guest_token=\"%s\" config_drive=\"%s\" root=/dev/vda rw init=%s",
 		gatewayIP,
 		guestIP,
-		entryPoint,
+		guestApiPort,
+		guestToken,
+		configDrive,
 		initPath,
 	)
 }
 
+// getVMDisks returns the disks of `vm` created with `spec`, building its config
+// drive if it needs one. Also returns the device of the config drive in the
+// guest, if any.
+func getVMDisks(vm *vm, spec vmSpec) ([]chvapi.DiskConfig, string, error) {
+	disks := []chvapi.DiskConfig{{Path: spec.rootfsPath}}
+	for _, disk := range spec.disks {
+		disks = append(disks, chvapi.DiskConfig{Path: disk.path, Readonly: Bool(disk.readOnly)})
+	}
+	if !spec.needsConfigDrive() {
+		return disks, "", nil
+	}
+
+	device, err := getConfigDriveDevice(len(spec.disks))
+	if err != nil {
+		return nil, "", err
+	}
+	// Lives in the state dir so it's removed with the VM.
+	configDrivePath, err := buildConfigDrive(vm.stateDirPath, vm.tenant, vm.name, spec)
+	if err != nil {
+		return nil, "", err
+	}
+	disks = append(disks, chvapi.DiskConfig{Path: configDrivePath, Readonly: Bool(true)})
+	return disks, device, nil
+}
+
 // bridgeExists checks if a bridge with the given name exists.
 func bridgeExists(bridgeName string) (bool, error) {
 	cmd := exec.Command("ip", "link", "show", "type", "bridge")
@@ -118,30 +321,76 @@ func bridgeExists(bridgeName string) (bool, error) {
 	return false, nil
 }
 
-func forwardPortToCodeServerInVM(vmIP string, port string) error {
-	cmd := exec.Command(
-		"iptables",
-		"-t",
-		"nat",
-		"-A",
-		"PREROUTING",
-		"-p",
-		"tcp",
-		"--dport",
-		string(port),
-		"-j",
-		"DNAT",
-		"--to-destination",
-		fmt.Sprintf("%s:%s", vmIP, port),
-	)
+// codeServerForwardRule returns the iptables arguments that `action` e.g. "-A"
+// or "-D" the DNAT rule forwarding `port` on the host to the code server in
+// the VM at `vmIP`. Like `portForwardRule` connections from the bridge aren't
+// forwarded so that guests can't reach each other's code server through it.
+func codeServerForwardRule(action string, bridgeName string, vmIP string, port string) []string {
+	return []string{
+		"-t", "nat", action, "PREROUTING",
+		"!", "-i", bridgeName,
+		"-p", "tcp",
+		"--dport", port,
+		"-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%s", vmIP, port),
+	}
+}
 
-	err := cmd.Run()
+func forwardPortToCodeServerInVM(bridgeName string, vmIP string, port string) error {
+	err := exec.Command("iptables", codeServerForwardRule("-A", bridgeName, vmIP, port)...).Run()
 	if err != nil {
 		return fmt.Errorf("error forwarding port: %w", err)
 	}
 	return nil
 }
 
+// removeCodeServerPortForward is best effort like `removePortForwards`.
+func removeCodeServerPortForward(bridgeName string, vmIP string, port string) {
+	err := exec.Command("iptables", codeServerForwardRule("-D", bridgeName, vmIP, port)...).Run()
+	if err != nil {
+		log.Warnf("failed to remove code server port forward to: %s: %v", vmIP, err)
+	}
+}
+
+// guestServiceIsolationRule returns the ebtables arguments that `action` e.g.
+// "-A" or "-D" the rule dropping connections to `port` of the VM at `vmIP`
+// from other guests. The code and command servers in guests are
+// unauthenticated and only meant for the host, whose traffic to guests goes
+// through the OUTPUT chain rather than FORWARD.
+func guestServiceIsolationRule(action string, vmIP string, port string) []string {
+	return []string{
+		"-t", "filter", action, "FORWARD",
+		"-p", "IPv4",
+		"--ip-dst", vmIP,
+		"--ip-proto", "tcp",
+		"--ip-dport", port,
+		"-j", "DROP",
+	}
+}
+
+// isolateGuestServices keeps guests from connecting to `ports` of the VM at
+// `vmIP`. Rules installed before a failure are removed.
+func isolateGuestServices(vmIP string, ports []string) error {
+	for i, port := range ports {
+		err := exec.Command("ebtables", guestServiceIsolationRule("-A", vmIP, port)...).Run()
+		if err != nil {
+			removeGuestServiceIsolation(vmIP, ports[:i])
+			return fmt.Errorf("failed to isolate guest port: %s: %w", port, err)
+		}
+	}
+	return nil
+}
+
+// removeGuestServiceIsolation is best effort like `removePortForwards`.
+func removeGuestServiceIsolation(vmIP string, ports []string) {
+	for _, port := range ports {
+		err := exec.Command("ebtables", guestServiceIsolationRule("-D", vmIP, port)...).Run()
+		if err != nil {
+			log.Warnf("failed to remove isolation of guest port: %s of: %s: %v", port, vmIP, err)
+		}
+	}
+}
+
 // setupBridgeAndFirewall sets up a bridge and firewall rules for the given bridge name, IP address, and subnet.
 func setupBridgeAndFirewall(backupFile string, bridgeName string, bridgeIP string, bridgeSubnet string) error {
 	output, err := exec.Command("iptables-save").Output()
@@ -195,28 +444,34 @@ func setupBridgeAndFirewall(backupFile string, bridgeName string, bridgeIP strin
 	return nil
 }
 
-func getVmStateDirPath(stateDir string, vmName string) string {
-	return path.Join(stateDir, vmName)
+func getVmStateDirPath(stateDir string, tenant string, vmName string) string {
+	return path.Join(stateDir, "vms", tenant, vmName)
 }
 
 func getVmSocketPath(vmStateDir string, vmName string) string {
 	return path.Join(vmStateDir, vmName+".sock")
 }
 
-func unixSocketClient(socketPath string) *http.Client {
+func unixSocketClient(socketPath string, timeout time.Duration) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 				return net.Dial("unix", socketPath)
 			},
 		},
-		Timeout: time.Second * 30,
+		Timeout: timeout,
 	}
 }
 
 func createApiClient(apiSocketPath string) *chvapi.APIClient {
+	return createApiClientWithTimeout(apiSocketPath, time.Second*30)
+}
+
+// createApiClientWithTimeout is used for calls like migrations that can take
+// longer than the default timeout.
+func createApiClientWithTimeout(apiSocketPath string, timeout time.Duration) *chvapi.APIClient {
 	configuration := chvapi.NewConfiguration()
-	configuration.HTTPClient = unixSocketClient(apiSocketPath)
+	configuration.HTTPClient = unixSocketClient(apiSocketPath, timeout)
 	configuration.Servers = chvapi.ServerConfigurations{
 		{
 			URL: "http://localhost/api/v1",
@@ -254,25 +509,19 @@ func waitForServer(ctx context.Context, apiClient *chvapi.APIClient, timeout tim
 	return <-errCh
 }
 
-func reapProcess(process *os.Process, logger *log.Entry, timeout time.Duration) error {
-	done := make(chan error, 1)
-	go func() {
-		log.Info("waiting for VM process to exit")
-		_, err := process.Wait()
-		done <- err
-	}()
-
+func reapProcess(waiter *processWaiter, logger *log.Entry, timeout time.Duration) error {
+	log.Info("waiting for VM process to exit")
 	select {
-	case err := <-done:
+	case <-waiter.done:
 		logger.Infof("VM process exited via wait")
-		return err
+		return waiter.err
 	case <-time.After(timeout):
 		logger.Warnf("Timeout waiting for VM process to exit")
 	}
 
 	// Attempt to kill the process if it's still running. This should also
-	// trigger the wait in the goroutine preventing it's leak.
-	err := process.Kill()
+	// trigger the wait in the waiter's goroutine preventing it's leak.
+	err := waiter.process.Kill()
 	if err != nil {
 		return fmt.Errorf("failed to kill VM process: %v", err)
 	}
@@ -285,6 +534,11 @@ func NewServer(config config.ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
 	}
 
+	_, err = parseExpiryAction(config.DefaultExpiryAction)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default expiry action: %w", err)
+	}
+
 	ipBackupFile := fmt.Sprintf("/tmp/iptables-backup-%s.rules", time.Now().Format(time.UnixDate))
 	err = setupBridgeAndFirewall(ipBackupFile, config.BridgeName, config.BridgeIP, config.BridgeSubnet)
 	if err != nil {
@@ -296,36 +550,43 @@ func NewServer(config config.ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("failed to create ip allocator: %w", err)
 	}
 
-	return &Server{
+	s := &Server{
 		vms:         make(map[string]*vm),
+		starting:    make(map[string]struct{}),
+		tenantUsage: make(map[string]resourceUsage),
+		hostPorts:   make(map[string]string),
+		results:     make(map[string]retainedResult),
+		functions:   make(map[string]*functionPool),
 		fountain:    fountain.NewFountain(config.BridgeName),
 		ipAllocator: ipAllocator,
 		config:      config,
-	}, nil
-}
+		events:      newEventBus(),
+	}
 
-func (s *Server) createVM(
-	ctx context.Context,
-	vmName string,
-	kernelPath string,
-	rootfsPath string,
-	entryPoint string,
-) error {
-	cleanup := cleanup.Make(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("done")
-	})
+	err = s.startGuestApiServer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start guest api server: %w", err)
+	}
 
-	defer func() {
-		// Won't do anything if no error since we call `Release` it at the end.
-		cleanup.Clean()
-	}()
+	err = s.startWebhooks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start webhooks: %w", err)
+	}
 
-	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
+	s.failInterruptedLayerBuilds()
+	go s.runReaper()
+	return s, nil
+}
+
+// launchVMM creates the state dir of `vmName` and spawns a VMM for it without
+// creating a VM in it. Undoing this is added to `cu`.
+func (s *Server) launchVMM(ctx context.Context, tenant string, vmName string, cu *cleanup.Cleanup) (*vm, error) {
+	vmStateDir := getVmStateDirPath(s.config.StateDir, tenant, vmName)
 	err := os.MkdirAll(vmStateDir, 0755)
 	if err != nil {
-		return fmt.Errorf("failed to create vm state dir: %w", err)
+		return nil, fmt.Errorf("failed to create vm state dir: %w", err)
 	}
-	cleanup.Add(func() {
+	cu.Add(func() {
 		if err := os.RemoveAll(vmStateDir); err != nil {
 			log.WithError(err).Errorf("failed to remove vm state dir: %s", vmStateDir)
 		}
@@ -340,18 +601,8 @@ func (s *Server) createVM(
 	logFilePath := path.Join(vmStateDir, "log")
 	logFile, err := os.Create(logFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to create log file: %w", err)
-	}
-
-	tapDevice, err := s.fountain.CreateTapDevice(vmName)
-	if err != nil {
-		return fmt.Errorf("failed to create tap device: %w", err)
+		return nil, fmt.Errorf("failed to create log file: %w", err)
 	}
-	cleanup.Add(func() {
-		if err := s.fountain.DestroyTapDevice(vmName); err != nil {
-			log.WithError(err).Errorf("failed to delete tap device: %s", tapDevice)
-		}
-	})
 
 	cmd := exec.Command(chvBinPath, "--api-socket", apiSocketPath)
 	cmd.Stdout = logFile
@@ -365,25 +616,78 @@ func (s *Server) createVM(
 
 	err = cmd.Start()
 	if err != nil {
-		return fmt.Errorf("error spawning vm: %w", err)
+		return nil, fmt.Errorf("error spawning vm: %w", err)
 	}
-	cleanup.Add(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("reap VMM process")
-		reapProcess(cmd.Process, log.WithField("vmname", vmName), reapVmTimeout)
+	waiter := newProcessWaiter(cmd.Process)
+	cu.Add(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "launchVMM"}).Info("reap VMM process")
+		reapProcess(waiter, log.WithField("vmname", vmName), reapVmTimeout)
 	})
 
 	err = waitForServer(ctx, apiClient, 10*time.Second)
 	if err != nil {
-		return fmt.Errorf("error waiting for vm: %w", err)
+		return nil, fmt.Errorf("error waiting for vm: %w", err)
 	}
-	cleanup.Add(func() {
-		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("kill VMM process")
+	cu.Add(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "launchVMM"}).Info("kill VMM process")
 		if err := cmd.Process.Kill(); err != nil {
 			log.WithField("vmname", vmName).Errorf("Error killing vm: %v", err)
 		}
 	})
 	log.WithField("vmname", vmName).Infof("VM started Pid:%d", cmd.Process.Pid)
 
+	return &vm{
+		name:             vmName,
+		tenant:           tenant,
+		stateDirPath:     vmStateDir,
+		apiSocketPath:    apiSocketPath,
+		apiClient:        apiClient,
+		process:          cmd.Process,
+		waiter:           waiter,
+		status:           vmStatusRunning,
+		readyCh:          make(chan struct{}),
+		stopSupervisorCh: make(chan struct{}),
+		createdAt:        time.Now(),
+		lastActivity:     time.Now(),
+	}, nil
+}
+
+func (s *Server) createVM(
+	ctx context.Context,
+	tenant string,
+	vmName string,
+	spec vmSpec,
+	waitForReady bool,
+	bootTimeout time.Duration,
+	// The VM being restarted, which is put back in its place if this fails.
+	replaces *vm,
+) error {
+	cleanup := cleanup.Make(func() {
+		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("done")
+	})
+
+	defer func() {
+		// Won't do anything if no error since we call `Release` it at the end.
+		cleanup.Clean()
+	}()
+
+	key := vmKey(tenant, vmName)
+	tapDevice, err := s.fountain.CreateTapDevice(key)
+	if err != nil {
+		return fmt.Errorf("failed to create tap device: %w", err)
+	}
+	cleanup.Add(func() {
+		if err := s.fountain.DestroyTapDevice(key); err != nil {
+			log.WithError(err).Errorf("failed to delete tap device: %s", tapDevice)
+		}
+	})
+
+	vm, err := s.launchVMM(ctx, tenant, vmName, &cleanup)
+	if err != nil {
+		return err
+	}
+	apiClient := vm.apiClient
+
 	guestIP, err := s.ipAllocator.AllocateIP()
 	if err != nil {
 		return fmt.Errorf("error allocating guest ip: %w", err)
@@ -394,8 +698,16 @@ func (s *Server) createVM(
 		s.ipAllocator.FreeIP(guestIP.IP)
 	})
 
+	err = isolateGuestServices(guestIP.IP.String(), s.guestServicePorts())
+	if err != nil {
+		return err
+	}
+	cleanup.Add(func() {
+		removeGuestServiceIsolation(guestIP.IP.String(), s.guestServicePorts())
+	})
+
 	// Forward port on the host to the codeserver.
-	err = forwardPortToCodeServerInVM(guestIP.IP.String(), s.config.CodeServerPort)
+	err = forwardPortToCodeServerInVM(s.config.BridgeName, guestIP.IP.String(), s.config.CodeServerPort)
 	if err != nil {
 		return fmt.Errorf("failed to forward port in the code server: %w", err)
 	}
@@ -408,17 +720,35 @@ func (s *Server) createVM(
 				"ip":              guestIP.String(),
 				"codeserver_port": s.config.CodeServerPort},
 		).Info("deleting codeserver port forward")
-		s.ipAllocator.FreeIP(guestIP.IP)
+		removeCodeServerPortForward(s.config.BridgeName, guestIP.IP.String(), s.config.CodeServerPort)
 	})
 
+	err = addPortForwards(s.config.BridgeName, guestIP.IP.String(), spec.ports)
+	if err != nil {
+		return err
+	}
+	cleanup.Add(func() {
+		removePortForwards(s.config.BridgeName, guestIP.IP.String(), spec.ports)
+	})
+
+	disks, configDriveDevice, err := getVMDisks(vm, spec)
+	if err != nil {
+		return err
+	}
+
+	guestToken, err := newGuestToken()
+	if err != nil {
+		return err
+	}
+
 	vmConfig := chvapi.VmConfig{
 		Payload: chvapi.PayloadConfig{
-			Kernel:  String(kernelPath),
-			Cmdline: String(getKernelCmdLine(s.config.BridgeIP, guestIP.String(), entryPoint)),
+			Kernel:  String(spec.kernelPath),
+			Cmdline: String(getKernelCmdLine(s.config.BridgeIP, guestIP.String(), s.getGuestApiPort(), guestToken, configDriveDevice)),
 		},
-		Disks:   []chvapi.DiskConfig{{Path: rootfsPath}},
-		Cpus:    &chvapi.CpusConfig{BootVcpus: numBootVcpus, MaxVcpus: numBootVcpus},
-		Memory:  &chvapi.MemoryConfig{Size: memorySizeBytes},
+		Disks:   disks,
+		Cpus:    &chvapi.CpusConfig{BootVcpus: int32(spec.vcpus), MaxVcpus: int32(spec.vcpus)},
+		Memory:  &chvapi.MemoryConfig{Size: spec.memoryBytes},
 		Serial:  chvapi.NewConsoleConfig(serialPortMode),
 		Console: chvapi.NewConsoleConfig(consolePortMode),
 		Net:     []chvapi.NetConfig{{Tap: String(tapDevice), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)}},
@@ -437,86 +767,551 @@ func (s *Server) createVM(
 
 	resp, err = apiClient.DefaultAPI.BootVM(ctx).Execute()
 	if err != nil {
-		return fmt.Errorf("failed to boot VM resp.Body: %v: %w", resp.Body, err)
+		return fmt.Errorf("failed to boot VM: %w", err)
 	}
 	if resp.StatusCode != 200 && resp.StatusCode != 204 {
 		return fmt.Errorf("failed to boot VM. bad status: %v", resp)
 	}
 	cleanup.Add(func() {
 		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("shutting down VM")
-		shutdown_req := apiClient.DefaultAPI.ShutdownVM(ctx)
+		// `ctx` may have been cancelled, which is often why this is being
+		// cleaned up.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		shutdown_req := apiClient.DefaultAPI.ShutdownVM(shutdownCtx)
 		resp, err := shutdown_req.Execute()
-		if err != nil {
+		if err != nil || resp == nil {
 			log.WithError(err).Errorf("failed to shutdown VM: %v", err)
+			return
 		}
 
 		if resp.StatusCode != 200 && resp.StatusCode != 204 {
-			log.WithError(err).Errorf("failed to shutdown VM. bad status: %v", resp)
+			log.Errorf("failed to shutdown VM. bad status: %v", resp)
 		}
 	})
 
-	vm := &vm{
-		name:          vmName,
-		stateDirPath:  vmStateDir,
-		apiSocketPath: apiSocketPath,
-		apiClient:     apiClient,
-		process:       cmd.Process,
-		ip:            guestIP,
-		tapDevice:     tapDevice,
-		status:        vmStatusRunning,
+	vm.spec = spec
+	vm.ip = guestIP
+	vm.tapDevice = tapDevice
+	vm.guestToken = guestToken
+
+	// The VM needs to be visible before it's ready as the guest identifies
+	// itself by its token and IP when signalling readiness.
+	s.lock.Lock()
+	s.vms[key] = vm
+	s.lock.Unlock()
+	s.publishEvent(vm, EventCreated, "")
+	s.publishEvent(vm, EventBooted, "")
+	cleanup.Add(func() {
+		s.lock.Lock()
+		if s.vms[key] == vm {
+			if replaces != nil && !isClosed(replaces.stopSupervisorCh) {
+				s.vms[key] = replaces
+			} else {
+				delete(s.vms, key)
+			}
+		}
+		s.lock.Unlock()
+		s.publishEvent(vm, EventDestroyed, "failed to start")
+	})
+
+	if waitForReady {
+		err = waitForGuestReady(ctx, vmName, vm.readyCh, bootTimeout)
+		if err != nil {
+			return err
+		}
 	}
+
 	log.Infof("Successfully created VM: %s", vmName)
-	s.vms[vmName] = vm
 	cleanup.Release()
+	go s.superviseVM(vm)
 	return nil
 }
 
 type Server struct {
-	vms         map[string]*vm
+	// Protects `vms` and the mutable state of each vm.
+	lock sync.Mutex
+	// Keyed by `vmKey`.
+	vms map[string]*vm
+	// Keys of the VMs being started by `startVM`.
+	starting map[string]struct{}
+	// Resources reserved by each tenant's VMs.
+	tenantUsage map[string]resourceUsage
+	// Key of the VM each forwarded host port belongs to, keyed by
+	// `portForward.key`.
+	hostPorts map[string]string
+	// Results of destroyed VMs, keyed by `vmKey`.
+	results map[string]retainedResult
+	// Functions with invocations in flight or pooled VMs, keyed by `vmKey` of
+	// the tenant and function name.
+	functions   map[string]*functionPool
 	fountain    *fountain.Fountain
 	ipAllocator *ipallocator.IPAllocator
 	config      config.ServerConfig
+	events      *eventBus
 }
 
-func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
-	vmName := req.GetVmName()
-	entryPoint := req.GetEntryPoint()
-	kernelPath := req.GetKernel()
-	rootfsPath := req.GetRootfs()
-	logger := log.WithField("vmName", vmName)
-	logger.Infof("received request to start VM")
+// getVMSpec validates `req` and returns the spec of the VM it asks for.
+func (s *Server) getVMSpec(req *serverapi.StartVMRequest) (vmSpec, error) {
+	restartPolicy, err := parseRestartPolicy(req.GetRestartPolicy())
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	expiryActionName := req.GetExpiryAction()
+	if expiryActionName == "" {
+		expiryActionName = s.config.DefaultExpiryAction
+	}
+	expiryAction, err := parseExpiryAction(expiryActionName)
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	// If not specified, set kernel and rootfs to defaults.
+	kernelPath := req.GetKernel()
 	if kernelPath == "" {
 		kernelPath = s.config.KernelPath
 	}
 
+	rootfsPath := req.GetRootfs()
 	if rootfsPath == "" {
 		rootfsPath = s.config.RootfsPath
 	}
 
-	vm, exists := s.vms[vmName]
-	if exists {
-		resp, err := vm.apiClient.DefaultAPI.BootVM(ctx).Execute()
+	if req.GetVcpus() < 0 || req.GetMemoryMb() < 0 {
+		return vmSpec{}, status.Errorf(codes.InvalidArgument, "invalid resources: %d vCPUs and %d MB of memory", req.GetVcpus(), req.GetMemoryMb())
+	}
+	vcpus := numBootVcpus
+	if req.GetVcpus() > 0 {
+		vcpus = int(req.GetVcpus())
+	}
+	memoryBytes := int64(memorySizeBytes)
+	if req.GetMemoryMb() > 0 {
+		memoryBytes = int64(req.GetMemoryMb()) * 1024 * 1024
+	}
+
+	var disks []diskSpec
+	for _, disk := range req.GetDisks() {
+		err := validateDiskPath(disk.GetPath(), s.config.AllowedDiskDirs)
+		if err != nil {
+			return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+		disks = append(disks, diskSpec{path: disk.GetPath(), readOnly: disk.GetReadOnly()})
+	}
+
+	ports, err := s.parsePortForwards(req.GetPorts())
+	if err != nil {
+		return vmSpec{}, err
+	}
+
+	args, err := getEntryPointArgs(req.GetEntryPoint(), req.GetArgs())
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	workingDir := req.GetWorkingDir()
+	if workingDir != "" && !path.IsAbs(workingDir) {
+		return vmSpec{}, status.Errorf(codes.InvalidArgument, "working dir isn't absolute: %q", workingDir)
+	}
+
+	err = validateUser(req.GetUser())
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	env, err := validateEnv(req.GetEnv())
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	secrets, err := validateEnv(req.GetSecrets())
+	if err != nil {
+		return vmSpec{}, status.Errorf(codes.InvalidArgument, "invalid secrets: %v", err)
+	}
+
+	if req.GetHostname() != "" && !isValidHostname(req.GetHostname()) {
+		return vmSpec{}, status.Errorf(codes.InvalidArgument, "invalid hostname: %q", req.GetHostname())
+	}
+
+	err = validateSSHKeys(req.GetSshKeys())
+	if err != nil {
+		return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(req.GetUserData()) > maxUserDataSize {
+		return vmSpec{}, status.Errorf(codes.InvalidArgument, "user data is too large: %d bytes, at most %d", len(req.GetUserData()), maxUserDataSize)
+	}
+	if cloudconfig.IsCloudConfig(req.GetUserData()) {
+		_, err = cloudconfig.Parse(req.GetUserData())
+		if err != nil {
+			return vmSpec{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	for _, service := range req.GetDisabledServices() {
+		if service == "" {
+			return vmSpec{}, status.Error(codes.InvalidArgument, "empty disabled service name")
+		}
+	}
+
+	return vmSpec{
+		kernelPath:       kernelPath,
+		rootfsPath:       rootfsPath,
+		entryPoint:       req.GetEntryPoint(),
+		args:             args,
+		workingDir:       workingDir,
+		user:             req.GetUser(),
+		vcpus:            vcpus,
+		memoryBytes:      memoryBytes,
+		disks:            disks,
+		ports:            ports,
+		env:              env,
+		secrets:          secrets,
+		hostname:         req.GetHostname(),
+		sshKeys:          slices.Clone(req.GetSshKeys()),
+		userData:         req.GetUserData(),
+		disabledServices: slices.Clone(req.GetDisabledServices()),
+		restartPolicy:    restartPolicy,
+		maxRestarts:      int(req.GetMaxRestarts()),
+		destroyOnExit:    req.GetDestroyOnExit(),
+		ttl:              getExpiryDuration(req.GetTtlSeconds(), s.config.DefaultTTLSeconds),
+		idleTimeout:      getExpiryDuration(req.GetIdleTimeoutSeconds(), s.config.DefaultIdleTimeoutSeconds),
+		expiryAction:     expiryAction,
+	}, nil
+}
+
+// toStartVMRequest is the inverse of `getVMSpec`.
+func (spec vmSpec) toStartVMRequest(vmName string) serverapi.StartVMRequest {
+	// A zero duration is disabled, which the request expresses as a negative
+	// value.
+	toSeconds := func(d time.Duration) int32 {
+		if d == 0 {
+			return -1
+		}
+		return int32(d / time.Second)
+	}
+
+	var disks []serverapi.DiskSpec
+	for _, disk := range spec.disks {
+		disks = append(disks, serverapi.DiskSpec{
+			Path:     serverapi.PtrString(disk.path),
+			ReadOnly: serverapi.PtrBool(disk.readOnly),
+		})
+	}
+
+	var ports []serverapi.PortForward
+	for _, port := range spec.ports {
+		ports = append(ports, serverapi.PortForward{
+			HostPort:  serverapi.PtrInt32(int32(port.hostPort)),
+			GuestPort: serverapi.PtrInt32(int32(port.guestPort)),
+			Protocol:  serverapi.PtrString(port.protocol),
+		})
+	}
+
+	req := serverapi.StartVMRequest{
+		VmName:             serverapi.PtrString(vmName),
+		Kernel:             serverapi.PtrString(spec.kernelPath),
+		Rootfs:             serverapi.PtrString(spec.rootfsPath),
+		EntryPoint:         serverapi.PtrString(spec.entryPoint),
+		WorkingDir:         serverapi.PtrString(spec.workingDir),
+		User:               serverapi.PtrString(spec.user),
+		Hostname:           serverapi.PtrString(spec.hostname),
+		SshKeys:            spec.sshKeys,
+		UserData:           serverapi.PtrString(spec.userData),
+		DisabledServices:   spec.disabledServices,
+		RestartPolicy:      serverapi.PtrString(spec.restartPolicy.String()),
+		MaxRestarts:        serverapi.PtrInt32(int32(spec.maxRestarts)),
+		DestroyOnExit:      serverapi.PtrBool(spec.destroyOnExit),
+		TtlSeconds:         serverapi.PtrInt32(toSeconds(spec.ttl)),
+		IdleTimeoutSeconds: serverapi.PtrInt32(toSeconds(spec.idleTimeout)),
+		ExpiryAction:       serverapi.PtrString(spec.expiryAction.String()),
+		Vcpus:              serverapi.PtrInt32(int32(spec.vcpus)),
+		MemoryMb:           serverapi.PtrInt32(int32(spec.memoryBytes / (1024 * 1024))),
+		Disks:              disks,
+		Ports:              ports,
+	}
+	if spec.entryPoint == "" {
+		req.Args = spec.args
+	}
+	if len(spec.env) > 0 {
+		req.Env = &spec.env
+	}
+	if len(spec.secrets) > 0 {
+		req.Secrets = &spec.secrets
+	}
+	return req
+}
+
+// getEntryPointArgs returns the command and arguments of the entry point given
+// either as a string or as `args`.
+func getEntryPointArgs(entryPoint string, args []string) ([]string, error) {
+	if entryPoint != "" && len(args) > 0 {
+		return nil, errors.New("only one of entry point and args can be set")
+	}
+	if len(args) > 0 {
+		if args[0] == "" {
+			return nil, errors.New("empty entry point command")
+		}
+		return append([]string(nil), args...), nil
+	}
+	if entryPoint == "" {
+		return nil, nil
+	}
+
+	args, err := shellwords.Parse(entryPoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry point: %q: %w", entryPoint, err)
+	}
+	return args, nil
+}
+
+// validateUser checks that `user` is a user name or uid[:gid].
+func validateUser(user string) error {
+	if user == "" {
+		return nil
+	}
+
+	uid, gid, hasGid := strings.Cut(user, ":")
+	if isDigits(uid) && (!hasGid || isDigits(gid)) {
+		return nil
+	}
+	if hasGid {
+		return fmt.Errorf("invalid user: %q, expected a name or uid[:gid]", user)
+	}
+
+	for _, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return fmt.Errorf("invalid user: %q, expected a name or uid[:gid]", user)
+		}
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHostname returns whether `hostname` is a valid RFC 1123 hostname.
+func isValidHostname(hostname string) bool {
+	if len(hostname) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateSSHKeys checks that `keys` look like lines of an authorized_keys
+// file.
+func validateSSHKeys(keys []string) error {
+	if len(keys) > maxSSHKeys {
+		return fmt.Errorf("too many ssh keys: %d, at most %d", len(keys), maxSSHKeys)
+	}
+	for _, key := range keys {
+		fields := strings.Fields(key)
+		if len(fields) < 2 || strings.ContainsAny(key, "\r\n") {
+			return fmt.Errorf("invalid ssh key: %q", key)
+		}
+	}
+	return nil
+}
+
+// validateDiskPath checks that the disk image at `path` is under one of
+// `allowedDirs` so that tenants can't attach arbitrary host files.
+func validateDiskPath(path string, allowedDirs []string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("disk path isn't absolute: %q", path)
+	}
+
+	// Resolve symlinks so that they can't point outside the allowed dirs.
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("invalid disk: %q: %w", path, err)
+	}
+
+	for _, dir := range allowedDirs {
+		resolvedDir, err := filepath.EvalSymlinks(dir)
 		if err != nil {
-			return nil, fmt.Errorf("failed to boot existing VM resp.Body: %v: %w", resp.Body, err)
+			continue
+		}
+		rel, err := filepath.Rel(resolvedDir, resolvedPath)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return nil
 		}
+	}
+	return fmt.Errorf("disk %q isn't under an allowed disk dir", path)
+}
+
+// validateEnv checks the names in `env` and its size. Returns a copy of it.
+func validateEnv(env map[string]string) (map[string]string, error) {
+	if len(env) == 0 {
+		return nil, nil
+	}
 
-		if resp.StatusCode >= 300 {
-			return nil, fmt.Errorf("failed to boot existing VM. bad status: %v", resp)
+	result := make(map[string]string, len(env))
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "= \x00") {
+			return nil, fmt.Errorf("invalid env var name: %q", name)
+		}
+		result[name] = value
+	}
+
+	size := 0
+	for name, value := range result {
+		size += len(name) + len(value) + 2
+	}
+	if size > maxEnvSize {
+		return nil, fmt.Errorf("env is too large: %d bytes, at most %d", size, maxEnvSize)
+	}
+	return result, nil
+}
+
+func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	vmName := req.GetVmName()
+	tenant := tenantFromContext(ctx)
+	waitForReady := req.GetWaitForReady()
+	logger := log.WithFields(log.Fields{"vmName": vmName, "tenant": tenant})
+	logger.Infof("received request to start VM")
+
+	err := validateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := s.getVMSpec(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetDryRun() {
+		err = s.checkStartVM(tenant, vmName, spec)
+		if err != nil {
+			return nil, err
+		}
+		return &serverapi.StartVMResponse{VmName: serverapi.PtrString(vmName)}, nil
+	}
+
+	bootTimeout := defaultBootTimeout
+	if req.GetBootTimeoutSeconds() > 0 {
+		bootTimeout = time.Duration(req.GetBootTimeoutSeconds()) * time.Second
+	}
+	return s.startVM(ctx, vmName, spec, waitForReady, bootTimeout)
+}
+
+// checkStartVM checks that VM `vmName` of `tenant` could be created with `spec`
+// once the VM of that name, if any, is destroyed.
+func (s *Server) checkStartVM(tenant string, vmName string, spec vmSpec) error {
+	key := vmKey(tenant, vmName)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := s.tenantUsage[tenant]
+	if vm, ok := s.vms[key]; ok {
+		current = current.minus(specUsage(vm.spec))
+	}
+	err := s.checkQuota(tenant, current, specUsage(spec))
+	if err != nil {
+		return err
+	}
+	return s.checkPorts(key, spec.ports)
+}
+
+// startVM starts VM `vmName` of the tenant in `ctx` with `spec`, creating it
+// if it doesn't exist. `spec` must have been validated by `getVMSpec`.
+func (s *Server) startVM(ctx context.Context, vmName string, spec vmSpec, waitForReady bool, bootTimeout time.Duration) (*serverapi.StartVMResponse, error) {
+	tenant := tenantFromContext(ctx)
+	logger := log.WithFields(log.Fields{"vmName": vmName, "tenant": tenant})
+	key := vmKey(tenant, vmName)
+
+	// The name is reserved until the VM is started so that concurrent starts
+	// of the same VM don't both create it.
+	s.lock.Lock()
+	if _, ok := s.starting[key]; ok {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Aborted, "vm %s is already being started", vmName)
+	}
+	vm, exists := s.vms[key]
+	var currentStatus vmStatus
+	if exists {
+		currentStatus = vm.status
+	}
+	s.starting[key] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.starting, key)
+		s.lock.Unlock()
+	}()
+	if exists && currentStatus == vmStatusCrashed {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has crashed, destroy it before starting it again", vmName)
+	}
+
+	if exists && currentStatus == vmStatusExited {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s has exited, destroy it before starting it again", vmName)
+	}
+
+	if exists && currentStatus == vmStatusMigrating {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is being migrated", vmName)
+	}
+
+	if exists && currentStatus == vmStatusPaused {
+		err := s.resumeVM(ctx, vm)
+		if err != nil {
+			logger.Errorf("failed to resume paused VM: %v", err)
+			return nil, err
+		}
+	} else if exists {
+		err := s.bootExistingVM(ctx, vm, waitForReady, bootTimeout)
+		if err != nil {
+			logger.Errorf("failed to boot existing VM: %v", err)
+			return nil, err
 		}
-		// This is set by `createVM` when the VM is new.
-		vm.status = vmStatusRunning
 	} else {
-		err := s.createVM(ctx, vmName, kernelPath, rootfsPath, entryPoint)
+		err := s.reserveResources(tenant, specUsage(spec))
 		if err != nil {
+			logger.Warnf("failed to start: %v", err)
+			return nil, err
+		}
+
+		err = s.reservePorts(key, spec.ports)
+		if err != nil {
+			s.releaseResources(tenant, specUsage(spec))
+			logger.Warnf("failed to start: %v", err)
+			return nil, err
+		}
+
+		err = s.createVM(ctx, tenant, vmName, spec, waitForReady, bootTimeout, nil)
+		if err != nil {
+			s.releasePorts(key, spec.ports)
+			s.releaseResources(tenant, specUsage(spec))
 			logger.Errorf("failed to start: %v", err)
 			return nil, err
 		}
-		vm = s.vms[vmName]
+		s.lock.Lock()
+		vm = s.vms[key]
+		s.lock.Unlock()
 	}
 
 	logger.Infof("VM started")
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return &serverapi.StartVMResponse{
 		VmName:         serverapi.PtrString(vmName),
 		Ip:             serverapi.PtrString(vm.ip.String()),
@@ -526,14 +1321,51 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 	}, nil
 }
 
+// bootExistingVM boots a previously stopped VM. VMs that aren't stopped are
+// left as they are. Unlike `createVM` a boot timeout doesn't clean up the VM as
+// it existed before this call.
+func (s *Server) bootExistingVM(ctx context.Context, vm *vm, waitForReady bool, bootTimeout time.Duration) error {
+	s.lock.Lock()
+	currentStatus := vm.status
+	readyCh := vm.readyCh
+	s.lock.Unlock()
+	if currentStatus != vmStatusStopped {
+		if waitForReady && currentStatus == vmStatusRunning {
+			return waitForGuestReady(ctx, vm.name, readyCh, bootTimeout)
+		}
+		return nil
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.BootVM(ctx).Execute()
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("bad status: %v", resp)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to boot existing VM: %w", err)
+	}
+
+	// Readiness is only reset once the VM booted so that a failed boot leaves
+	// the VM as it was.
+	s.lock.Lock()
+	vm.resetReadiness()
+	readyCh = vm.readyCh
+	s.lock.Unlock()
+	s.publishEvent(vm, EventBooted, "")
+
+	if waitForReady {
+		return waitForGuestReady(ctx, vm.name, readyCh, bootTimeout)
+	}
+	return nil
+}
+
 func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
 	vmName := req.GetVmName()
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to stop VM")
 
-	vm, exists := s.vms[vmName]
-	if !exists {
-		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return nil, err
 	}
 
 	shutdown_req := vm.apiClient.DefaultAPI.ShutdownVM(ctx)
@@ -546,22 +1378,18 @@ func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*servera
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to stop VM. bad status: %v", resp))
 	}
 
+	s.lock.Lock()
 	vm.status = vmStatusStopped
+	s.lock.Unlock()
+	s.publishEvent(vm, EventStopped, "")
 	logger.Infof("VM stopped")
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
-func (s *Server) destroyVM(ctx context.Context, vmName string) error {
-	log.WithField("vmName", vmName).Info("destroyVM")
-	logger := log.WithField("vmName", vmName)
-
-	vm, exists := s.vms[vmName]
-	if !exists {
-		return status.Errorf(codes.NotFound, "vm %s not found", vmName)
-	}
-
+// shutdownVMM gracefully shuts down the VM and then the VMM process.
+func shutdownVMM(ctx context.Context, vm *vm, logger *log.Entry) error {
 	// Shutdown for a graceful exit before full deletion. Don't error out if this fails as we still
 	// want to try a deletion after this.
 	shutdownReq := vm.apiClient.DefaultAPI.ShutdownVM(ctx)
@@ -575,64 +1403,250 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 	deleteReq := vm.apiClient.DefaultAPI.DeleteVM(ctx)
 	resp, err = deleteReq.Execute()
 	if err != nil {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to delete VM: %v", err))
+		return fmt.Errorf("failed to delete VM: %w", err)
 	}
 
 	if resp.StatusCode >= 300 {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to stop VM. bad status: %v", resp))
+		return fmt.Errorf("failed to stop VM. bad status: %v", resp)
 	}
 
 	shutdownVMMReq := vm.apiClient.DefaultAPI.ShutdownVMM(ctx)
 	resp, err = shutdownVMMReq.Execute()
 	if err != nil {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM: %v", err))
+		return fmt.Errorf("failed to shutdown VMM: %w", err)
 	}
 
 	if resp.StatusCode >= 300 {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM. bad status: %v", resp))
+		return fmt.Errorf("failed to shutdown VMM. bad status: %v", resp)
+	}
+	return nil
+}
+
+// teardownVM shuts down the VMM if it's still alive and releases every
+// resource allocated for `vm` by `createVM`. It's best effort as a crashed or
+// hung VMM shouldn't leak the VM's tap device and IP.
+func (s *Server) teardownVM(ctx context.Context, vm *vm) {
+	logger := log.WithField("vmName", vm.name)
+
+	if !vm.waiter.exited() {
+		err := shutdownVMM(ctx, vm, logger)
+		if err != nil {
+			logger.Warnf("failed to shutdown VMM, it will be killed: %v", err)
+		}
 	}
 
-	err = reapProcess(vm.process, logger, reapVmTimeout)
+	err := reapProcess(vm.waiter, logger, reapVmTimeout)
 	if err != nil {
 		logger.Warnf("failed to reap VM process: %v", err)
 	}
 
-	// Once deleted remove its directory and remove it from the internal store of VMs.
+	// Once deleted remove its directory.
 	err = os.RemoveAll(vm.stateDirPath)
 	if err != nil {
 		log.Warnf("Failed to delete directory %s: %v", vm.stateDirPath, err)
 	}
 
-	err = s.fountain.DestroyTapDevice(vmName)
-	if err != nil {
-		log.Warnf("failed to destroy the tap device for vm: %s: %v", vmName, err)
+	// A VM that migrated to another server on this host takes its tap device
+	// with it.
+	onBridge, err := s.fountain.IsTapDeviceOnBridge(vm.key())
+	if err != nil || onBridge {
+		err = s.fountain.DestroyTapDevice(vm.key())
+		if err != nil {
+			log.Warnf("failed to destroy the tap device for vm: %s: %v", vm.name, err)
+		}
 	}
 
+	removePortForwards(s.config.BridgeName, vm.ip.IP.String(), vm.spec.ports)
+	removeCodeServerPortForward(s.config.BridgeName, vm.ip.IP.String(), s.config.CodeServerPort)
+	removeGuestServiceIsolation(vm.ip.IP.String(), s.guestServicePorts())
+
 	err = s.ipAllocator.FreeIP(vm.ip.IP)
 	if err != nil {
 		log.Warnf("failed to free IP: %s: %v", vm.ip.IP.String(), err)
 	}
-	delete(s.vms, vmName)
+}
+
+// pauseVM stops the vCPUs of `vm` while retaining its memory.
+func (s *Server) pauseVM(ctx context.Context, vm *vm) error {
+	s.lock.Lock()
+	currentStatus := vm.status
+	s.lock.Unlock()
+	if currentStatus != vmStatusRunning && currentStatus != vmStatusReady && currentStatus != vmStatusUnhealthy {
+		return status.Errorf(codes.FailedPrecondition, "vm %s can't be paused in state: %v", vm.name, currentStatus)
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.PauseVM(ctx).Execute()
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to pause VM: %v", err))
+	}
+
+	if resp.StatusCode >= 300 {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to pause VM. bad status: %v", resp))
+	}
+
+	s.lock.Lock()
+	vm.status = vmStatusPaused
+	s.lock.Unlock()
+	s.publishEvent(vm, EventPaused, "")
 	return nil
 }
 
-func (s *Server) destroyAllVMs(ctx context.Context) error {
-	log.Info("destroying all VMs")
+// resumeVM resumes a VM paused by `pauseVM`.
+func (s *Server) resumeVM(ctx context.Context, vm *vm) error {
+	s.lock.Lock()
+	currentStatus := vm.status
+	s.lock.Unlock()
+	if currentStatus != vmStatusPaused {
+		return status.Errorf(codes.FailedPrecondition, "vm %s isn't paused: %v", vm.name, currentStatus)
+	}
+
+	resp, err := vm.apiClient.DefaultAPI.ResumeVM(ctx).Execute()
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to resume VM: %v", err))
+	}
+
+	if resp.StatusCode >= 300 {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to resume VM. bad status: %v", resp))
+	}
+
+	s.lock.Lock()
+	vm.status = vm.bootedStatus()
+	vm.pausedOnIdle = false
+	// Don't let the VM be reclaimed for being idle as soon as it's resumed.
+	vm.lastActivity = time.Now()
+	s.lock.Unlock()
+	s.publishEvent(vm, EventResumed, "")
+	return nil
+}
+
+func (s *Server) PauseVM(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to pause VM")
+
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.pauseVM(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("VM paused")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+func (s *Server) ResumeVM(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to resume VM")
+
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.resumeVM(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("VM resumed")
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+	}, nil
+}
+
+// destroyVM destroys the VM with key `key` in `s.vms` regardless of its
+// tenant.
+func (s *Server) destroyVM(ctx context.Context, key string) error {
+	return s.destroyTrackedVM(ctx, key, nil)
+}
+
+// destroyVMInstance destroys `vm` unless it's no longer tracked, e.g. because a
+// restart or a new VM with the same name replaced it since it was looked up.
+func (s *Server) destroyVMInstance(ctx context.Context, vm *vm) error {
+	return s.destroyTrackedVM(ctx, vm.key(), vm)
+}
+
+// destroyTrackedVM destroys the VM tracked under `key` if it's `expected` or
+// `expected` is nil.
+func (s *Server) destroyTrackedVM(ctx context.Context, key string, expected *vm) error {
+	log.WithField("vmKey", key).Info("destroyVM")
+
+	// Stop supervising the VM first so that its VMM exiting isn't treated as a
+	// crash.
+	s.lock.Lock()
+	vm, exists := s.vms[key]
+	if !exists || (expected != nil && vm != expected) {
+		s.lock.Unlock()
+		return status.Errorf(codes.NotFound, "vm %s not found", key)
+	}
+	if !isClosed(vm.stopSupervisorCh) {
+		close(vm.stopSupervisorCh)
+	}
+	s.retainResult(vm)
+	delete(s.vms, key)
+	restarting := vm.status == vmStatusRestarting
+	tornDown := vm.tornDown
+	s.lock.Unlock()
+
+	// The restart notices that it's been destroyed and cleans up after
+	// itself.
+	if restarting {
+		s.publishEvent(vm, EventDestroyed, "")
+		return nil
+	}
+
+	if !tornDown {
+		s.teardownVM(ctx, vm)
+	}
+	s.releasePorts(key, vm.spec.ports)
+	s.releaseResources(vm.tenant, specUsage(vm.spec))
+	s.publishEvent(vm, EventDestroyed, "")
+	return nil
+}
+
+// destroyVMs destroys the VMs of `tenant` or of every tenant if it's empty.
+func (s *Server) destroyVMs(ctx context.Context, tenant string) error {
+	s.lock.Lock()
+	var keys []string
+	for key, vm := range s.vms {
+		if tenant == "" || vm.tenant == tenant {
+			keys = append(keys, key)
+		}
+	}
+	s.lock.Unlock()
+
 	var finalErr error
-	for _, vm := range s.vms {
-		err := s.destroyVM(ctx, vm.name)
+	for _, key := range keys {
+		err := s.destroyVM(ctx, key)
 		if err != nil {
-			log.Warnf("failed to destroy and clean up vm: %s", vm.name)
+			log.Warnf("failed to destroy and clean up vm: %s", key)
 		}
 		finalErr = errors.Join(finalErr, err)
 	}
 	return finalErr
 }
 
+func (s *Server) destroyAllVMs(ctx context.Context) error {
+	tenant := tenantFromContext(ctx)
+	log.WithField("tenant", tenant).Info("destroying all VMs")
+	return s.destroyVMs(ctx, tenant)
+}
+
+// Shutdown destroys the VMs of every tenant.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Info("destroying the VMs of all tenants")
+	return s.destroyVMs(ctx, "")
+}
+
 func (s *Server) DestroyVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
 	log.Infof("received request to destroy VM")
 	vmName := req.GetVmName()
-	err := s.destroyVM(ctx, vmName)
+	err := s.destroyVM(ctx, vmKey(tenantFromContext(ctx), vmName))
 	if err != nil {
 		return nil, err
 	}
@@ -654,13 +1668,25 @@ func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsRes
 func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse, error) {
 	resp := &serverapi.ListAllVMsResponse{}
 	var vms []serverapi.ListAllVMsResponseVmsInner
+	tenant := tenantFromContext(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	for _, vm := range s.vms {
+		if vm.tenant != tenant {
+			continue
+		}
+
 		vmInfo := serverapi.ListAllVMsResponseVmsInner{
-			VmName:        serverapi.PtrString(vm.name),
-			Ip:            serverapi.PtrString(vm.ip.String()),
-			Status:        serverapi.PtrString(vm.status.String()),
-			TapDeviceName: serverapi.PtrString(vm.tapDevice),
+			VmName:         serverapi.PtrString(vm.name),
+			Ip:             serverapi.PtrString(vm.ip.String()),
+			Status:         serverapi.PtrString(vm.status.String()),
+			TapDeviceName:  serverapi.PtrString(vm.tapDevice),
+			RestartPolicy:  serverapi.PtrString(vm.spec.restartPolicy.String()),
+			Restarts:       serverapi.PtrInt32(int32(vm.restarts)),
+			CreatedAt:      serverapi.PtrString(vm.createdAt.Format(time.RFC3339)),
+			LastActivityAt: serverapi.PtrString(vm.lastActivity.Format(time.RFC3339)),
 		}
 		vms = append(vms, vmInfo)
 	}
@@ -669,15 +1695,26 @@ func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse,
 }
 
 func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMResponse, error) {
-	vm, ok := s.vms[vmName]
-	if !ok {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	vm, err := s.getVM(ctx, vmName)
+	if err != nil {
+		return nil, err
 	}
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	spec := vm.spec.toStartVMRequest(vm.name)
+	// Secrets are write only.
+	spec.Secrets = nil
 	return &serverapi.ListVMResponse{
-		VmName:        serverapi.PtrString(vm.name),
-		Ip:            serverapi.PtrString(vm.ip.String()),
-		Status:        serverapi.PtrString(vm.status.String()),
-		TapDeviceName: serverapi.PtrString(vm.tapDevice),
+		VmName:         serverapi.PtrString(vm.name),
+		Ip:             serverapi.PtrString(vm.ip.String()),
+		Status:         serverapi.PtrString(vm.status.String()),
+		TapDeviceName:  serverapi.PtrString(vm.tapDevice),
+		RestartPolicy:  serverapi.PtrString(vm.spec.restartPolicy.String()),
+		Restarts:       serverapi.PtrInt32(int32(vm.restarts)),
+		CreatedAt:      serverapi.PtrString(vm.createdAt.Format(time.RFC3339)),
+		LastActivityAt: serverapi.PtrString(vm.lastActivity.Format(time.RFC3339)),
+		Spec:           &spec,
 	}, nil
 }
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	healthCheckInterval = 5 * time.Second
+	healthCheckTimeout  = 2 * time.Second
+	// Number of consecutive failed health checks after which a VM is marked
+	// unhealthy.
+	unhealthyThreshold = 3
+	restartBackoffBase = 1 * time.Second
+	restartBackoffMax  = 1 * time.Minute
+	// Consecutive failures to recreate a VM after which its restart is given
+	// up on, even if its restarts are unlimited.
+	maxFailedRestartAttempts = 10
+	// Name of the guest service probed by health checks, as used in a VM's
+	// disabled services.
+	codeServerServiceName = "codeserver"
+)
+
+// restartPolicy decides whether a VM is restarted after it crashes or becomes
+// unhealthy.
+type restartPolicy int
+
+const (
+	restartPolicyNever restartPolicy = iota
+	restartPolicyOnFailure
+	restartPolicyAlways
+)
+
+func (policy restartPolicy) String() string {
+	switch policy {
+	case restartPolicyNever:
+		return "never"
+	case restartPolicyOnFailure:
+		return "on-failure"
+	case restartPolicyAlways:
+		return "always"
+	default:
+		return "unknown"
+	}
+}
+
+func parseRestartPolicy(policy string) (restartPolicy, error) {
+	switch policy {
+	case "", "never":
+		return restartPolicyNever, nil
+	case "on-failure":
+		return restartPolicyOnFailure, nil
+	case "always":
+		return restartPolicyAlways, nil
+	default:
+		return restartPolicyNever, fmt.Errorf("unknown restart policy: %s", policy)
+	}
+}
+
+// processWaiter waits on a VMM process exactly once so that both the
+// supervisor and the destroy path can observe its exit.
+type processWaiter struct {
+	process *os.Process
+	// Closed once the process has exited. `state` and `err` are only valid
+	// after that.
+	done  chan struct{}
+	state *os.ProcessState
+	err   error
+}
+
+func newProcessWaiter(process *os.Process) *processWaiter {
+	waiter := &processWaiter{
+		process: process,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		waiter.state, waiter.err = process.Wait()
+		close(waiter.done)
+	}()
+	return waiter
+}
+
+func (w *processWaiter) exited() bool {
+	return isClosed(w.done)
+}
+
+// exitedCleanly must only be called once the process has exited.
+func (w *processWaiter) exitedCleanly() bool {
+	return w.err == nil && w.state.Success()
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// restartBackoff returns how long to wait before the `restarts`+1'th restart.
+func restartBackoff(restarts int) time.Duration {
+	backoff := restartBackoffBase
+	for i := 0; i < restarts && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, restartBackoffMax)
+}
+
+// restartsExhausted returns whether a VM that has been restarted `restarts`
+// times, and failed to be recreated `failedAttempts` times in a row since, is
+// given up on.
+func restartsExhausted(maxRestarts int, restarts int, failedAttempts int) bool {
+	return (maxRestarts > 0 && restarts >= maxRestarts) || failedAttempts >= maxFailedRestartAttempts
+}
+
+// superviseVM watches `vm` till it's destroyed or restarted. It marks the VM
+// as crashed if the VMM process dies and unhealthy if health checks keep
+// failing, applying the VM's restart policy in both cases.
+func (s *Server) superviseVM(vm *vm) {
+	logger := log.WithField("vmname", vm.name)
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	failedChecks := 0
+	for {
+		select {
+		case <-vm.stopSupervisorCh:
+			return
+
+		case <-vm.waiter.done:
+			logger.Warnf("VMM process exited: %v", vm.waiter.state)
+			s.lock.Lock()
+			// The VMM is expected to exit when the VM is being destroyed. It
+			// also exits once it has migrated the VM out, and `MigrateVM`
+			// handles it crashing during a migration.
+			if isClosed(vm.stopSupervisorCh) || vm.status == vmStatusMigrating || vm.status == vmStatusCrashed {
+				s.lock.Unlock()
+				return
+			}
+			// The guest powers off once its entry point exits, in which case
+			// the entry point's exit code tells whether it failed.
+			if result := vm.result; result != nil {
+				vm.status = vmStatusExited
+				destroyOnExit := vm.spec.destroyOnExit
+				s.lock.Unlock()
+				s.publishEvent(vm, EventStopped, "guest powered off after its entry point exited")
+				if !s.maybeRestartVM(vm, result.ExitCode != 0) && destroyOnExit {
+					logger.Info("destroying VM as its entry point exited")
+					err := s.destroyVMInstance(context.Background(), vm)
+					if err != nil {
+						logger.WithError(err).Error("failed to destroy VM")
+					}
+				}
+				return
+			}
+			vm.status = vmStatusCrashed
+			s.lock.Unlock()
+			s.publishEvent(vm, EventCrashed, fmt.Sprintf("VMM process exited: %v", vm.waiter.state))
+
+			s.maybeRestartVM(vm, !vm.waiter.exitedCleanly())
+			return
+
+		case <-ticker.C:
+			err := s.checkHealth(vm)
+			if err == nil {
+				failedChecks = 0
+				s.markHealthy(vm)
+				continue
+			}
+
+			failedChecks++
+			logger.WithError(err).Warnf("health check failed (%d/%d)", failedChecks, unhealthyThreshold)
+			if failedChecks < unhealthyThreshold {
+				continue
+			}
+
+			s.lock.Lock()
+			vm.status = vmStatusUnhealthy
+			s.lock.Unlock()
+			if s.maybeRestartVM(vm, true) {
+				return
+			}
+		}
+	}
+}
+
+// checkHealth pings the VMM and, once the guest has signalled readiness, the
+// guest agents.
+func (s *Server) checkHealth(vm *vm) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	_, _, err := vm.apiClient.DefaultAPI.VmmPingGet(ctx).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to ping VMM: %w", err)
+	}
+
+	s.lock.Lock()
+	checkGuest := vm.status != vmStatusStopped &&
+		vm.status != vmStatusPaused &&
+		vm.status != vmStatusMigrating &&
+		// The guest stops its services once the entry point exits.
+		vm.result == nil &&
+		isClosed(vm.readyCh) &&
+		// Probing a disabled code server would restart the VM forever.
+		!slices.Contains(vm.spec.disabledServices, codeServerServiceName)
+	s.lock.Unlock()
+	if !checkGuest || s.config.CodeServerPort == "" {
+		return nil
+	}
+
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(vm.ip.IP.String(), s.config.CodeServerPort))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create guest health check request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to ping code server: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to ping code server. bad status: %v", resp.Status)
+	}
+	return nil
+}
+
+// markHealthy moves an unhealthy VM back to the status it had before its
+// health checks started failing.
+func (s *Server) markHealthy(vm *vm) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if vm.status != vmStatusUnhealthy {
+		return
+	}
+
+	vm.status = vm.bootedStatus()
+	log.WithField("vmname", vm.name).Info("VM is healthy again")
+}
+
+// maybeRestartVM applies the restart policy of `vm`. `failed` is false if the
+// VM exited cleanly. Returns true if `vm` has been replaced or destroyed and
+// shouldn't be supervised anymore.
+func (s *Server) maybeRestartVM(vm *vm, failed bool) bool {
+	logger := log.WithField("vmname", vm.name)
+
+	policy := vm.spec.restartPolicy
+	if policy == restartPolicyNever || (policy == restartPolicyOnFailure && !failed) {
+		logger.Infof("not restarting VM with restart policy: %v", policy)
+		return false
+	}
+
+	s.lock.Lock()
+	restarts := vm.restarts
+	s.lock.Unlock()
+	if restartsExhausted(vm.spec.maxRestarts, restarts, 0) {
+		logger.Warnf("not restarting VM after %d restarts", restarts)
+		return false
+	}
+
+	// Wait out the first backoff while the VM is still visible so that it can
+	// be destroyed instead.
+	backoff := restartBackoff(restarts)
+	logger.Infof("restarting VM in %v", backoff)
+	select {
+	case <-vm.stopSupervisorCh:
+		return true
+	case <-time.After(backoff):
+	}
+
+	// The VM stays visible while it's recreated so that it can be listed and
+	// destroyed. Its name stays reserved so that it can't be started anew
+	// meanwhile.
+	key := vm.key()
+	s.lock.Lock()
+	if isClosed(vm.stopSupervisorCh) {
+		s.lock.Unlock()
+		return true
+	}
+	vm.status = vmStatusRestarting
+	s.starting[key] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.starting, key)
+		s.lock.Unlock()
+	}()
+
+	s.teardownVM(context.Background(), vm)
+	s.lock.Lock()
+	vm.tornDown = true
+	s.lock.Unlock()
+
+	// Destroying the VM while it's restarting leaves releasing its ports and
+	// resources to the restart.
+	release := func() {
+		s.releasePorts(key, vm.spec.ports)
+		s.releaseResources(vm.tenant, specUsage(vm.spec))
+	}
+
+	for failedAttempts := 0; ; failedAttempts++ {
+		if isClosed(vm.stopSupervisorCh) {
+			logger.Info("VM destroyed while restarting")
+			release()
+			return true
+		}
+
+		restarts++
+		err := s.createVM(context.Background(), vm.tenant, vm.name, vm.spec, false, 0, vm)
+		if err == nil {
+			s.lock.Lock()
+			destroyed := isClosed(vm.stopSupervisorCh)
+			if newVM, ok := s.vms[key]; ok && !destroyed {
+				newVM.restarts = restarts
+			}
+			s.lock.Unlock()
+			if destroyed {
+				logger.Info("VM destroyed while restarting")
+				err = s.destroyVM(context.Background(), key)
+				if err != nil {
+					logger.WithError(err).Warn("failed to destroy restarted VM")
+				}
+				return true
+			}
+			logger.Infof("restarted VM (restarts: %d)", restarts)
+			return true
+		}
+		logger.WithError(err).Errorf("failed to restart VM")
+
+		if restartsExhausted(vm.spec.maxRestarts, restarts, failedAttempts+1) {
+			logger.Errorf("giving up on restarting VM after %d restarts", restarts)
+			// Left crashed so that it's visible until it's destroyed, which
+			// releases its ports and resources.
+			s.lock.Lock()
+			destroyed := isClosed(vm.stopSupervisorCh)
+			if !destroyed {
+				vm.status = vmStatusCrashed
+				vm.restarts = restarts
+			}
+			s.lock.Unlock()
+			if destroyed {
+				release()
+			}
+			return true
+		}
+
+		select {
+		case <-vm.stopSupervisorCh:
+		case <-time.After(restartBackoff(restarts)):
+		}
+	}
+}
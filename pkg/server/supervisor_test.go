@@ -0,0 +1,148 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		restarts int
+		want     time.Duration
+	}{
+		{restarts: 0, want: restartBackoffBase},
+		{restarts: 1, want: 2 * restartBackoffBase},
+		{restarts: 3, want: 8 * restartBackoffBase},
+		{restarts: 5, want: 32 * restartBackoffBase},
+		{restarts: 6, want: restartBackoffMax},
+		{restarts: 100, want: restartBackoffMax},
+		// Doubling this often would overflow without the cap.
+		{restarts: 1000, want: restartBackoffMax},
+	}
+
+	for _, tc := range tests {
+		got := restartBackoff(tc.restarts)
+		if got != tc.want {
+			t.Errorf("restartBackoff(%d) = %v, want %v", tc.restarts, got, tc.want)
+		}
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    restartPolicy
+		wantErr bool
+	}{
+		{policy: "", want: restartPolicyNever},
+		{policy: "never", want: restartPolicyNever},
+		{policy: "on-failure", want: restartPolicyOnFailure},
+		{policy: "always", want: restartPolicyAlways},
+		{policy: "Always", wantErr: true},
+		{policy: "unless-stopped", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseRestartPolicy(tc.policy)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseRestartPolicy(%q): expected an error", tc.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRestartPolicy(%q): unexpected error: %v", tc.policy, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseRestartPolicy(%q) = %v, want %v", tc.policy, got, tc.want)
+		}
+		// Policies are returned by the API by their name.
+		if tc.policy != "" && got.String() != tc.policy {
+			t.Errorf("%v.String() = %q, want %q", got, got.String(), tc.policy)
+		}
+	}
+}
+
+func TestRestartsExhausted(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxRestarts    int
+		restarts       int
+		failedAttempts int
+		want           bool
+	}{
+		{name: "unlimited", maxRestarts: 0, restarts: 1000, want: false},
+		{name: "below max", maxRestarts: 3, restarts: 2, want: false},
+		{name: "at max", maxRestarts: 3, restarts: 3, want: true},
+		{name: "above max", maxRestarts: 3, restarts: 4, want: true},
+		{
+			name:           "failed attempts below limit",
+			restarts:       5,
+			failedAttempts: maxFailedRestartAttempts - 1,
+			want:           false,
+		},
+		{
+			name:           "failed attempts at limit",
+			restarts:       5,
+			failedAttempts: maxFailedRestartAttempts,
+			want:           true,
+		},
+		{
+			name:           "failed attempts at limit below max",
+			maxRestarts:    100,
+			restarts:       5,
+			failedAttempts: maxFailedRestartAttempts,
+			want:           true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := restartsExhausted(tc.maxRestarts, tc.restarts, tc.failedAttempts)
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestMaybeRestartVM covers the decisions `maybeRestartVM` makes before it
+// touches the VM. VMs that would be restarted are destroyed before their
+// backoff is over so that they aren't.
+func TestMaybeRestartVM(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      restartPolicy
+		maxRestarts int
+		restarts    int
+		failed      bool
+		want        bool
+	}{
+		{name: "never after failure", policy: restartPolicyNever, failed: true, want: false},
+		{name: "on-failure after clean exit", policy: restartPolicyOnFailure, failed: false, want: false},
+		{name: "on-failure after failure", policy: restartPolicyOnFailure, failed: true, want: true},
+		{name: "always after clean exit", policy: restartPolicyAlways, failed: false, want: true},
+		{name: "always below max", policy: restartPolicyAlways, maxRestarts: 3, restarts: 2, want: true},
+		{name: "always at max", policy: restartPolicyAlways, maxRestarts: 3, restarts: 3, want: false},
+		{name: "on-failure at max", policy: restartPolicyOnFailure, maxRestarts: 1, restarts: 1, failed: true, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			vm := &vm{
+				name:             "test",
+				spec:             vmSpec{restartPolicy: tc.policy, maxRestarts: tc.maxRestarts},
+				restarts:         tc.restarts,
+				stopSupervisorCh: make(chan struct{}),
+			}
+			close(vm.stopSupervisorCh)
+
+			got := s.maybeRestartVM(vm, tc.failed)
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultTenant owns VMs created without a tenant in their context, e.g. when
+// authentication is disabled.
+const defaultTenant = "default"
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type tenantContextKey struct{}
+
+// WithTenant returns a copy of `ctx` acting for `tenant`. Every `Server`
+// method only sees and manages VMs of the tenant in its context.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+func tenantFromContext(ctx context.Context) string {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	if !ok || tenant == "" {
+		return defaultTenant
+	}
+	return tenant
+}
+
+func validateTenant(tenant string) error {
+	if !tenantNameRegexp.MatchString(tenant) {
+		return status.Errorf(codes.InvalidArgument, "invalid tenant name: %q", tenant)
+	}
+	return nil
+}
+
+// vmKey returns the key of a VM in `Server.vms`. VM names are only unique
+// within a tenant. The default tenant's VMs are keyed by their name so that
+// their tap devices keep their names.
+func vmKey(tenant string, vmName string) string {
+	if tenant == defaultTenant {
+		return vmName
+	}
+	return tenant + "/" + vmName
+}
+
+func (v *vm) key() string {
+	return vmKey(v.tenant, v.name)
+}
+
+// getVM returns the VM called `vmName` owned by the tenant in `ctx`. VMs of
+// other tenants aren't found so that their names don't leak.
+func (s *Server) getVM(ctx context.Context, vmName string) (*vm, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	vm, ok := s.vms[vmKey(tenantFromContext(ctx), vmName)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	return vm, nil
+}
+
+// resourceUsage is what VMs count against their tenant's quota.
+type resourceUsage struct {
+	vms         int
+	vcpus       int
+	memoryBytes int64
+	ips         int
+}
+
+func specUsage(spec vmSpec) resourceUsage {
+	return resourceUsage{
+		vms:         1,
+		vcpus:       spec.vcpus,
+		memoryBytes: spec.memoryBytes,
+		ips:         1,
+	}
+}
+
+func (u resourceUsage) minus(other resourceUsage) resourceUsage {
+	return resourceUsage{
+		vms:         u.vms - other.vms,
+		vcpus:       u.vcpus - other.vcpus,
+		memoryBytes: u.memoryBytes - other.memoryBytes,
+		ips:         u.ips - other.ips,
+	}
+}
+
+func (s *Server) getQuota(tenant string) config.QuotaConfig {
+	if quota, ok := s.config.TenantQuotas[tenant]; ok {
+		return quota
+	}
+	return s.config.DefaultQuota
+}
+
+// reserveResources counts `usage` against the quota of `tenant`, failing if it
+// would exceed it. It must be released with `releaseResources` once the VM
+// using it is gone.
+func (s *Server) reserveResources(tenant string, usage resourceUsage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := s.tenantUsage[tenant]
+	err := s.checkQuota(tenant, current, usage)
+	if err != nil {
+		return err
+	}
+
+	current.vms += usage.vms
+	current.vcpus += usage.vcpus
+	current.memoryBytes += usage.memoryBytes
+	current.ips += usage.ips
+	s.tenantUsage[tenant] = current
+	return nil
+}
+
+// checkQuota fails if adding `usage` to the `current` usage of `tenant` would
+// exceed its quota.
+func (s *Server) checkQuota(tenant string, current resourceUsage, usage resourceUsage) error {
+	quota := s.getQuota(tenant)
+	exceeds := func(used int64, requested int64, limit int64) bool {
+		return limit > 0 && used+requested > limit
+	}
+
+	if exceeds(int64(current.vms), int64(usage.vms), int64(quota.MaxVMs)) {
+		return quotaError(tenant, "VMs", current.vms, quota.MaxVMs)
+	}
+	if exceeds(int64(current.vcpus), int64(usage.vcpus), int64(quota.MaxVcpus)) {
+		return quotaError(tenant, "vCPUs", current.vcpus, quota.MaxVcpus)
+	}
+	maxMemoryBytes := int64(quota.MaxMemoryMB) * 1024 * 1024
+	if exceeds(current.memoryBytes, usage.memoryBytes, maxMemoryBytes) {
+		return quotaError(tenant, "MB of memory", int(current.memoryBytes/(1024*1024)), quota.MaxMemoryMB)
+	}
+	if exceeds(int64(current.ips), int64(usage.ips), int64(quota.MaxIPs)) {
+		return quotaError(tenant, "IPs", current.ips, quota.MaxIPs)
+	}
+	return nil
+}
+
+func quotaError(tenant string, resource string, used int, limit int) error {
+	return status.Error(
+		codes.ResourceExhausted,
+		fmt.Sprintf("tenant %s would exceed its quota of %d %s (%d in use)", tenant, limit, resource, used),
+	)
+}
+
+func (s *Server) releaseResources(tenant string, usage resourceUsage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := s.tenantUsage[tenant].minus(usage)
+	if current.vms <= 0 {
+		delete(s.tenantUsage, tenant)
+		return
+	}
+	s.tenantUsage[tenant] = current
+}
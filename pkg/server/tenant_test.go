@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+func newTestServer(quota config.QuotaConfig) *Server {
+	return &Server{
+		vms:         map[string]*vm{},
+		starting:    map[string]struct{}{},
+		tenantUsage: map[string]resourceUsage{},
+		hostPorts:   map[string]string{},
+		config:      config.ServerConfig{DefaultQuota: quota},
+	}
+}
+
+func testUsage(vcpus int, memoryMB int64) resourceUsage {
+	return resourceUsage{vms: 1, vcpus: vcpus, memoryBytes: memoryMB * 1024 * 1024, ips: 1}
+}
+
+func TestVMKey(t *testing.T) {
+	tests := []struct {
+		tenant string
+		vmName string
+		want   string
+	}{
+		// Keeps the tap device names of VMs created before tenants.
+		{tenant: defaultTenant, vmName: "web", want: "web"},
+		{tenant: "acme", vmName: "web", want: "acme/web"},
+		{tenant: "acme-2", vmName: "web", want: "acme-2/web"},
+	}
+
+	for _, tc := range tests {
+		got := vmKey(tc.tenant, tc.vmName)
+		if got != tc.want {
+			t.Errorf("vmKey(%q, %q) = %q, want %q", tc.tenant, tc.vmName, got, tc.want)
+		}
+	}
+
+	if vmKey("acme", "web") == vmKey("other", "web") {
+		t.Error("VMs of different tenants with the same name have the same key")
+	}
+}
+
+func TestReserveResources(t *testing.T) {
+	quota := config.QuotaConfig{MaxVMs: 3, MaxVcpus: 4, MaxMemoryMB: 2048, MaxIPs: 3}
+
+	tests := []struct {
+		name     string
+		reserved []resourceUsage
+		request  resourceUsage
+		wantErr  bool
+	}{
+		{name: "first VM", request: testUsage(2, 1024)},
+		{name: "up to the quota", reserved: []resourceUsage{testUsage(2, 1024)}, request: testUsage(2, 1024)},
+		{name: "too many vCPUs", reserved: []resourceUsage{testUsage(3, 512)}, request: testUsage(2, 512), wantErr: true},
+		{name: "too much memory", reserved: []resourceUsage{testUsage(1, 1536)}, request: testUsage(1, 1024), wantErr: true},
+		{
+			name:     "too many VMs",
+			reserved: []resourceUsage{testUsage(1, 256), testUsage(1, 256), testUsage(1, 256)},
+			request:  testUsage(1, 256),
+			wantErr:  true,
+		},
+		{name: "single VM over the quota", request: testUsage(8, 512), wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(quota)
+			for _, usage := range tc.reserved {
+				err := s.reserveResources("acme", usage)
+				if err != nil {
+					t.Fatalf("failed to reserve: %v", err)
+				}
+			}
+			before := s.tenantUsage["acme"]
+
+			err := s.reserveResources("acme", tc.request)
+			if tc.wantErr {
+				// Mapped to 429 by the restserver.
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Fatalf("expected ResourceExhausted, got: %v", err)
+				}
+				if s.tenantUsage["acme"] != before {
+					t.Errorf("failed reservation changed usage from %+v to %+v", before, s.tenantUsage["acme"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReleaseResources(t *testing.T) {
+	s := newTestServer(config.QuotaConfig{MaxVcpus: 4})
+
+	for _, vcpus := range []int{1, 3} {
+		err := s.reserveResources("acme", testUsage(vcpus, 512))
+		if err != nil {
+			t.Fatalf("failed to reserve: %v", err)
+		}
+	}
+	err := s.reserveResources("acme", testUsage(1, 512))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got: %v", err)
+	}
+	// Other tenants have quotas of their own.
+	err = s.reserveResources("other", testUsage(4, 512))
+	if err != nil {
+		t.Fatalf("unexpected error for other tenant: %v", err)
+	}
+
+	s.releaseResources("acme", testUsage(3, 512))
+	want := testUsage(1, 512)
+	if s.tenantUsage["acme"] != want {
+		t.Errorf("got usage %+v, want %+v", s.tenantUsage["acme"], want)
+	}
+	err = s.reserveResources("acme", testUsage(3, 512))
+	if err != nil {
+		t.Fatalf("failed to reserve released resources: %v", err)
+	}
+
+	s.releaseResources("acme", testUsage(3, 512))
+	s.releaseResources("acme", testUsage(1, 512))
+	if usage, ok := s.tenantUsage["acme"]; ok {
+		t.Errorf("expected no usage once every VM is released, got %+v", usage)
+	}
+	if s.tenantUsage["other"] != testUsage(4, 512) {
+		t.Errorf("releasing changed the usage of another tenant: %+v", s.tenantUsage["other"])
+	}
+}
+
+// TestStartVMFailureReleasesResources checks that a VM that fails to start
+// doesn't keep counting against its tenant's quota.
+func TestStartVMFailureReleasesResources(t *testing.T) {
+	s := newTestServer(config.QuotaConfig{MaxVMs: 1})
+	port := portForward{hostPort: 8080, guestPort: 80, protocol: protocolTCP}
+	// Held by another tenant's VM so that the start fails after reserving
+	// resources.
+	s.hostPorts[port.key()] = vmKey("other", "web")
+
+	ctx := WithTenant(context.Background(), "acme")
+	spec := vmSpec{vcpus: 1, memoryBytes: 512 * 1024 * 1024, ports: []portForward{port}}
+	_, err := s.startVM(ctx, "web", spec, false, time.Second)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got: %v", err)
+	}
+
+	if usage, ok := s.tenantUsage["acme"]; ok {
+		t.Errorf("failed start left usage %+v", usage)
+	}
+	if _, ok := s.starting[vmKey("acme", "web")]; ok {
+		t.Error("failed start left the VM name reserved")
+	}
+	if s.hostPorts[port.key()] != vmKey("other", "web") {
+		t.Errorf("failed start changed the owner of port %s", port.key())
+	}
+
+	err = s.reserveResources("acme", testUsage(1, 512))
+	if err != nil {
+		t.Errorf("failed to reserve after failed start: %v", err)
+	}
+}
+
+func TestCheckStartVM(t *testing.T) {
+	s := newTestServer(config.QuotaConfig{MaxVcpus: 4})
+	current := vmSpec{vcpus: 3, memoryBytes: 512 * 1024 * 1024}
+	s.vms[vmKey("acme", "web")] = &vm{name: "web", tenant: "acme", spec: current}
+	err := s.reserveResources("acme", specUsage(current))
+	if err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+
+	// The existing VM's resources count as released when replacing it.
+	err = s.checkStartVM("acme", "web", vmSpec{vcpus: 4, memoryBytes: 512 * 1024 * 1024})
+	if err != nil {
+		t.Errorf("unexpected error replacing VM: %v", err)
+	}
+
+	err = s.checkStartVM("acme", "api", vmSpec{vcpus: 2, memoryBytes: 512 * 1024 * 1024})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for new VM, got: %v", err)
+	}
+
+	if s.tenantUsage["acme"] != specUsage(current) {
+		t.Errorf("checking changed usage to %+v", s.tenantUsage["acme"])
+	}
+}
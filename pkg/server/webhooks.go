@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/chv-starter-pack/pkg/config"
+)
+
+const (
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookTimeout     = 10 * time.Second
+	webhookBackoffBase        = 1 * time.Second
+	webhookBackoffMax         = 1 * time.Minute
+
+	webhookSignatureHeader = "X-Chv-Signature"
+	webhookEventHeader     = "X-Chv-Event"
+	webhookDeliveryHeader  = "X-Chv-Delivery"
+)
+
+// webhook delivers events to a configured endpoint. Deliveries are sequential
+// so that the endpoint sees events in order.
+type webhook struct {
+	config      config.WebhookConfig
+	eventTypes  map[EventType]bool
+	maxAttempts int
+	client      *http.Client
+}
+
+func newWebhook(cfg config.WebhookConfig) (*webhook, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webhook url: %s", cfg.URL)
+	}
+
+	eventTypes := make(map[EventType]bool)
+	for _, name := range cfg.Events {
+		eventType, err := ParseEventType(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook events: %s: %w", cfg.URL, err)
+		}
+		eventTypes[eventType] = true
+	}
+
+	maxAttempts := defaultWebhookMaxAttempts
+	if cfg.MaxAttempts > 0 {
+		maxAttempts = cfg.MaxAttempts
+	}
+
+	timeout := defaultWebhookTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+
+	return &webhook{
+		config:      cfg,
+		eventTypes:  eventTypes,
+		maxAttempts: maxAttempts,
+		client:      &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *webhook) wants(event Event) bool {
+	return len(w.eventTypes) == 0 || w.eventTypes[event.Type]
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of `payload`.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) post(event Event, payload []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(event.Type))
+	// Lets the endpoint drop duplicates of retried deliveries.
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(event.ID, 10))
+	if w.config.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(w.config.Secret, payload))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %v", resp.Status)
+	}
+	return nil
+}
+
+// deliver posts `event`, retrying with exponential backoff. The event is
+// dropped after `maxAttempts` failures.
+func (w *webhook) deliver(event Event) {
+	logger := log.WithFields(log.Fields{"webhook": w.config.URL, "eventID": event.ID})
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Error("failed to marshal event")
+		return
+	}
+
+	backoff := webhookBackoffBase
+	for attempt := 1; attempt <= w.maxAttempts; attempt++ {
+		err = w.post(event, payload)
+		if err == nil {
+			return
+		}
+
+		logger.Warnf("failed to deliver event (%d/%d): %v", attempt, w.maxAttempts, err)
+		if attempt < w.maxAttempts {
+			time.Sleep(backoff)
+			backoff = min(2*backoff, webhookBackoffMax)
+		}
+	}
+	logger.Errorf("dropping event after %d failed deliveries", w.maxAttempts)
+}
+
+// run delivers the events of the webhook's tenant, or of every tenant if it
+// has none, for the lifetime of the server. A slow endpoint makes it fall
+// behind the bus, in which case it resubscribes after the last event it
+// delivered.
+func (w *webhook) run(bus *eventBus) {
+	var lastID uint64
+	subscriber := bus.subscribe(w.config.Tenant, lastID)
+	for {
+		for event := range subscriber.ch {
+			if event.Type == EventReset {
+				log.WithField("webhook", w.config.URL).Warn(event.Message)
+			} else if w.wants(event) {
+				w.deliver(event)
+			}
+			lastID = event.ID
+		}
+
+		log.WithField("webhook", w.config.URL).Warnf("webhook fell behind, resuming after event: %d", lastID)
+		subscriber = bus.subscribe(w.config.Tenant, lastID)
+	}
+}
+
+// startWebhooks starts delivering events to the webhooks in the server config.
+func (s *Server) startWebhooks() error {
+	for _, cfg := range s.config.Webhooks {
+		w, err := newWebhook(cfg)
+		if err != nil {
+			return err
+		}
+		go w.run(s.events)
+	}
+	return nil
+}